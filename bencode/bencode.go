@@ -0,0 +1,93 @@
+// Package bencode implements the encoding used by .torrent files, trackers
+// and the DHT. It maps Go values to bencoded values like encoding/json does
+// to JSON:
+//
+//   - integers (and bools, as 0 and 1) are encoded as integers
+//   - strings, byte slices and byte arrays are encoded as strings
+//   - slices and arrays are encoded as lists
+//   - maps with string keys and structs are encoded as dictionaries
+//
+// Struct fields are named by the "bencode" struct tag, which may have the
+// "omitempty" option. Fields of embedded structs are promoted, so common
+// fields can be shared between message types. Dictionaries are always
+// encoded with sorted keys, and the decoder rejects everything that isn't
+// in canonical form, so that re-encoding a decoded value yields the same
+// bytes.
+//
+// Decoding into an interface{} yields int64, string, []interface{} and
+// map[string]interface{} values. RawMessage keeps the undecoded bytes of a
+// value.
+package bencode
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// DefaultMaxDepth is the default limit for the nesting of lists and dictionaries
+const DefaultMaxDepth = 100
+
+// DefaultMaxLength is the default limit for the encoded length of a value
+// read by a Decoder
+const DefaultMaxLength = 256 << 20
+
+// RawMessage is a raw encoded bencode value. It can be used to delay
+// decoding, or to keep the exact bytes of a value, e.g. to hash them.
+type RawMessage []byte
+
+// MarshalBencode returns m as the encoding of m
+func (m RawMessage) MarshalBencode() ([]byte, error) {
+	if len(m) == 0 {
+		return nil, fmt.Errorf("Empty RawMessage")
+	}
+	return m, nil
+}
+
+// UnmarshalBencode sets *m to a copy of data
+func (m *RawMessage) UnmarshalBencode(data []byte) error {
+	*m = append((*m)[0:0], data...)
+	return nil
+}
+
+// Marshaler is implemented by types that encode themselves. The returned
+// bytes must be a single valid bencoded value.
+type Marshaler interface {
+	MarshalBencode() ([]byte, error)
+}
+
+// Unmarshaler is implemented by types that decode themselves. data is a
+// single valid bencoded value, which must be copied if it is retained.
+type Unmarshaler interface {
+	UnmarshalBencode(data []byte) error
+}
+
+// SyntaxError describes malformed or non-canonical input
+type SyntaxError struct {
+	Offset int64 // offset of the error in the input
+	msg    string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("%s at offset %d", e.msg, e.Offset)
+}
+
+// UnmarshalTypeError describes a value that can't be stored in a Go type
+type UnmarshalTypeError struct {
+	Value  string // "integer", "string", "list" or "dictionary"
+	Type   reflect.Type
+	Offset int64
+}
+
+func (e *UnmarshalTypeError) Error() string {
+	return fmt.Sprintf("Can't decode bencode %s into Go value of type %s at offset %d", e.Value, e.Type, e.Offset)
+}
+
+// UnsupportedTypeError is returned when encoding a value of a type that has
+// no bencode representation, e.g. floats
+type UnsupportedTypeError struct {
+	Type reflect.Type
+}
+
+func (e *UnsupportedTypeError) Error() string {
+	return fmt.Sprintf("Can't encode Go value of type %s", e.Type)
+}
@@ -0,0 +1,345 @@
+package bencode
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+)
+
+var unmarshalerType = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
+
+// Unmarshal decodes the bencoded value in data into v, which must be a
+// non-nil pointer. data must contain exactly one value in canonical form.
+// Dictionary keys without a matching struct field are ignored.
+func Unmarshal(data []byte, v interface{}) error {
+	_, err := scan(data, DefaultMaxDepth)
+	if err != nil {
+		return err
+	}
+	return unmarshalValid(data, v)
+}
+
+func unmarshalValid(data []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("Need a non-nil pointer to decode into, got %T", v)
+	}
+	d := decodeState{data: data}
+	return d.value(rv.Elem())
+}
+
+// A Decoder reads bencoded values from a stream
+type Decoder struct {
+	r         *bufio.Reader
+	MaxDepth  int   // maximum nesting of lists and dictionaries
+	MaxLength int64 // maximum encoded length of a value, 0 for no limit
+}
+
+// NewDecoder returns a decoder reading from r, with the default limits
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{
+		r:         bufio.NewReader(r),
+		MaxDepth:  DefaultMaxDepth,
+		MaxLength: DefaultMaxLength,
+	}
+}
+
+// Decode reads the next value from the stream and stores it in v, see
+// Unmarshal. Reading stops right after the value.
+func (d *Decoder) Decode(v interface{}) error {
+	var raw bytes.Buffer
+	s := &scanner{
+		r:         d.r,
+		record:    &raw,
+		maxDepth:  d.MaxDepth,
+		maxLength: d.MaxLength,
+	}
+	err := s.value(0)
+	if err != nil {
+		return err
+	}
+	return unmarshalValid(raw.Bytes(), v)
+}
+
+// decodeState decodes data that has already been validated by the scanner
+type decodeState struct {
+	data []byte
+	off  int
+}
+
+func (d *decodeState) typeError(value string, t reflect.Type) error {
+	return &UnmarshalTypeError{Value: value, Type: t, Offset: int64(d.off)}
+}
+
+// skip returns the end offset of the value at offset off
+func (d *decodeState) skip(off int) int {
+	switch c := d.data[off]; {
+	case c == 'i':
+		return off + bytes.IndexByte(d.data[off:], 'e') + 1
+	case c == 'l' || c == 'd':
+		off++
+		for d.data[off] != 'e' {
+			off = d.skip(off)
+		}
+		return off + 1
+	default:
+		colon := off + bytes.IndexByte(d.data[off:], ':')
+		n, _ := strconv.Atoi(string(d.data[off:colon]))
+		return colon + 1 + n
+	}
+}
+
+func (d *decodeState) value(v reflect.Value) error {
+	// allocate pointers and look for unmarshalers on the way
+	for {
+		if v.CanAddr() && v.Addr().Type().Implements(unmarshalerType) {
+			end := d.skip(d.off)
+			err := v.Addr().Interface().(Unmarshaler).UnmarshalBencode(d.data[d.off:end])
+			d.off = end
+			return err
+		}
+		if v.Kind() != reflect.Ptr {
+			break
+		}
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		v = v.Elem()
+	}
+
+	if v.Kind() == reflect.Interface && v.NumMethod() == 0 {
+		generic, err := d.generic()
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(generic))
+		return nil
+	}
+
+	switch c := d.data[d.off]; {
+	case c == 'i':
+		return d.integer(v)
+	case c == 'l':
+		return d.list(v)
+	case c == 'd':
+		return d.dict(v)
+	default:
+		return d.str(v)
+	}
+}
+
+func (d *decodeState) readInt() int64 {
+	end := d.off + bytes.IndexByte(d.data[d.off:], 'e')
+	n, _ := strconv.ParseInt(string(d.data[d.off+1:end]), 10, 64)
+	d.off = end + 1
+	return n
+}
+
+func (d *decodeState) readString() []byte {
+	colon := d.off + bytes.IndexByte(d.data[d.off:], ':')
+	n, _ := strconv.Atoi(string(d.data[d.off:colon]))
+	s := d.data[colon+1 : colon+1+n]
+	d.off = colon + 1 + n
+	return s
+}
+
+func (d *decodeState) integer(v reflect.Value) error {
+	start := d.off
+	n := d.readInt()
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if v.OverflowInt(n) {
+			d.off = start
+			return d.typeError("integer "+strconv.FormatInt(n, 10), v.Type())
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if n < 0 || v.OverflowUint(uint64(n)) {
+			d.off = start
+			return d.typeError("integer "+strconv.FormatInt(n, 10), v.Type())
+		}
+		v.SetUint(uint64(n))
+	case reflect.Bool:
+		v.SetBool(n != 0)
+	default:
+		d.off = start
+		return d.typeError("integer", v.Type())
+	}
+	return nil
+}
+
+func (d *decodeState) str(v reflect.Value) error {
+	start := d.off
+	s := d.readString()
+	switch {
+	case v.Kind() == reflect.String:
+		v.SetString(string(s))
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+		v.SetBytes(append([]byte{}, s...))
+	case v.Kind() == reflect.Array && v.Type().Elem().Kind() == reflect.Uint8:
+		if len(s) != v.Len() {
+			d.off = start
+			return d.typeError(fmt.Sprintf("string of length %d", len(s)), v.Type())
+		}
+		reflect.Copy(v, reflect.ValueOf(s))
+	default:
+		d.off = start
+		return d.typeError("string", v.Type())
+	}
+	return nil
+}
+
+func (d *decodeState) list(v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Slice:
+		d.off++
+		v.Set(reflect.MakeSlice(v.Type(), 0, 0))
+		for d.data[d.off] != 'e' {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			err := d.value(elem)
+			if err != nil {
+				return err
+			}
+			v.Set(reflect.Append(v, elem))
+		}
+		d.off++
+	case reflect.Array:
+		d.off++
+		i := 0
+		for ; d.data[d.off] != 'e'; i++ {
+			if i >= v.Len() {
+				return d.typeError("list with more than "+strconv.Itoa(v.Len())+" elements", v.Type())
+			}
+			err := d.value(v.Index(i))
+			if err != nil {
+				return err
+			}
+		}
+		d.off++
+		for ; i < v.Len(); i++ {
+			v.Index(i).Set(reflect.Zero(v.Type().Elem()))
+		}
+	default:
+		return d.typeError("list", v.Type())
+	}
+	return nil
+}
+
+func (d *decodeState) dict(v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return d.typeError("dictionary", v.Type())
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		d.off++
+		for d.data[d.off] != 'e' {
+			key := reflect.ValueOf(string(d.readString())).Convert(v.Type().Key())
+			elem := reflect.New(v.Type().Elem()).Elem()
+			err := d.value(elem)
+			if err != nil {
+				return err
+			}
+			v.SetMapIndex(key, elem)
+		}
+		d.off++
+	case reflect.Struct:
+		fields := cachedFields(v.Type())
+		d.off++
+		for d.data[d.off] != 'e' {
+			key := string(d.readString())
+			f := findField(fields, key)
+			if f == nil {
+				d.off = d.skip(d.off)
+				continue
+			}
+			fv, err := d.fieldByIndex(v, f.index)
+			if err != nil {
+				return err
+			}
+			err = d.value(fv)
+			if err != nil {
+				return err
+			}
+		}
+		d.off++
+	default:
+		return d.typeError("dictionary", v.Type())
+	}
+	return nil
+}
+
+// fieldByIndex returns the field, allocating embedded nil pointers
+func (d *decodeState) fieldByIndex(v reflect.Value, index []int) (reflect.Value, error) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				if !v.CanSet() {
+					return reflect.Value{}, fmt.Errorf("Can't set embedded pointer to unexported struct %s", v.Type().Elem())
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, nil
+}
+
+// findField returns the field for a dictionary key. Fields are sorted by name.
+func findField(fields []field, name string) *field {
+	lo, hi := 0, len(fields)
+	for lo < hi {
+		mid := (lo + hi) / 2
+		if fields[mid].name < name {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	if lo < len(fields) && fields[lo].name == name {
+		return &fields[lo]
+	}
+	return nil
+}
+
+// generic decodes the next value into int64, string, []interface{} or
+// map[string]interface{}
+func (d *decodeState) generic() (interface{}, error) {
+	switch c := d.data[d.off]; {
+	case c == 'i':
+		return d.readInt(), nil
+	case c == 'l':
+		d.off++
+		list := []interface{}{}
+		for d.data[d.off] != 'e' {
+			elem, err := d.generic()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, elem)
+		}
+		d.off++
+		return list, nil
+	case c == 'd':
+		d.off++
+		dict := map[string]interface{}{}
+		for d.data[d.off] != 'e' {
+			key := string(d.readString())
+			elem, err := d.generic()
+			if err != nil {
+				return nil, err
+			}
+			dict[key] = elem
+		}
+		d.off++
+		return dict, nil
+	default:
+		return string(d.readString()), nil
+	}
+}
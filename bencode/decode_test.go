@@ -0,0 +1,146 @@
+package bencode
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnmarshal(t *testing.T) {
+	var generic interface{}
+	require.Nil(t, Unmarshal([]byte("d1:ali1e1:be1:bi-3e1:c3:abce"), &generic))
+	assert.Equal(t, map[string]interface{}{
+		"a": []interface{}{int64(1), "b"},
+		"b": int64(-3),
+		"c": "abc",
+	}, generic)
+
+	var q query
+	require.Nil(t, Unmarshal([]byte("d1:ad2:id2:abe1:q4:ping2:roi1e1:t2:aa7:unknownli1ee1:y1:qe"), &q))
+	assert.Equal(t, query{
+		Header:    Header{TransactionID: "aa", MessageType: "q"},
+		Method:    "ping",
+		ReadOnly:  true,
+		Arguments: map[string]string{"id": "ab"},
+	}, q)
+
+	var p withPointer
+	require.Nil(t, Unmarshal([]byte("d5:valuei7e1:y1:re"), &p))
+	require.NotNil(t, p.Header)
+	assert.Equal(t, "r", p.Header.MessageType)
+	assert.Equal(t, 7, *p.Value)
+
+	var f fileInfo
+	require.Nil(t, Unmarshal([]byte("d3:Rawd1:xi1ee4:hash4:abcd6:lengthi5e4:pathl1:a1:bee"), &f))
+	assert.Equal(t, fileInfo{
+		Length: 5,
+		Path:   []string{"a", "b"},
+		Hash:   [4]byte{'a', 'b', 'c', 'd'},
+		Raw:    RawMessage("d1:xi1ee"),
+	}, f)
+
+	var raw RawMessage
+	require.Nil(t, Unmarshal([]byte("l1:ae"), &raw))
+	assert.Equal(t, RawMessage("l1:ae"), raw)
+
+	var b []byte
+	require.Nil(t, Unmarshal([]byte("3:\x00\x01\x02"), &b))
+	assert.Equal(t, []byte{0, 1, 2}, b)
+
+	var u uint8
+	require.Nil(t, Unmarshal([]byte("i255e"), &u))
+	assert.Equal(t, uint8(255), u)
+
+	var arr [2]int
+	require.Nil(t, Unmarshal([]byte("li1ee"), &arr))
+	assert.Equal(t, [2]int{1, 0}, arr)
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	tests := map[string]struct {
+		input  string
+		target interface{}
+	}{
+		"empty input":          {"", new(interface{})},
+		"leading zero":         {"i03e", new(int)},
+		"negative zero":        {"i-0e", new(int)},
+		"empty integer":        {"ie", new(int)},
+		"minus only":           {"i-e", new(int)},
+		"invalid integer":      {"i1x2e", new(int)},
+		"integer overflow":     {"i9223372036854775808e", new(int64)},
+		"string length zero":   {"01:a", new(string)},
+		"truncated string":     {"5:abc", new(string)},
+		"unterminated list":    {"li1e", new([]int)},
+		"unsorted keys":        {"d1:bi1e1:ai2ee", new(map[string]int)},
+		"duplicate keys":       {"d1:ai1e1:ai2ee", new(map[string]int)},
+		"non-string key":       {"di1ei2ee", new(map[string]int)},
+		"trailing data":        {"i1ei2e", new(int)},
+		"invalid value":        {"x", new(interface{})},
+		"string into int":      {"1:a", new(int)},
+		"int into string":      {"i1e", new(string)},
+		"list into struct":     {"le", new(query)},
+		"wrong array length":   {"3:abc", new([4]byte)},
+		"too many elements":    {"li1ei2ee", new([1]int)},
+		"overflows int8":       {"i128e", new(int8)},
+		"negative uint":        {"i-1e", new(uint)},
+		"not a pointer":        {"i1e", 1},
+		"field of wrong type":  {"d1:qi1ee", new(query)},
+		"too deep":             {strings.Repeat("l", DefaultMaxDepth+1) + strings.Repeat("e", DefaultMaxDepth+1), new(interface{})},
+		"huge string length":   {"99999999999999999999999:a", new(string)},
+		"negative string size": {"-1:a", new(string)},
+	}
+	for name, test := range tests {
+		err := Unmarshal([]byte(test.input), test.target)
+		assert.NotNil(t, err, name)
+	}
+}
+
+func TestDecoder(t *testing.T) {
+	dec := NewDecoder(strings.NewReader("i1ed1:ai2ee4:spam"))
+	var n int
+	require.Nil(t, dec.Decode(&n))
+	assert.Equal(t, 1, n)
+	var m map[string]int
+	require.Nil(t, dec.Decode(&m))
+	assert.Equal(t, map[string]int{"a": 2}, m)
+	var s string
+	require.Nil(t, dec.Decode(&s))
+	assert.Equal(t, "spam", s)
+	assert.NotNil(t, dec.Decode(&s))
+}
+
+func TestDecoderLimits(t *testing.T) {
+	dec := NewDecoder(strings.NewReader("l" + strings.Repeat("i1e", 100) + "e"))
+	dec.MaxLength = 50
+	var list []int
+	err := dec.Decode(&list)
+	require.NotNil(t, err)
+	assert.IsType(t, &SyntaxError{}, err)
+
+	dec = NewDecoder(strings.NewReader("lllleeee"))
+	dec.MaxDepth = 3
+	assert.NotNil(t, dec.Decode(new(interface{})))
+
+	// a bogus string length fails at the end of the input, instead of
+	// allocating the announced length
+	dec = NewDecoder(io.MultiReader(strings.NewReader("200000000:"), bytes.NewReader(make([]byte, 10))))
+	assert.NotNil(t, dec.Decode(new(string)))
+}
+
+func TestRoundTrip(t *testing.T) {
+	inputs := []string{
+		"d8:announce3:url4:infod6:lengthi1e4:name1:a12:piece lengthi16384e6:pieces0:ee",
+		"li-1ei0ei9223372036854775807e0:ledee",
+	}
+	for _, input := range inputs {
+		var generic interface{}
+		require.Nil(t, Unmarshal([]byte(input), &generic))
+		data, err := Marshal(generic)
+		require.Nil(t, err)
+		assert.Equal(t, input, string(data))
+	}
+}
@@ -0,0 +1,108 @@
+package bencode
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type Header struct {
+	TransactionID string `bencode:"t"`
+	MessageType   string `bencode:"y"`
+}
+
+type query struct {
+	Header
+	Method    string            `bencode:"q"`
+	ReadOnly  bool              `bencode:"ro,omitempty"`
+	Arguments map[string]string `bencode:"a"`
+}
+
+type withPointer struct {
+	*Header
+	Value *int `bencode:"value"`
+}
+
+type shadowing struct {
+	Header
+	MessageType int `bencode:"y"` // shadows Header.MessageType
+}
+
+type fileInfo struct {
+	Length int      `bencode:"length"`
+	Path   []string `bencode:"path"`
+	Md5sum string   `bencode:"md5sum,omitempty"`
+	Hash   [4]byte  `bencode:"hash"`
+	Raw    RawMessage
+	Skip   string `bencode:"-"`
+	hidden string
+}
+
+func TestMarshal(t *testing.T) {
+	value := 3
+	tests := map[string]struct {
+		input  interface{}
+		output string
+	}{
+		"integer":            {input: -42, output: "i-42e"},
+		"unsigned":           {input: uint64(1 << 63), output: "i9223372036854775808e"},
+		"bools":              {input: []bool{true, false}, output: "li1ei0ee"},
+		"string":             {input: "spam", output: "4:spam"},
+		"bytes":              {input: []byte{0, 1}, output: "2:\x00\x01"},
+		"byte array":         {input: [3]byte{'a', 'b', 'c'}, output: "3:abc"},
+		"empty string":       {input: "", output: "0:"},
+		"list":               {input: []interface{}{"a", 1, []int{}}, output: "l1:ai1elee"},
+		"nil slice":          {input: []string(nil), output: "le"},
+		"map is sorted":      {input: map[string]int{"b": 2, "a": 1, "B": 0}, output: "d1:Bi0e1:ai1e1:bi2ee"},
+		"sorted bytewise":    {input: map[string]int{"piece length": 1, "pieces": 2}, output: "d12:piece lengthi1e6:piecesi2ee"},
+		"raw message":        {input: []RawMessage{RawMessage("i1e"), RawMessage("d1:ali1eee")}, output: "li1ed1:ali1eeee"},
+		"pointer":            {input: &value, output: "i3e"},
+		"nil embedded":       {input: withPointer{Value: &value}, output: "d5:valuei3ee"},
+		"embedded pointer":   {input: withPointer{Header: &Header{MessageType: "q"}}, output: "d1:t0:1:y1:qe"},
+		"shadowed field":     {input: shadowing{Header: Header{MessageType: "q"}, MessageType: 1}, output: "d1:t0:1:yi1ee"},
+		"struct omits empty": {input: fileInfo{Length: 1, Raw: RawMessage("0:")}, output: "d3:Raw0:4:hash4:\x00\x00\x00\x006:lengthi1e4:pathlee"},
+		"embedded struct": {
+			input: query{
+				Header:    Header{TransactionID: "aa", MessageType: "q"},
+				Method:    "ping",
+				ReadOnly:  true,
+				Arguments: map[string]string{"id": "abcdefghij0123456789"},
+			},
+			output: "d1:ad2:id20:abcdefghij0123456789e1:q4:ping2:roi1e1:t2:aa1:y1:qe",
+		},
+	}
+
+	for name, test := range tests {
+		data, err := Marshal(test.input)
+		assert.Nil(t, err, name)
+		assert.Equal(t, test.output, string(data), name)
+	}
+}
+
+func TestMarshalErrors(t *testing.T) {
+	tests := map[string]interface{}{
+		"float":             1.5,
+		"non-string keys":   map[int]string{1: "a"},
+		"nil":               nil,
+		"nil in list":       []interface{}{nil},
+		"invalid raw":       RawMessage("i1"),
+		"raw with trailing": RawMessage("i1ei2e"),
+		"empty raw":         []RawMessage{{}},
+		"channel":           make(chan int),
+	}
+	for name, input := range tests {
+		_, err := Marshal(input)
+		assert.NotNil(t, err, name)
+	}
+}
+
+func TestEncoder(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	require.Nil(t, enc.Encode(1))
+	require.Nil(t, enc.Encode("a"))
+	assert.NotNil(t, enc.Encode([]interface{}{"b", 1.5}))
+	assert.Equal(t, "i1e1:a", buf.String())
+}
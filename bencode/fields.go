@@ -0,0 +1,126 @@
+package bencode
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// field is a struct field that is encoded as a dictionary key
+type field struct {
+	name      string
+	index     []int // index sequence for reflect.Value.FieldByIndex
+	omitEmpty bool
+}
+
+var fieldCache sync.Map // map[reflect.Type][]field
+
+// cachedFields returns the fields of the struct type t, sorted by name
+func cachedFields(t reflect.Type) []field {
+	if fields, ok := fieldCache.Load(t); ok {
+		return fields.([]field)
+	}
+	fields, _ := fieldCache.LoadOrStore(t, typeFields(t))
+	return fields.([]field)
+}
+
+// typeFields collects the fields of t, including the promoted fields of
+// embedded structs. Like encoding/json, a field shadows fields of the same
+// name at a deeper level, and fields of the same name at the same level
+// cancel each other out.
+func typeFields(t reflect.Type) []field {
+	type candidate struct {
+		field
+		tagged bool
+	}
+	var candidates []candidate
+
+	type level struct {
+		typ   reflect.Type
+		index []int
+	}
+	current := []level{{typ: t}}
+	visited := map[reflect.Type]bool{}
+	for len(current) > 0 {
+		var next []level
+		for _, l := range current {
+			if visited[l.typ] {
+				continue
+			}
+			visited[l.typ] = true
+			for i := 0; i < l.typ.NumField(); i++ {
+				sf := l.typ.Field(i)
+				tag := sf.Tag.Get("bencode")
+				if tag == "-" {
+					continue
+				}
+				name, opts := parseTag(tag)
+				index := append(append([]int{}, l.index...), i)
+
+				ft := sf.Type
+				if ft.Kind() == reflect.Ptr {
+					ft = ft.Elem()
+				}
+				if sf.Anonymous && name == "" && ft.Kind() == reflect.Struct {
+					next = append(next, level{typ: ft, index: index})
+					continue
+				}
+				if sf.PkgPath != "" {
+					continue // unexported
+				}
+				tagged := name != ""
+				if !tagged {
+					name = sf.Name
+				}
+				candidates = append(candidates, candidate{
+					field: field{
+						name:      name,
+						index:     index,
+						omitEmpty: opts == "omitempty",
+					},
+					tagged: tagged,
+				})
+			}
+		}
+		current = next
+	}
+
+	// candidates are ordered by depth, as the struct is walked level by level
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].name < candidates[j].name
+	})
+	var fields []field
+	for i := 0; i < len(candidates); {
+		j := i + 1
+		for j < len(candidates) && candidates[j].name == candidates[i].name {
+			j++
+		}
+		// only the shallowest fields of a name compete, a single tagged
+		// one wins over untagged ones
+		depth := len(candidates[i].index)
+		var shallowest, tagged []field
+		for _, c := range candidates[i:j] {
+			if len(c.index) == depth {
+				shallowest = append(shallowest, c.field)
+				if c.tagged {
+					tagged = append(tagged, c.field)
+				}
+			}
+		}
+		if len(tagged) == 1 {
+			fields = append(fields, tagged[0])
+		} else if len(shallowest) == 1 {
+			fields = append(fields, shallowest[0])
+		}
+		i = j
+	}
+	return fields
+}
+
+func parseTag(tag string) (string, string) {
+	if i := strings.Index(tag, ","); i >= 0 {
+		return tag[:i], tag[i+1:]
+	}
+	return tag, ""
+}
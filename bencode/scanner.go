@@ -0,0 +1,227 @@
+package bencode
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math"
+)
+
+// scanner reads a single bencoded value, checking that it is well-formed
+// and canonical: integers without leading zeros or negative zero, and
+// dictionary keys in strictly ascending order.
+type scanner struct {
+	r         *bufio.Reader
+	record    *bytes.Buffer // receives the bytes of the value, if not nil
+	offset    int64
+	maxDepth  int
+	maxLength int64 // 0 for no limit
+}
+
+func (s *scanner) syntaxError(msg string) error {
+	return &SyntaxError{Offset: s.offset, msg: msg}
+}
+
+func (s *scanner) checkLength(n int64) error {
+	if s.maxLength > 0 && s.offset+n > s.maxLength {
+		return s.syntaxError("Value exceeds maximum length")
+	}
+	return nil
+}
+
+func (s *scanner) readByte() (byte, error) {
+	err := s.checkLength(1)
+	if err != nil {
+		return 0, err
+	}
+	c, err := s.r.ReadByte()
+	if err == io.EOF {
+		return 0, s.syntaxError("Unexpected end of input")
+	}
+	if err != nil {
+		return 0, err
+	}
+	s.offset++
+	if s.record != nil {
+		s.record.WriteByte(c)
+	}
+	return c, nil
+}
+
+// value reads the value starting at the current position
+func (s *scanner) value(depth int) error {
+	c, err := s.readByte()
+	if err != nil {
+		return err
+	}
+	return s.valueAfter(c, depth)
+}
+
+// container reads the elements of a list or dictionary, up to and
+// including the terminating 'e'
+func (s *scanner) container(isDict bool, depth int) error {
+	var prevKey []byte
+	for first := true; ; first = false {
+		c, err := s.readByte()
+		if err != nil {
+			return err
+		}
+		if c == 'e' {
+			return nil
+		}
+		if !isDict {
+			err = s.valueAfter(c, depth+1)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if c < '0' || c > '9' {
+			return s.syntaxError("Dictionary key is not a string")
+		}
+		key, err := s.str(c, true)
+		if err != nil {
+			return err
+		}
+		if !first && bytes.Compare(prevKey, key) >= 0 {
+			return s.syntaxError("Dictionary keys are not sorted or not unique")
+		}
+		prevKey = key
+		err = s.value(depth + 1)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// valueAfter reads a value whose first byte c has already been read
+func (s *scanner) valueAfter(c byte, depth int) error {
+	switch {
+	case c == 'i':
+		_, err := s.integer(c, 'e')
+		return err
+	case c >= '0' && c <= '9':
+		_, err := s.str(c, false)
+		return err
+	case c == 'l' || c == 'd':
+		if depth >= s.maxDepth {
+			return s.syntaxError("Exceeded maximum nesting depth")
+		}
+		return s.container(c == 'd', depth)
+	}
+	return s.syntaxError("Invalid value")
+}
+
+// integer reads the digits of an integer up to the terminator. c is the
+// byte already read: 'i' for integers, or the first digit of a string length.
+func (s *scanner) integer(c byte, terminator byte) (int64, error) {
+	var digits []byte
+	if c != 'i' {
+		digits = append(digits, c)
+	}
+	for {
+		c, err := s.readByte()
+		if err != nil {
+			return 0, err
+		}
+		if c == terminator {
+			break
+		}
+		if len(digits) > 20 {
+			return 0, s.syntaxError("Integer too large")
+		}
+		digits = append(digits, c)
+	}
+
+	negative := len(digits) > 0 && digits[0] == '-'
+	if terminator != 'e' && negative {
+		return 0, s.syntaxError("Negative string length")
+	}
+	unsigned := digits
+	if negative {
+		unsigned = digits[1:]
+	}
+	if len(unsigned) == 0 {
+		return 0, s.syntaxError("Empty integer")
+	}
+	if unsigned[0] == '0' && (len(unsigned) > 1 || negative) {
+		return 0, s.syntaxError("Integer is not canonical")
+	}
+	var n uint64
+	for _, d := range unsigned {
+		if d < '0' || d > '9' {
+			return 0, s.syntaxError("Invalid integer")
+		}
+		if n > (math.MaxUint64-uint64(d-'0'))/10 {
+			return 0, s.syntaxError("Integer too large")
+		}
+		n = n*10 + uint64(d-'0')
+	}
+	if negative {
+		if n > 1<<63 {
+			return 0, s.syntaxError("Integer too large")
+		}
+		return -int64(n), nil
+	}
+	if n > math.MaxInt64 {
+		return 0, s.syntaxError("Integer too large")
+	}
+	return int64(n), nil
+}
+
+// str reads a string whose first length digit c has already been read.
+// The string is only returned if keep is set.
+func (s *scanner) str(c byte, keep bool) ([]byte, error) {
+	n, err := s.integer(c, ':')
+	if err != nil {
+		return nil, err
+	}
+	err = s.checkLength(n)
+	if err != nil {
+		return nil, err
+	}
+
+	var w io.Writer = ioutil.Discard
+	var kept bytes.Buffer
+	if keep {
+		w = &kept
+	}
+	if s.record != nil {
+		w = io.MultiWriter(w, s.record)
+	}
+	// copying instead of allocating n bytes up front means that a bogus
+	// length doesn't make us allocate more than the input actually has
+	copied, err := io.CopyN(w, s.r, n)
+	s.offset += copied
+	if err == io.EOF {
+		return nil, s.syntaxError("Unexpected end of input")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return kept.Bytes(), nil
+}
+
+// validate checks that data is exactly one canonical bencoded value
+func validate(data []byte) error {
+	_, err := scan(data, DefaultMaxDepth)
+	return err
+}
+
+// scan validates the value at the start of data and returns its length
+func scan(data []byte, maxDepth int) (int, error) {
+	s := &scanner{
+		r:        bufio.NewReader(bytes.NewReader(data)),
+		maxDepth: maxDepth,
+	}
+	err := s.value(0)
+	if err != nil {
+		return 0, err
+	}
+	if int(s.offset) != len(data) {
+		return 0, s.syntaxError("Trailing data after value")
+	}
+	return int(s.offset), nil
+}
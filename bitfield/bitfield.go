@@ -24,3 +24,14 @@ func (bf Bitfield) SetPiece(index int) {
 	}
 	bf[byteIndex] |= 1 << (7 - offset)
 }
+
+// Count returns the number of pieces set in the bitfield
+func (bf Bitfield) Count() int {
+	count := 0
+	for _, b := range bf {
+		for ; b != 0; b &= b - 1 {
+			count++
+		}
+	}
+	return count
+}
@@ -47,3 +47,9 @@ func TestSetPiece(t *testing.T) {
 		assert.Equal(t, test.outpt, bf)
 	}
 }
+
+func TestCount(t *testing.T) {
+	assert.Equal(t, 0, Bitfield{}.Count())
+	assert.Equal(t, 6, Bitfield{0b01010100, 0b01010100}.Count())
+	assert.Equal(t, 9, Bitfield{0xff, 0x80}.Count())
+}
@@ -2,33 +2,55 @@ package client
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/sjaensch/storrent/bitfield"
 	"github.com/sjaensch/storrent/peers"
+	"github.com/sjaensch/storrent/ratelimit"
 
 	"github.com/sjaensch/storrent/message"
 
 	"github.com/sjaensch/storrent/handshake"
 )
 
-// A Client is a TCP connection with a peer
+// A Client is a TCP connection with a peer. Only the goroutine using the
+// client changes its state, holding mu while doing so, so that Stats can be
+// called from anywhere.
 type Client struct {
-	Conn     net.Conn
-	Choked   bool
-	Bitfield bitfield.Bitfield
-	peer     peers.Peer
-	infoHash [20]byte
-	peerID   [20]byte
+	Conn           net.Conn
+	Choked         bool // the peer chokes us
+	Interested     bool // we are interested in the peer
+	PeerChoked     bool // we choke the peer
+	PeerInterested bool // the peer is interested in us
+	Bitfield       bitfield.Bitfield
+	Reserved       [8]byte // reserved bytes of the peer's handshake
+	// Extensions is set if the peer supports the extension protocol (BEP 10)
+	Extensions bool
+	// Reqq is the number of outstanding requests the peer accepts, as told
+	// in its extension handshake, or 0 if unknown
+	Reqq int
+
+	mu          sync.Mutex
+	download    *ratelimit.Meter
+	upload      *ratelimit.Meter
+	connectedAt time.Time
+	peer        peers.Peer
+	infoHash    [20]byte
+	peerID      [20]byte
 }
 
 func completeHandshake(conn net.Conn, infohash, peerID [20]byte) (*handshake.Handshake, error) {
+	return exchangeHandshake(conn, handshake.New(infohash, peerID))
+}
+
+func exchangeHandshake(conn net.Conn, req *handshake.Handshake) (*handshake.Handshake, error) {
 	conn.SetDeadline(time.Now().Add(3 * time.Second))
 	defer conn.SetDeadline(time.Time{}) // Disable the deadline
 
-	req := handshake.New(infohash, peerID)
 	_, err := conn.Write(req.Serialize())
 	if err != nil {
 		return nil, err
@@ -38,8 +60,8 @@ func completeHandshake(conn net.Conn, infohash, peerID [20]byte) (*handshake.Han
 	if err != nil {
 		return nil, err
 	}
-	if !bytes.Equal(res.InfoHash[:], infohash[:]) {
-		return nil, fmt.Errorf("Expected infohash %x but got %x", res.InfoHash, infohash)
+	if !bytes.Equal(res.InfoHash[:], req.InfoHash[:]) {
+		return nil, fmt.Errorf("Expected infohash %x but got %x", req.InfoHash, res.InfoHash)
 	}
 	return res, nil
 }
@@ -61,35 +83,61 @@ func recvBitfield(conn net.Conn) (bitfield.Bitfield, error) {
 }
 
 // New connects with a peer, completes a handshake, and receives a handshake
-// returns an err if any of those fail.
-func New(peer peers.Peer, peerID, infoHash [20]byte) (*Client, error) {
-	conn, err := net.DialTimeout("tcp", peer.String(), 3*time.Second)
+// returns an err if any of those fail. Cancelling ctx aborts connecting.
+func New(ctx context.Context, peer peers.Peer, peerID, infoHash [20]byte) (*Client, error) {
+	return Dial(ctx, peer, handshake.New(infoHash, peerID))
+}
+
+// Dial is like New, but sends the given handshake, e.g. one with reserved
+// bits set
+func Dial(ctx context.Context, peer peers.Peer, req *handshake.Handshake) (*Client, error) {
+	dialer := net.Dialer{Timeout: 3 * time.Second}
+	rawConn, err := dialer.DialContext(ctx, "tcp", peer.String())
 	if err != nil {
 		return nil, err
 	}
+	download, upload := ratelimit.NewMeter(), ratelimit.NewMeter()
+	conn := ratelimit.MeterConn(rawConn, download, upload)
 
-	_, err = completeHandshake(conn, infoHash, peerID)
+	res, err := exchangeHandshake(conn, req)
 	if err != nil {
 		conn.Close()
 		return nil, err
 	}
 
 	bf, err := recvBitfield(conn)
+	if err == nil {
+		err = ctx.Err()
+	}
 	if err != nil {
 		conn.Close()
 		return nil, err
 	}
 
 	return &Client{
-		Conn:     conn,
-		Choked:   true,
-		Bitfield: bf,
-		peer:     peer,
-		infoHash: infoHash,
-		peerID:   peerID,
+		Conn:        conn,
+		Choked:      true,
+		PeerChoked:  true,
+		Bitfield:    bf,
+		Reserved:    res.Reserved,
+		Extensions:  res.SupportsExtensionProtocol(),
+		download:    download,
+		upload:      upload,
+		connectedAt: time.Now(),
+		peer:        peer,
+		infoHash:    req.InfoHash,
+		peerID:      req.PeerID,
 	}, nil
 }
 
+// SetLimits throttles reads from and writes to the peer. Either limiter may
+// be nil. It should only be called once.
+func (c *Client) SetLimits(download, upload *ratelimit.Limiter) {
+	if download != nil || upload != nil {
+		c.Conn = ratelimit.NewConn(c.Conn, download, upload)
+	}
+}
+
 // Read reads and consumes a message from the connection
 func (c *Client) Read() (*message.Message, error) {
 	msg, err := message.Read(c.Conn)
@@ -105,6 +153,7 @@ func (c *Client) SendRequest(index, begin, length int) error {
 
 // SendInterested sends an Interested message to the peer
 func (c *Client) SendInterested() error {
+	c.setState(&c.Interested, true)
 	msg := message.Message{ID: message.MsgInterested}
 	_, err := c.Conn.Write(msg.Serialize())
 	return err
@@ -112,6 +161,7 @@ func (c *Client) SendInterested() error {
 
 // SendNotInterested sends a NotInterested message to the peer
 func (c *Client) SendNotInterested() error {
+	c.setState(&c.Interested, false)
 	msg := message.Message{ID: message.MsgNotInterested}
 	_, err := c.Conn.Write(msg.Serialize())
 	return err
@@ -119,6 +169,7 @@ func (c *Client) SendNotInterested() error {
 
 // SendUnchoke sends an Unchoke message to the peer
 func (c *Client) SendUnchoke() error {
+	c.setState(&c.PeerChoked, false)
 	msg := message.Message{ID: message.MsgUnchoke}
 	_, err := c.Conn.Write(msg.Serialize())
 	return err
@@ -206,3 +206,58 @@ func TestSendHave(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, expected, buf)
 }
+
+func TestSendExtendedHandshake(t *testing.T) {
+	clientConn, serverConn := createClientAndServer(t)
+	client := Client{Conn: clientConn}
+	err := client.SendExtendedHandshake(&ExtendedHandshake{V: "storrent"})
+	assert.Nil(t, err)
+	payload := "d1:mde1:v8:storrente"
+	expected := append([]byte{0x00, 0x00, 0x00, byte(2 + len(payload)), 20, 0}, payload...)
+	buf := make([]byte, len(expected))
+	_, err = serverConn.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, buf)
+}
+
+func TestHandleExtended(t *testing.T) {
+	tests := map[string]struct {
+		input *message.Message
+		reqq  int
+		fails bool
+	}{
+		"handshake with reqq": {
+			input: message.FormatExtended(0, []byte("d1:md11:ut_metadatai3ee4:reqqi500e1:v4:teste")),
+			reqq:  500,
+		},
+		"handshake without reqq": {
+			input: message.FormatExtended(0, []byte("d1:mdee")),
+			reqq:  250,
+		},
+		"other extended message": {
+			input: message.FormatExtended(3, []byte("garbage")),
+			reqq:  250,
+		},
+		"malformed handshake": {
+			input: message.FormatExtended(0, []byte("d1:m")),
+			reqq:  250,
+			fails: true,
+		},
+		"not an extended message": {
+			input: &message.Message{ID: message.MsgHave, Payload: []byte{0, 0, 0, 1}},
+			reqq:  250,
+			fails: true,
+		},
+	}
+
+	for name, test := range tests {
+		client := Client{Reqq: 250}
+		err := client.HandleExtended(test.input)
+		if test.fails {
+			assert.NotNil(t, err, name)
+		} else {
+			assert.Nil(t, err, name)
+		}
+		assert.Equal(t, test.reqq, client.Reqq, name)
+	}
+}
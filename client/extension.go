@@ -0,0 +1,49 @@
+package client
+
+import (
+	"github.com/sjaensch/storrent/bencode"
+	"github.com/sjaensch/storrent/message"
+)
+
+// ExtendedHandshake is the payload of the extension handshake (BEP 10)
+type ExtendedHandshake struct {
+	M    map[string]int `bencode:"m"`              // extended message IDs of the supported extensions
+	V    string         `bencode:"v,omitempty"`    // client name and version
+	Reqq int            `bencode:"reqq,omitempty"` // number of outstanding requests accepted
+}
+
+// SendExtendedHandshake sends the extension handshake to the peer
+func (c *Client) SendExtendedHandshake(h *ExtendedHandshake) error {
+	if h.M == nil {
+		h.M = map[string]int{}
+	}
+	payload, err := bencode.Marshal(h)
+	if err != nil {
+		return err
+	}
+	msg := message.FormatExtended(message.ExtendedHandshakeID, payload)
+	_, err = c.Conn.Write(msg.Serialize())
+	return err
+}
+
+// HandleExtended processes an EXTENDED message. The peer's extension
+// handshake sets Reqq, other extended messages are ignored, as we don't
+// announce any extensions.
+func (c *Client) HandleExtended(msg *message.Message) error {
+	id, payload, err := message.ParseExtended(msg)
+	if err != nil {
+		return err
+	}
+	if id != message.ExtendedHandshakeID {
+		return nil
+	}
+	var h ExtendedHandshake
+	err = bencode.Unmarshal(payload, &h)
+	if err != nil {
+		return err
+	}
+	if h.Reqq > 0 {
+		c.Reqq = h.Reqq
+	}
+	return nil
+}
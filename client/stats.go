@@ -0,0 +1,78 @@
+package client
+
+import (
+	"time"
+
+	"github.com/sjaensch/storrent/message"
+)
+
+// Stats is a snapshot of the statistics of a connection
+type Stats struct {
+	Addr           string
+	Downloaded     int64   // bytes read from the peer, including protocol overhead
+	Uploaded       int64   // bytes written to the peer
+	DownloadRate   float64 // bytes per second over the last seconds
+	UploadRate     float64 // bytes per second over the last seconds
+	Pieces         int     // number of pieces the peer has
+	Choked         bool    // the peer chokes us
+	Interested     bool    // we are interested in the peer
+	PeerChoked     bool    // we choke the peer
+	PeerInterested bool    // the peer is interested in us
+	Connected      time.Duration
+}
+
+// Stats returns the statistics of the connection. It may be called from any
+// goroutine.
+func (c *Client) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := Stats{
+		Addr:           c.peer.String(),
+		Downloaded:     c.download.Total(),
+		Uploaded:       c.upload.Total(),
+		DownloadRate:   c.download.Rate(),
+		UploadRate:     c.upload.Rate(),
+		Pieces:         c.Bitfield.Count(),
+		Choked:         c.Choked,
+		Interested:     c.Interested,
+		PeerChoked:     c.PeerChoked,
+		PeerInterested: c.PeerInterested,
+	}
+	if !c.connectedAt.IsZero() {
+		stats.Connected = time.Since(c.connectedAt)
+	}
+	return stats
+}
+
+func (c *Client) setState(field *bool, value bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	*field = value
+}
+
+// UpdateState keeps track of the peer's state as told by choke, unchoke,
+// interested, not interested and have messages. Other messages are ignored.
+func (c *Client) UpdateState(msg *message.Message) error {
+	if msg == nil {
+		return nil
+	}
+	switch msg.ID {
+	case message.MsgChoke:
+		c.setState(&c.Choked, true)
+	case message.MsgUnchoke:
+		c.setState(&c.Choked, false)
+	case message.MsgInterested:
+		c.setState(&c.PeerInterested, true)
+	case message.MsgNotInterested:
+		c.setState(&c.PeerInterested, false)
+	case message.MsgHave:
+		index, err := message.ParseHave(msg)
+		if err != nil {
+			return err
+		}
+		c.mu.Lock()
+		c.Bitfield.SetPiece(index)
+		c.mu.Unlock()
+	}
+	return nil
+}
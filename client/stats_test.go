@@ -0,0 +1,63 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/sjaensch/storrent/bitfield"
+	"github.com/sjaensch/storrent/message"
+	"github.com/sjaensch/storrent/ratelimit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpdateState(t *testing.T) {
+	client := Client{Choked: true, PeerChoked: true, Bitfield: bitfield.Bitfield{0x80, 0}}
+	msgs := []*message.Message{
+		{ID: message.MsgUnchoke},
+		{ID: message.MsgInterested},
+		message.FormatHave(9),
+		nil,
+		{ID: message.MsgPiece, Payload: []byte{0, 0, 0, 0, 0, 0, 0, 0}},
+	}
+	for _, msg := range msgs {
+		require.Nil(t, client.UpdateState(msg))
+	}
+	stats := client.Stats()
+	assert.False(t, stats.Choked)
+	assert.True(t, stats.PeerChoked)
+	assert.True(t, stats.PeerInterested)
+	assert.False(t, stats.Interested)
+	assert.Equal(t, 2, stats.Pieces)
+
+	require.Nil(t, client.UpdateState(&message.Message{ID: message.MsgChoke}))
+	require.Nil(t, client.UpdateState(&message.Message{ID: message.MsgNotInterested}))
+	assert.True(t, client.Stats().Choked)
+	assert.False(t, client.Stats().PeerInterested)
+
+	err := client.UpdateState(&message.Message{ID: message.MsgHave, Payload: []byte{1}})
+	assert.NotNil(t, err)
+}
+
+func TestStats(t *testing.T) {
+	clientConn, serverConn := createClientAndServer(t)
+	download, upload := ratelimit.NewMeter(), ratelimit.NewMeter()
+	client := Client{
+		Conn:       ratelimit.MeterConn(clientConn, download, upload),
+		PeerChoked: true,
+		download:   download,
+		upload:     upload,
+	}
+
+	require.Nil(t, client.SendInterested())
+	require.Nil(t, client.SendUnchoke())
+	_, err := serverConn.Write(message.FormatHave(1).Serialize())
+	require.Nil(t, err)
+	_, err = client.Read()
+	require.Nil(t, err)
+
+	stats := client.Stats()
+	assert.True(t, stats.Interested)
+	assert.False(t, stats.PeerChoked)
+	assert.Equal(t, int64(9), stats.Downloaded)
+	assert.Equal(t, int64(10), stats.Uploaded)
+}
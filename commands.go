@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	"github.com/sjaensch/storrent/p2p"
+	"github.com/sjaensch/storrent/ratelimit"
+)
+
+const commandsHelp = `While downloading, commands can be written to stdin, one per line:
+  download <rate>
+  upload <rate>
+change the limits, where rate is in bytes per second with an optional
+K, M or G suffix, or off.
+  pause
+  resume
+disconnect from all peers and continue later.
+`
+
+// readCommands applies the commands read from r, until r is exhausted
+func readCommands(r io.Reader, download, upload *ratelimit.Limiter, control *p2p.Control) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		err := applyCommand(scanner.Text(), download, upload, control)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func applyCommand(line string, download, upload *ratelimit.Limiter, control *p2p.Control) error {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil
+	}
+	switch {
+	case len(fields) == 1 && fields[0] == "pause":
+		control.Pause()
+		return nil
+	case len(fields) == 1 && fields[0] == "resume":
+		control.Resume()
+		return nil
+	case len(fields) != 2:
+		return fmt.Errorf("Invalid command %q, expected download|upload <rate>, pause or resume", line)
+	}
+	rate, err := ratelimit.ParseRate(fields[1])
+	if err != nil {
+		return err
+	}
+	switch fields[0] {
+	case "download":
+		download.SetRate(rate)
+	case "upload":
+		upload.SetRate(rate)
+	default:
+		return fmt.Errorf("Invalid command %q, expected download|upload <rate>, pause or resume", line)
+	}
+	log.Printf("Set %s limit to %s", fields[0], formatRate(rate))
+	return nil
+}
+
+func formatRate(rate int) string {
+	if rate == 0 {
+		return "unlimited"
+	}
+	return formatSize(rate) + "/s"
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sjaensch/storrent/torrentfile"
+)
+
+// stringList is a flag that can be given multiple times
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func create(args []string) {
+	flags := flag.NewFlagSet("create", flag.ExitOnError)
+	var trackers, webSeeds stringList
+	flags.Var(&trackers, "a", "tracker announce URL, can be given multiple times. Separate URLs with commas to put them in the same tier")
+	flags.Var(&webSeeds, "w", "web seed URL, can be given multiple times")
+	outPath := flags.String("o", "", "output file (default: <name>.torrent)")
+	comment := flags.String("c", "", "comment")
+	createdBy := flags.String("created-by", "storrent", "created by")
+	noDate := flags.Bool("no-date", false, "don't include the creation date")
+	private := flags.Bool("private", false, "mark the torrent as private")
+	source := flags.String("source", "", "source tag, gives the torrent a distinct info hash")
+	pieceLength := flags.Int("piece-length", 0, "piece length in bytes (default: chosen based on the size)")
+	hybrid := flags.Bool("hybrid", false, "create a hybrid v1/v2 torrent (BEP 52)")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: storrent create [options] <file or directory>\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	path := flags.Arg(0)
+
+	opts := torrentfile.CreateOptions{
+		Comment:     *comment,
+		CreatedBy:   *createdBy,
+		Private:     *private,
+		Source:      *source,
+		WebSeeds:    webSeeds,
+		PieceLength: *pieceLength,
+		Hybrid:      *hybrid,
+	}
+	opts.Announce, opts.AnnounceList = trackerTiers(trackers)
+	if !*noDate {
+		opts.CreationDate = time.Now()
+	}
+
+	if *outPath == "" {
+		*outPath = filepath.Base(filepath.Clean(path)) + ".torrent"
+	}
+	out, err := os.Create(*outPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	infoHash, err := torrentfile.Create(path, opts, out)
+	if err == nil {
+		err = out.Close()
+	}
+	if err != nil {
+		out.Close()
+		os.Remove(*outPath)
+		log.Fatal(err)
+	}
+	fmt.Printf("Created %s, info hash %x\n", *outPath, infoHash)
+}
+
+// trackerTiers turns -a flags into the announce URL and the announce-list.
+// Each flag is a tier of comma separated URLs.
+func trackerTiers(trackers []string) (string, [][]string) {
+	var announceList [][]string
+	for _, tier := range trackers {
+		announceList = append(announceList, strings.Split(tier, ","))
+	}
+	if len(announceList) == 0 {
+		return "", nil
+	}
+	if len(announceList) == 1 && len(announceList[0]) == 1 {
+		// a single tracker doesn't need an announce-list
+		return announceList[0][0], nil
+	}
+	return announceList[0][0], announceList
+}
@@ -0,0 +1,57 @@
+package dht
+
+import (
+	"crypto/sha1"
+	"math"
+	"net"
+)
+
+const bloomFilterBits = 2048
+const bloomFilterHashes = 2
+
+// BloomFilter is a set of peer IPs as used in DHT scrapes (BEP 33). It allows
+// estimating the number of seeders and leechers of a torrent without
+// transferring all their addresses.
+type BloomFilter [bloomFilterBits / 8]byte
+
+// Add inserts the IP into the filter
+func (bf *BloomFilter) Add(ip net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	} else {
+		ip = ip.To16()
+	}
+	hash := sha1.Sum(ip)
+	bf.set(int(hash[0]) | int(hash[1])<<8)
+	bf.set(int(hash[2]) | int(hash[3])<<8)
+}
+
+func (bf *BloomFilter) set(index int) {
+	index %= bloomFilterBits
+	bf[index/8] |= 1 << (index % 8)
+}
+
+// Merge adds all elements of other to the filter
+func (bf *BloomFilter) Merge(other *BloomFilter) {
+	for i := range bf {
+		bf[i] |= other[i]
+	}
+}
+
+// Estimate returns the approximate number of distinct IPs in the filter
+func (bf *BloomFilter) Estimate() float64 {
+	zeroBits := 0
+	for _, b := range bf {
+		for i := 0; i < 8; i++ {
+			if b&(1<<i) == 0 {
+				zeroBits++
+			}
+		}
+	}
+	// a saturated filter would give us infinity
+	if zeroBits == 0 {
+		zeroBits = 1
+	}
+	m := float64(bloomFilterBits)
+	return math.Log(float64(zeroBits)/m) / (bloomFilterHashes * math.Log(1-1/m))
+}
@@ -0,0 +1,35 @@
+package dht
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// test vector from BEP 33
+func TestBloomFilterEstimate(t *testing.T) {
+	var bf BloomFilter
+	assert.Equal(t, 0.0, bf.Estimate())
+
+	for i := 0; i < 256; i++ {
+		bf.Add(net.IP{192, 0, 2, byte(i)})
+	}
+	for i := 0; i < 1000; i++ {
+		ip := net.ParseIP("2001:db8::")
+		ip[14] = byte(i >> 8)
+		ip[15] = byte(i)
+		bf.Add(ip)
+	}
+	assert.InDelta(t, 1224.9308, bf.Estimate(), 0.0001)
+}
+
+func TestBloomFilterMerge(t *testing.T) {
+	var bf1, bf2 BloomFilter
+	bf1.Add(net.IP{192, 0, 2, 1})
+	bf2.Add(net.IP{192, 0, 2, 2})
+	bf2.Add(net.IP{192, 0, 2, 1})
+	bf1.Merge(&bf2)
+	assert.Equal(t, bf2, bf1)
+	assert.InDelta(t, 2, bf1.Estimate(), 0.01)
+}
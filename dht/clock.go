@@ -0,0 +1,30 @@
+package dht
+
+import "time"
+
+// Clock is the DHT's source of time. Tests can replace it to control
+// timeouts and expiry without waiting.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// realClock is the Clock backed by the time package
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// now returns the current time according to the DHT's clock. DHTs that
+// weren't created with New, e.g. in tests, use the real time.
+func (dht *DHT) now() time.Time {
+	if dht.clock == nil {
+		return time.Now()
+	}
+	return dht.clock.Now()
+}
@@ -2,17 +2,31 @@ package dht
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
+	"fmt"
 	"log"
 	"net"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/sjaensch/storrent/err"
+	"github.com/sjaensch/storrent/peers"
 )
 
 const maxNodesPerBucket = 8
 const activePeriod = 15 * time.Minute
 
+// refreshInterval is how long a bucket may go unchanged before we refresh it
+const refreshInterval = 15 * time.Minute
+
+// maintenanceInterval is how often we check whether the routing table needs a refresh
+const maintenanceInterval = time.Minute
+
+// Port is the UDP port the DHT listens on
+const Port = 6881
+
 var bootstrapNodes = []string{
 	"router.utorrent.com:6881",
 	"dht.transmissionbt.com:6881",
@@ -21,8 +35,24 @@ var bootstrapNodes = []string{
 
 // DHT represents the DHT routing table
 type DHT struct {
-	NodeID     *[20]byte
-	BucketTree *BucketTree
+	NodeID      *[20]byte
+	BucketTree  *BucketTree // routing table for IPv4 nodes
+	BucketTree6 *BucketTree // routing table for IPv6 nodes (BEP 32)
+
+	conn      net.PacketConn
+	clock     Clock
+	readOnly  bool // see SetReadOnly
+	mu        sync.Mutex
+	pending   map[string]*pendingQuery // outstanding queries by transaction ID
+	nextTID   uint16
+	peerStore map[[20]byte]map[string]storedPeer // peers announced to us, by infohash
+	items     map[[20]byte]*storedItem           // BEP 44 items stored on our node, by target
+	samples   [][20]byte                         // current BEP 51 sample of peerStore keys
+	sampled   time.Time                          // when samples was taken
+	secret    [20]byte                           // used to generate announce tokens
+	oldSecret [20]byte                           // previous secret, tokens generated with it are still valid
+	rotated   time.Time                          // when secret was last changed
+	done      chan struct{}
 }
 
 // BucketTree is an entry in the binary tree for our routing table
@@ -48,41 +78,247 @@ type Node struct {
 	LastActive time.Time
 }
 
-// BootstrapDHT initializes the DHT and fills it with the first nodes retrieved
-// when looking for the given infohash
-func BootstrapDHT(infohash []byte) (DHT, error) {
-	dht := DHT{
-		NodeID: new([20]byte),
+// New creates a DHT node with a random node ID that sends and answers KRPC
+// messages on conn. Call Close to shut it down.
+func New(conn net.PacketConn) *DHT {
+	return NewWithClock(conn, realClock{})
+}
+
+// NewWithClock creates a DHT node like New, using clock as its source of time.
+func NewWithClock(conn net.PacketConn, clock Clock) *DHT {
+	var id [20]byte
+	rand.Read(id[:])
+	return newWithID(conn, clock, id)
+}
+
+// newWithID creates a DHT node with the given node ID, which can't be changed
+// once the node answers queries
+func newWithID(conn net.PacketConn, clock Clock, id [20]byte) *DHT {
+	dht := &DHT{
+		NodeID: &id,
 		BucketTree: &BucketTree{
 			Level:  0,
 			Bucket: &Bucket{},
 		},
+		BucketTree6: &BucketTree{
+			Level:  0,
+			Bucket: &Bucket{},
+		},
+		conn:      conn,
+		clock:     clock,
+		pending:   make(map[string]*pendingQuery),
+		peerStore: make(map[[20]byte]map[string]storedPeer),
+		items:     make(map[[20]byte]*storedItem),
+		done:      make(chan struct{}),
 	}
-	rand.Read(dht.NodeID[:])
+	rand.Read(dht.secret[:])
+	dht.rotated = clock.Now()
+
+	go dht.serve()
+	return dht
+}
 
-	raddr, err := net.ResolveUDPAddr("udp", bootstrapNodes[0])
+// BootstrapDHT initializes the DHT and fills it with the first nodes retrieved
+// when looking for the given infohash. Cancelling ctx aborts bootstrapping,
+// but not the maintenance of the DHT, which runs until it is closed.
+func BootstrapDHT(ctx context.Context, infohash []byte) (*DHT, error) {
+	conn, err := net.ListenPacket("udp", fmt.Sprintf(":%d", Port))
 	if err != nil {
-		return dht, err
-	}
-	bootstrapNode := Node{
-		Address: raddr,
+		return nil, err
 	}
+	dht := New(conn)
 
-	nodes, err := bootstrapNode.FindNode(dht.NodeID[:], infohash)
-	if err != nil {
-		return dht, err
+	var addresses []*net.UDPAddr
+	for _, address := range bootstrapNodes {
+		raddr, err := net.ResolveUDPAddr("udp", address)
+		if err != nil {
+			log.Printf("Resolving bootstrap node %s failed: %v", address, err)
+			continue
+		}
+		addresses = append(addresses, raddr)
 	}
-	dht.BucketTree.Bucket = &Bucket{
-		Nodes: nodes,
+	err = dht.Bootstrap(ctx, addresses, infohash)
+	if err != nil {
+		dht.Close()
+		return nil, err
 	}
 
+	go dht.maintain()
 	return dht, nil
 }
 
+// Bootstrap fills the routing table by contacting the nodes at the given
+// addresses and then looking up our own node ID, as well as target if it is
+// not nil. Afterwards every bucket is refreshed, so that we know nodes in all
+// regions of the keyspace.
+func (dht *DHT) Bootstrap(ctx context.Context, addresses []*net.UDPAddr, target []byte) error {
+	var lastErr error
+	for _, address := range addresses {
+		ID, err := dht.Ping(ctx, &Node{Address: address})
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			log.Printf("Bootstrapping from %s failed: %v", address, err)
+			lastErr = err
+			continue
+		}
+		dht.InsertNode(&Node{
+			ID:         ID,
+			Address:    address,
+			LastActive: dht.now(),
+		})
+	}
+
+	for _, lookupTarget := range [][]byte{dht.NodeID[:], target} {
+		if lookupTarget != nil {
+			dht.lookup(ctx, lookupTarget, dht.findNodeQuery(ctx, lookupTarget))
+		}
+	}
+	for _, bucketTarget := range dht.bucketTargets(dht.now().Add(time.Nanosecond)) {
+		dht.lookup(ctx, bucketTarget[:], dht.findNodeQuery(ctx, bucketTarget[:]))
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if len(dht.knownNodes()) == 0 {
+		if lastErr == nil {
+			lastErr = fmt.Errorf("No bootstrap node responded")
+		}
+		return lastErr
+	}
+	return nil
+}
+
+// maintain refreshes the routing table and drops expired peers and items
+// periodically until the DHT is closed
+func (dht *DHT) maintain() {
+	for {
+		select {
+		case <-dht.done:
+			return
+		case <-dht.clock.After(maintenanceInterval):
+			dht.expirePeers()
+			dht.expireItems()
+			// closing the DHT aborts the queries
+			dht.Refresh(context.Background())
+		}
+	}
+}
+
+// Refresh pings the nodes in our routing table that haven't been active for a
+// while, dropping the ones that don't respond. Buckets that haven't changed
+// recently are filled up again by looking up a random ID within their range.
+func (dht *DHT) Refresh(ctx context.Context) {
+	now := dht.now()
+	var questionable []*Node
+	for _, node := range dht.knownNodes() {
+		if !node.isGood(now) {
+			questionable = append(questionable, node)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, node := range questionable {
+		wg.Add(1)
+		go func(node *Node) {
+			defer wg.Done()
+			ID, err := dht.Ping(ctx, node)
+			if err != nil || *ID != *node.ID {
+				dht.removeNode(node)
+				return
+			}
+			node.LastActive = dht.now()
+			dht.InsertNode(node)
+		}(node)
+	}
+	wg.Wait()
+
+	for _, target := range dht.bucketTargets(now.Add(-refreshInterval)) {
+		dht.lookup(ctx, target[:], dht.findNodeQuery(ctx, target[:]))
+	}
+}
+
+// findNodeQuery returns a lookup query function that sends find_node queries
+func (dht *DHT) findNodeQuery(ctx context.Context, target []byte) func(node *Node) (*Node, error) {
+	return func(node *Node) (*Node, error) {
+		return dht.FindNode(ctx, node, target)
+	}
+}
+
+// bucketTargets returns a random ID within the range of each bucket that
+// hasn't been refreshed since the given time, and marks the buckets as refreshed.
+func (dht *DHT) bucketTargets(since time.Time) [][20]byte {
+	now := dht.now()
+	dht.mu.Lock()
+	defer dht.mu.Unlock()
+	var targets [][20]byte
+	collect := func(bucket *Bucket, prefix [20]byte, bits int) {
+		if !bucket.LastRefreshed.Before(since) {
+			return
+		}
+		target := randomIDWithPrefix(prefix, bits)
+		targets = append(targets, target)
+		// don't refresh the same bucket again during the next maintenance run
+		bucket.LastRefreshed = now
+	}
+	dht.BucketTree.walkBuckets([20]byte{}, collect)
+	dht.BucketTree6.walkBuckets([20]byte{}, collect)
+	return targets
+}
+
+// removeNode drops the node from our routing table
+func (dht *DHT) removeNode(node *Node) {
+	dht.mu.Lock()
+	defer dht.mu.Unlock()
+	bucketTree := dht.BucketTree
+	if node.isIPv6() {
+		bucketTree = dht.BucketTree6
+	}
+	for bitIndex := 0; bucketTree.Bucket == nil; bitIndex++ {
+		if (node.ID[bitIndex/8]>>(7-(bitIndex%8)))&1 == 0 {
+			bucketTree = bucketTree.LeftChild
+		} else {
+			bucketTree = bucketTree.RightChild
+		}
+	}
+	bucketTree.Bucket.remove(node.ID)
+}
+
+// SetReadOnly switches read-only mode (BEP 43) on or off. A read-only node
+// can look up peers and items, but doesn't answer queries and asks other
+// nodes not to add it to their routing tables. This is useful on metered
+// connections and behind NATs that don't allow incoming packets.
+func (dht *DHT) SetReadOnly(readOnly bool) {
+	dht.mu.Lock()
+	defer dht.mu.Unlock()
+	dht.readOnly = readOnly
+}
+
+// IsReadOnly returns true if the DHT is in read-only mode
+func (dht *DHT) IsReadOnly() bool {
+	dht.mu.Lock()
+	defer dht.mu.Unlock()
+	return dht.readOnly
+}
+
+// Close stops answering queries and closes the underlying connection.
+func (dht *DHT) Close() error {
+	close(dht.done)
+	return dht.conn.Close()
+}
+
 // InsertNode adds a Node to our routing table, potentially rebalancing the tree if necessary.
+// IPv6 nodes are kept in a separate routing table from IPv4 nodes.
 func (dht *DHT) InsertNode(node *Node) error {
+	dht.mu.Lock()
+	defer dht.mu.Unlock()
+
 	bitIndex := 0
 	bucketTree := dht.BucketTree
+	if node.isIPv6() {
+		bucketTree = dht.BucketTree6
+	}
 	var bit byte
 
 	for ; bucketTree.Bucket == nil; bitIndex++ {
@@ -98,8 +334,16 @@ func (dht *DHT) InsertNode(node *Node) error {
 		}
 	}
 
-	if bucketTree.Bucket.Count < 8 || bucketTree.Bucket.makeRoom() || prefixMatch(dht.NodeID[:], node.ID[:], bitIndex) {
-		bucketTree.addNode(node)
+	if existing := bucketTree.Bucket.find(node.ID); existing != nil {
+		// we already know this node, just refresh it
+		existing.Address = node.Address
+		existing.LastActive = node.LastActive
+		return nil
+	}
+
+	now := dht.now()
+	if bucketTree.Bucket.Count < maxNodesPerBucket || bucketTree.Bucket.makeRoom(now) || prefixMatch(dht.NodeID[:], node.ID[:], bitIndex) {
+		bucketTree.addNode(node, now)
 	} else {
 		log.Printf("Not inserting node, bucket is full.")
 	}
@@ -108,13 +352,13 @@ func (dht *DHT) InsertNode(node *Node) error {
 }
 
 // Internal function that will add the Node to bucket, splitting it if necessary.
-func (bucketTree *BucketTree) addNode(node *Node) {
+func (bucketTree *BucketTree) addNode(node *Node, now time.Time) {
 	err.Assert(bucketTree.Bucket != nil)
 
 	node.Next = bucketTree.Bucket.Nodes
 	bucketTree.Bucket.Nodes = node
 	bucketTree.Bucket.Count++
-	bucketTree.Bucket.LastRefreshed = time.Now()
+	bucketTree.Bucket.LastRefreshed = now
 
 	// are we over capacity now? then split the bucket
 	if bucketTree.Bucket.Count > maxNodesPerBucket {
@@ -133,21 +377,90 @@ func (bucketTree *BucketTree) addNode(node *Node) {
 			// cur.Next will be changed in the recursive call, save it now
 			next = cur.Next
 			if cur.ID[idIndex]&bitMask > 0 {
-				bucketTree.RightChild.addNode(cur)
+				bucketTree.RightChild.addNode(cur, now)
 			} else {
-				bucketTree.LeftChild.addNode(cur)
+				bucketTree.LeftChild.addNode(cur, now)
 			}
 		}
 		bucketTree.Bucket = nil
 	}
 }
 
+// closestNodes returns up to count nodes from the tree, ordered by their XOR
+// distance to target.
+func (bucketTree *BucketTree) closestNodes(target []byte, count int) []*Node {
+	var nodes []*Node
+	bucketTree.walk(func(node *Node) {
+		nodes = append(nodes, node)
+	})
+	sort.Slice(nodes, func(i, j int) bool {
+		return closer(nodes[i].ID[:], nodes[j].ID[:], target)
+	})
+	if len(nodes) > count {
+		nodes = nodes[:count]
+	}
+	return nodes
+}
+
+// walk calls fn for every node in the tree.
+func (bucketTree *BucketTree) walk(fn func(node *Node)) {
+	if bucketTree == nil {
+		return
+	}
+	if bucketTree.Bucket != nil {
+		for node := bucketTree.Bucket.Nodes; node != nil; node = node.Next {
+			fn(node)
+		}
+		return
+	}
+	bucketTree.LeftChild.walk(fn)
+	bucketTree.RightChild.walk(fn)
+}
+
+// walkBuckets calls fn for every bucket in the tree, along with the prefix
+// shared by all node IDs in the bucket and the length of that prefix in bits.
+func (bucketTree *BucketTree) walkBuckets(prefix [20]byte, fn func(bucket *Bucket, prefix [20]byte, bits int)) {
+	if bucketTree.Bucket != nil {
+		fn(bucketTree.Bucket, prefix, int(bucketTree.Level))
+		return
+	}
+	bucketTree.LeftChild.walkBuckets(prefix, fn)
+	prefix[bucketTree.Level/8] |= 1 << (7 - bucketTree.Level%8)
+	bucketTree.RightChild.walkBuckets(prefix, fn)
+}
+
+// find returns the node with the given ID if it is in the bucket
+func (bucket *Bucket) find(ID *[20]byte) *Node {
+	for cur := bucket.Nodes; cur != nil; cur = cur.Next {
+		if *cur.ID == *ID {
+			return cur
+		}
+	}
+	return nil
+}
+
+// remove drops the node with the given ID from the bucket
+func (bucket *Bucket) remove(ID *[20]byte) {
+	var last *Node
+	for cur := bucket.Nodes; cur != nil; cur = cur.Next {
+		if *cur.ID == *ID {
+			if last != nil {
+				last.Next = cur.Next
+			} else {
+				bucket.Nodes = cur.Next
+			}
+			bucket.Count--
+			return
+		}
+		last = cur
+	}
+}
+
 // makeRoom removes an unknown (non-Good) node from the bucket if there is one
-func (bucket *Bucket) makeRoom() bool {
+func (bucket *Bucket) makeRoom(now time.Time) bool {
 	var last, cur *Node
-	for cur = bucket.Nodes; cur != nil && cur.isGood(); cur = cur.Next {
+	for cur = bucket.Nodes; cur != nil && cur.isGood(now); cur = cur.Next {
 		last = cur
-		cur = cur.Next
 	}
 	if cur != nil {
 		// found a non-Good node
@@ -164,15 +477,23 @@ func (bucket *Bucket) makeRoom() bool {
 }
 
 // isGood returns true if the Node is "good", i.e. has been active in the last activePeriod (usually 15 minutes).
-func (node *Node) isGood() bool {
-	return node.LastActive.Add(activePeriod).After(time.Now())
+func (node *Node) isGood(now time.Time) bool {
+	return node.LastActive.Add(activePeriod).After(now)
+}
+
+// isIPv6 returns true if the node is reachable over IPv6. Nodes without an
+// address are treated as IPv4 nodes.
+func (node *Node) isIPv6() bool {
+	return node.Address != nil && node.Address.IP.To4() == nil
 }
 
-// FindNode queries the node for other nodes that are close to the given infohash.
-func (node *Node) FindNode(ourID, infohash []byte) (*Node, error) {
-	query := NewKRPCFindNodeQuery(ourID, infohash)
+// FindNode queries the node for other nodes that are close to the given target.
+// Nodes of both address families are requested.
+func (dht *DHT) FindNode(ctx context.Context, node *Node, target []byte) (*Node, error) {
+	query := NewKRPCFindNodeQuery(dht.NodeID[:], target)
+	query.Arguments.Want = []string{WantIPv4, WantIPv6}
 	response := KRPCFindNodeResponse{}
-	err := Request(node, query, &response)
+	err := dht.Request(ctx, node, &query, &response)
 	if err != nil {
 		return nil, err
 	}
@@ -184,6 +505,90 @@ func (node *Node) FindNode(ourID, infohash []byte) (*Node, error) {
 	return node, nil
 }
 
+// Ping checks whether the node is alive, returning its node ID.
+func (dht *DHT) Ping(ctx context.Context, node *Node) (*[20]byte, error) {
+	query := NewKRPCPingQuery(dht.NodeID[:])
+	response := KRPCPingResponse{}
+	err := dht.Request(ctx, node, &query, &response)
+	if err != nil {
+		return nil, err
+	}
+	if response.MessageType == "e" {
+		return nil, response.Error.error("pinging node")
+	}
+	if len(response.Arguments.NodeID) != 20 {
+		return nil, fmt.Errorf("Received malformed node ID of length %d", len(response.Arguments.NodeID))
+	}
+	ID := new([20]byte)
+	copy(ID[:], response.Arguments.NodeID)
+	return ID, nil
+}
+
+// GetPeers asks the node for peers of the given infohash. It returns the peers
+// the node knows about (IPv4 and IPv6), closer nodes to continue the lookup
+// with, and the token required to announce to this node.
+func (dht *DHT) GetPeers(ctx context.Context, node *Node, infohash []byte) ([]peers.Peer, *Node, string, error) {
+	response, err := dht.getPeers(ctx, node, infohash, false)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	return response.toPeersAndNodes()
+}
+
+// getPeers sends a get_peers query, optionally asking for the scrape bloom filters.
+func (dht *DHT) getPeers(ctx context.Context, node *Node, infohash []byte, scrape bool) (*KRPCGetPeersResponse, error) {
+	query := NewKRPCGetPeersQuery(dht.NodeID[:], infohash)
+	query.Arguments.Want = []string{WantIPv4, WantIPv6}
+	if scrape {
+		query.Arguments.Scrape = true
+	}
+	response := KRPCGetPeersResponse{}
+	err := dht.Request(ctx, node, &query, &response)
+	if err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+// AnnouncePeer tells the node that we are downloading infohash on the given port,
+// or seeding it if seed is set. token must be the one received in a previous
+// GetPeers response from that node.
+func (dht *DHT) AnnouncePeer(ctx context.Context, node *Node, infohash []byte, port int, token string, seed bool) error {
+	query := NewKRPCAnnouncePeerQuery(dht.NodeID[:], infohash, port, token, seed)
+	response := KRPCPingResponse{}
+	err := dht.Request(ctx, node, &query, &response)
+	if err != nil {
+		return err
+	}
+	if response.MessageType == "e" {
+		return response.Error.error("announcing peer")
+	}
+	return nil
+}
+
+// randomIDWithPrefix returns a random node ID that starts with the first bits of prefix
+func randomIDWithPrefix(prefix [20]byte, bits int) [20]byte {
+	var ID [20]byte
+	rand.Read(ID[:])
+	for i := 0; i < bits; i++ {
+		mask := byte(1 << (7 - i%8))
+		ID[i/8] = ID[i/8]&^mask | prefix[i/8]&mask
+	}
+	return ID
+}
+
+// closer returns true if ID1 is closer to target than ID2, using the XOR metric.
+func closer(ID1, ID2, target []byte) bool {
+	for i := range target {
+		d1 := ID1[i] ^ target[i]
+		d2 := ID2[i] ^ target[i]
+		if d1 != d2 {
+			return d1 < d2
+		}
+	}
+	return false
+}
+
 // prefixMatch compares the first bitCount bits of the two byte array slices;
 // returns true if they match, false if they don't.
 func prefixMatch(ID1, ID2 []byte, bitCount int) bool {
@@ -1,10 +1,12 @@
 package dht
 
 import (
+	"net"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 // compare two BucketTrees by value (mostly - for BucketTree.Bucket.Nodes we compare the references)
@@ -55,7 +57,7 @@ func TestAddNode(t *testing.T) {
 		},
 	}
 
-	input.addNode(testNode)
+	input.addNode(testNode, time.Now())
 	// the data is modified in-place, so the input is the result
 	assert.True(t, compare(t, &input, &expected))
 }
@@ -94,7 +96,7 @@ func TestAddNodeBucketSplit(t *testing.T) {
 		},
 	}
 
-	input.addNode(testNode)
+	input.addNode(testNode, time.Now())
 	// the data is modified in-place, so the input is the result
 	assert.True(t, compare(t, &input, &expected))
 }
@@ -128,3 +130,43 @@ func TestInsertNode(t *testing.T) {
 	dht.InsertNode(node)
 	assert.Equal(t, node, dht.BucketTree.RightChild.LeftChild.Bucket.Nodes)
 }
+
+func TestInsertNodeIPv6(t *testing.T) {
+	node4 := &Node{
+		ID:      &[20]byte{1},
+		Address: &net.UDPAddr{IP: net.IP{192, 0, 2, 1}, Port: 6881},
+	}
+	node6 := &Node{
+		ID:      &[20]byte{2},
+		Address: &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 6881},
+	}
+	dht := &DHT{
+		NodeID:      &[20]byte{},
+		BucketTree:  &BucketTree{Bucket: &Bucket{}},
+		BucketTree6: &BucketTree{Bucket: &Bucket{}},
+	}
+
+	dht.InsertNode(node4)
+	dht.InsertNode(node6)
+	assert.Equal(t, node4, dht.BucketTree.Bucket.Nodes)
+	assert.Equal(t, byte(1), dht.BucketTree.Bucket.Count)
+	assert.Equal(t, node6, dht.BucketTree6.Bucket.Nodes)
+	assert.Equal(t, byte(1), dht.BucketTree6.Bucket.Count)
+
+	// inserting a known node again only refreshes it
+	dht.InsertNode(&Node{ID: &[20]byte{2}, Address: node6.Address})
+	assert.Equal(t, byte(1), dht.BucketTree6.Bucket.Count)
+}
+
+func TestClosestNodes(t *testing.T) {
+	tree := &BucketTree{Bucket: &Bucket{}}
+	for _, b := range []byte{0x80, 0x01, 0x40, 0x03} {
+		tree.addNode(&Node{ID: &[20]byte{b}}, time.Now())
+	}
+
+	closest := tree.closestNodes([]byte{0x02, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, 3)
+	require.Len(t, closest, 3)
+	assert.Equal(t, byte(0x03), closest[0].ID[0])
+	assert.Equal(t, byte(0x01), closest[1].ID[0])
+	assert.Equal(t, byte(0x40), closest[2].ID[0])
+}
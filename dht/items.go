@@ -0,0 +1,359 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha1"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/sjaensch/storrent/bencode"
+)
+
+// maxItemValueSize is the maximum size of the bencoded value of an item
+const maxItemValueSize = 1000
+
+// maxSaltSize is the maximum size of the salt of a mutable item
+const maxSaltSize = 64
+
+// itemLifetime is how long we keep items that aren't stored again
+const itemLifetime = 2 * time.Hour
+
+// maxItems is how many items we store at most. Puts of new items are
+// refused beyond that.
+const maxItems = 10000
+
+// Item is arbitrary data stored in the DHT (BEP 44). Immutable items only
+// consist of a value and are addressed by its SHA-1 hash. Mutable items are
+// signed with an ed25519 key and addressed by the public key and salt.
+type Item struct {
+	Value     interface{} // any value the bencode package can encode
+	PublicKey []byte      // ed25519 public key, only set for mutable items
+	Salt      []byte
+	Seq       int64
+	Signature []byte
+}
+
+type storedItem struct {
+	item   *Item
+	stored time.Time
+}
+
+// NewImmutableItem creates an item that can only be retrieved by the hash of its value
+func NewImmutableItem(value interface{}) (*Item, error) {
+	item := &Item{Value: value}
+	_, err := item.encodedValue()
+	if err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+// NewMutableItem creates an item that is signed with privateKey. Publishing
+// a new value under the same key and salt requires a higher seq.
+func NewMutableItem(value interface{}, privateKey ed25519.PrivateKey, salt []byte, seq int64) (*Item, error) {
+	if len(salt) > maxSaltSize {
+		return nil, fmt.Errorf("Salt too big: %d > %d bytes", len(salt), maxSaltSize)
+	}
+	item := &Item{
+		Value:     value,
+		PublicKey: privateKey.Public().(ed25519.PublicKey),
+		Salt:      salt,
+		Seq:       seq,
+	}
+	encoded, err := item.encodedValue()
+	if err != nil {
+		return nil, err
+	}
+	item.Signature = ed25519.Sign(privateKey, signaturePayload(salt, seq, encoded))
+	return item, nil
+}
+
+// IsMutable returns true if the item is signed
+func (item *Item) IsMutable() bool {
+	return item.PublicKey != nil
+}
+
+// Target returns the key the item is stored under in the DHT
+func (item *Item) Target() ([20]byte, error) {
+	if item.IsMutable() {
+		return mutableTarget(item.PublicKey, item.Salt), nil
+	}
+	encoded, err := item.encodedValue()
+	if err != nil {
+		return [20]byte{}, err
+	}
+	return sha1.Sum(encoded), nil
+}
+
+// Verify checks the signature of a mutable item. Immutable items are always valid.
+func (item *Item) Verify() error {
+	if !item.IsMutable() {
+		return nil
+	}
+	if len(item.PublicKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("Invalid public key length %d", len(item.PublicKey))
+	}
+	encoded, err := item.encodedValue()
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(item.PublicKey, signaturePayload(item.Salt, item.Seq, encoded), item.Signature) {
+		return fmt.Errorf("Invalid signature")
+	}
+	return nil
+}
+
+func (item *Item) encodedValue() ([]byte, error) {
+	encoded, err := bencode.Marshal(item.Value)
+	if err != nil {
+		return nil, err
+	}
+	if len(encoded) > maxItemValueSize {
+		return nil, fmt.Errorf("Item value too big: %d > %d bytes", len(encoded), maxItemValueSize)
+	}
+	return encoded, nil
+}
+
+func mutableTarget(publicKey, salt []byte) [20]byte {
+	return sha1.Sum(append(append([]byte{}, publicKey...), salt...))
+}
+
+// signaturePayload returns the data that is signed for a mutable item: the
+// bencoded salt, seq and v keys without the surrounding dictionary.
+func signaturePayload(salt []byte, seq int64, encodedValue []byte) []byte {
+	var buf bytes.Buffer
+	if len(salt) > 0 {
+		fmt.Fprintf(&buf, "4:salt%d:%s", len(salt), salt)
+	}
+	fmt.Fprintf(&buf, "3:seqi%de1:v", seq)
+	buf.Write(encodedValue)
+	return buf.Bytes()
+}
+
+// GetImmutable asks the node for the immutable item with the given target,
+// i.e. the SHA-1 hash of its bencoded value. If the node doesn't have it the
+// item is nil. Closer nodes and the token required to store the item on the
+// node are returned in any case.
+func (dht *DHT) GetImmutable(ctx context.Context, node *Node, target []byte) (*Item, *Node, string, error) {
+	item, nodes, token, err := dht.get(ctx, node, target, -1)
+	if err != nil || item == nil {
+		return nil, nodes, token, err
+	}
+	itemTarget, err := item.Target()
+	if err != nil {
+		return nil, nodes, token, err
+	}
+	if item.IsMutable() || !bytes.Equal(itemTarget[:], target) {
+		return nil, nodes, token, fmt.Errorf("Received item doesn't match target %x", target)
+	}
+	return item, nodes, token, nil
+}
+
+// GetMutable asks the node for the mutable item with the given public key and
+// salt. Only items with a sequence number higher than seq are returned, pass a
+// negative seq to get any version.
+func (dht *DHT) GetMutable(ctx context.Context, node *Node, publicKey, salt []byte, seq int64) (*Item, *Node, string, error) {
+	target := mutableTarget(publicKey, salt)
+	item, nodes, token, err := dht.get(ctx, node, target[:], seq)
+	if err != nil || item == nil {
+		return nil, nodes, token, err
+	}
+	item.Salt = salt
+	if !bytes.Equal(item.PublicKey, publicKey) {
+		return nil, nodes, token, fmt.Errorf("Received item for different public key %x", item.PublicKey)
+	}
+	err = item.Verify()
+	if err != nil {
+		return nil, nodes, token, err
+	}
+	if seq >= 0 && item.Seq <= seq {
+		return nil, nodes, token, nil
+	}
+	return item, nodes, token, nil
+}
+
+func (dht *DHT) get(ctx context.Context, node *Node, target []byte, seq int64) (*Item, *Node, string, error) {
+	var seqArg *int64
+	if seq > 0 {
+		seqArg = &seq
+	}
+	query := NewKRPCGetQuery(dht.NodeID[:], target, seqArg)
+	query.Arguments.Want = []string{WantIPv4, WantIPv6}
+	response := KRPCGetResponse{}
+	err := dht.Request(ctx, node, &query, &response)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if response.MessageType == "e" {
+		return nil, nil, "", response.Error.error("getting item")
+	}
+
+	nodes := parseNodes(response.Arguments.Nodes, net.IPv4len)
+	nodes = append(nodes, parseNodes(response.Arguments.Nodes6, net.IPv6len)...)
+	if response.Arguments.Value == nil {
+		return nil, linkNodes(nodes), response.Arguments.Token, nil
+	}
+	item := &Item{}
+	err = bencode.Unmarshal(response.Arguments.Value, &item.Value)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if response.Arguments.PublicKey != "" {
+		item.PublicKey = []byte(response.Arguments.PublicKey)
+		item.Seq = response.Arguments.Seq
+		item.Signature = []byte(response.Arguments.Signature)
+	}
+	return item, linkNodes(nodes), response.Arguments.Token, nil
+}
+
+// Put stores the item on the node. token must be the one received in a
+// previous get response from that node.
+func (dht *DHT) Put(ctx context.Context, node *Node, token string, item *Item) error {
+	return dht.put(ctx, node, token, item, nil)
+}
+
+// PutCAS stores the mutable item on the node, but only if the sequence number
+// of the item currently stored there is cas (compare and swap).
+func (dht *DHT) PutCAS(ctx context.Context, node *Node, token string, item *Item, cas int64) error {
+	return dht.put(ctx, node, token, item, &cas)
+}
+
+func (dht *DHT) put(ctx context.Context, node *Node, token string, item *Item, cas *int64) error {
+	query, err := NewKRPCPutQuery(dht.NodeID[:], token, item, cas)
+	if err != nil {
+		return err
+	}
+	response := KRPCPingResponse{}
+	err = dht.Request(ctx, node, &query, &response)
+	if err != nil {
+		return err
+	}
+	if response.MessageType == "e" {
+		return response.Error.error("putting item")
+	}
+	return nil
+}
+
+// handleGet answers a get query with the item we have stored under the target,
+// if any, plus the nodes closest to the target.
+func (dht *DHT) handleGet(query *krpcIncoming, addr *net.UDPAddr) interface{} {
+	args := &query.Arguments
+	response := map[string]interface{}{
+		"id":    string(dht.NodeID[:]),
+		"token": dht.token(addr),
+	}
+	nodes, nodes6 := dht.closestNodes([]byte(args.Target), args.Want, addr)
+	if nodes != "" {
+		response["nodes"] = nodes
+	}
+	if nodes6 != "" {
+		response["nodes6"] = nodes6
+	}
+
+	var target [20]byte
+	copy(target[:], args.Target)
+	item := dht.storedItem(target)
+	if item != nil && (!item.IsMutable() || args.Seq == nil || item.Seq > *args.Seq) {
+		response["v"] = item.Value
+		if item.IsMutable() {
+			response["k"] = string(item.PublicKey)
+			response["seq"] = item.Seq
+			response["sig"] = string(item.Signature)
+		}
+	}
+	return response
+}
+
+// handlePut validates and stores the item of a put query. On failure the
+// KRPC error code and message are returned.
+func (dht *DHT) handlePut(query *krpcIncoming, addr *net.UDPAddr) (int, string) {
+	args := &query.Arguments
+	if !dht.validToken(args.Token, addr) {
+		return errProtocol, "bad token"
+	}
+	if args.Value == nil {
+		return errProtocol, "missing value"
+	}
+
+	item := &Item{}
+	if err := bencode.Unmarshal(args.Value, &item.Value); err != nil {
+		return errProtocol, "invalid value"
+	}
+	if args.PublicKey != "" {
+		if len(args.PublicKey) != ed25519.PublicKeySize || args.Seq == nil {
+			return errProtocol, "invalid mutable item"
+		}
+		if len(args.Salt) > maxSaltSize {
+			return errSaltTooBig, "salt (salt field) too big"
+		}
+		item.PublicKey = []byte(args.PublicKey)
+		item.Salt = []byte(args.Salt)
+		item.Seq = *args.Seq
+		item.Signature = []byte(args.Signature)
+	}
+	encoded, err := item.encodedValue()
+	if err != nil {
+		return errMessageTooBig, "message (v field) too big"
+	}
+	if err := item.Verify(); err != nil {
+		return errInvalidSignature, "invalid signature"
+	}
+	target, _ := item.Target()
+
+	dht.mu.Lock()
+	defer dht.mu.Unlock()
+	existing, ok := dht.items[target]
+	if !ok && len(dht.items) >= maxItems {
+		return errServer, "item storage full"
+	}
+	if ok && item.IsMutable() {
+		if args.CAS != nil && existing.item.Seq != *args.CAS {
+			return errCASMismatch, "CAS mismatch"
+		}
+		if item.Seq < existing.item.Seq {
+			return errSeqTooLow, "sequence number less than current"
+		}
+		// storing the same item again only refreshes it
+		if item.Seq == existing.item.Seq {
+			current, _ := existing.item.encodedValue()
+			if !bytes.Equal(encoded, current) {
+				return errSeqTooLow, "sequence number equal to current"
+			}
+		}
+	}
+	dht.items[target] = &storedItem{
+		item:   item,
+		stored: dht.now(),
+	}
+	return 0, ""
+}
+
+// expireItems drops the items that haven't been stored again for itemLifetime
+func (dht *DHT) expireItems() {
+	dht.mu.Lock()
+	defer dht.mu.Unlock()
+	now := dht.now()
+	for target, stored := range dht.items {
+		if now.Sub(stored.stored) > itemLifetime {
+			delete(dht.items, target)
+		}
+	}
+}
+
+// storedItem returns the item stored under target, dropping it if it has expired
+func (dht *DHT) storedItem(target [20]byte) *Item {
+	dht.mu.Lock()
+	defer dht.mu.Unlock()
+	stored, ok := dht.items[target]
+	if !ok {
+		return nil
+	}
+	if dht.now().Sub(stored.stored) > itemLifetime {
+		delete(dht.items, target)
+		return nil
+	}
+	return stored.item
+}
@@ -0,0 +1,174 @@
+package dht
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func decodeHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	require.Nil(t, err)
+	return b
+}
+
+// test vectors from BEP 44
+func TestItemTestVectors(t *testing.T) {
+	immutable, err := NewImmutableItem("Hello World!")
+	require.Nil(t, err)
+	target, err := immutable.Target()
+	require.Nil(t, err)
+	assert.Equal(t, decodeHex(t, "e5f96f6f38320f0f33959cb4d3d656452117aadb"), target[:])
+
+	publicKey := decodeHex(t, "77ff84905a91936367c01360803104f92432fcd904a43511876df5cdf3e7e548")
+	tests := map[string]struct {
+		salt      string
+		signature string
+		target    string
+	}{
+		"mutable without salt": {
+			signature: "305ac8aeb6c9c151fa120f120ea2cfb923564e11552d06a5d856091e5e853cff1260d3f39e4999684aa92eb73ffd136e6f4f3ecbfda0ce53a1608ecd7ae21f01",
+			target:    "4a533d47ec9c7d95b1ad75f576cffc641853b750",
+		},
+		"mutable with salt": {
+			salt:      "foobar",
+			signature: "6834284b6b24c3204eb2fea824d82f88883a3d95e8b4a21b8c0ded553d17d17ddf9a8a7104b1258f30bed3787e6cb896fca78c58f8e03b5f18f14951a87d9a08",
+			target:    "411eba73b6f087ca51a3795d9c8c938d365e32c1",
+		},
+	}
+	for name, test := range tests {
+		item := &Item{
+			Value:     "Hello World!",
+			PublicKey: publicKey,
+			Salt:      []byte(test.salt),
+			Seq:       1,
+			Signature: decodeHex(t, test.signature),
+		}
+		assert.Nil(t, item.Verify(), name)
+		target, err := item.Target()
+		require.Nil(t, err)
+		assert.Equal(t, decodeHex(t, test.target), target[:], name)
+
+		item.Seq = 2
+		assert.NotNil(t, item.Verify(), name)
+	}
+}
+
+func TestNewItemValueTooBig(t *testing.T) {
+	_, err := NewImmutableItem(strings.Repeat("a", maxItemValueSize))
+	assert.NotNil(t, err)
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	require.Nil(t, err)
+	_, err = NewMutableItem("value", privateKey, make([]byte, maxSaltSize+1), 1)
+	assert.NotNil(t, err)
+}
+
+func TestPutAndGetImmutable(t *testing.T) {
+	server := newLoopbackDHT(t, "udp", "127.0.0.1:0")
+	defer server.Close()
+	client := newLoopbackDHT(t, "udp", "127.0.0.1:0")
+	defer client.Close()
+
+	value := map[string]interface{}{
+		"infohash": "aaaaaaaaaaaaaaaaaaaa",
+		"list":     []interface{}{"a", int64(1)},
+	}
+	item, err := NewImmutableItem(value)
+	require.Nil(t, err)
+	target, err := item.Target()
+	require.Nil(t, err)
+
+	found, _, token, err := client.GetImmutable(context.Background(), loopbackNode(server), target[:])
+	require.Nil(t, err)
+	assert.Nil(t, found)
+
+	err = client.Put(context.Background(), loopbackNode(server), "bad token", item)
+	assert.NotNil(t, err)
+	err = client.Put(context.Background(), loopbackNode(server), token, item)
+	require.Nil(t, err)
+
+	found, _, _, err = client.GetImmutable(context.Background(), loopbackNode(server), target[:])
+	require.Nil(t, err)
+	require.NotNil(t, found)
+	assert.Equal(t, value, found.Value)
+}
+
+func TestPutAndGetMutable(t *testing.T) {
+	server := newLoopbackDHT(t, "udp", "127.0.0.1:0")
+	defer server.Close()
+	client := newLoopbackDHT(t, "udp", "127.0.0.1:0")
+	defer client.Close()
+
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	require.Nil(t, err)
+	salt := []byte("release")
+
+	_, _, token, err := client.GetMutable(context.Background(), loopbackNode(server), publicKey, salt, -1)
+	require.Nil(t, err)
+
+	item, err := NewMutableItem("v1", privateKey, salt, 1)
+	require.Nil(t, err)
+	require.Nil(t, client.Put(context.Background(), loopbackNode(server), token, item))
+
+	// tampered items are rejected
+	tampered := *item
+	tampered.Value = "v1 but different"
+	assert.NotNil(t, client.Put(context.Background(), loopbackNode(server), token, &tampered))
+
+	found, _, _, err := client.GetMutable(context.Background(), loopbackNode(server), publicKey, salt, -1)
+	require.Nil(t, err)
+	require.NotNil(t, found)
+	assert.Equal(t, "v1", found.Value)
+	assert.Equal(t, int64(1), found.Seq)
+
+	// nothing newer than what we already have
+	found, _, _, err = client.GetMutable(context.Background(), loopbackNode(server), publicKey, salt, 1)
+	require.Nil(t, err)
+	assert.Nil(t, found)
+
+	item2, err := NewMutableItem("v2", privateKey, salt, 2)
+	require.Nil(t, err)
+	// CAS fails because the current sequence number is 1
+	assert.NotNil(t, client.PutCAS(context.Background(), loopbackNode(server), token, item2, 0))
+	require.Nil(t, client.PutCAS(context.Background(), loopbackNode(server), token, item2, 1))
+
+	// older sequence numbers are rejected
+	assert.NotNil(t, client.Put(context.Background(), loopbackNode(server), token, item))
+	// as are other values with the same sequence number, unlike the same item
+	other, err := NewMutableItem("v2 but different", privateKey, salt, 2)
+	require.Nil(t, err)
+	assert.NotNil(t, client.Put(context.Background(), loopbackNode(server), token, other))
+	require.Nil(t, client.Put(context.Background(), loopbackNode(server), token, item2))
+
+	found, _, _, err = client.GetMutable(context.Background(), loopbackNode(server), publicKey, salt, 1)
+	require.Nil(t, err)
+	require.NotNil(t, found)
+	assert.Equal(t, "v2", found.Value)
+}
+
+func TestPutStorageFull(t *testing.T) {
+	server := newLoopbackDHT(t, "udp", "127.0.0.1:0")
+	defer server.Close()
+	client := newLoopbackDHT(t, "udp", "127.0.0.1:0")
+	defer client.Close()
+
+	server.mu.Lock()
+	for i := 0; i < maxItems; i++ {
+		server.items[[20]byte{byte(i >> 8), byte(i)}] = &storedItem{item: &Item{Value: "v"}, stored: time.Now()}
+	}
+	server.mu.Unlock()
+
+	item, err := NewImmutableItem("value")
+	require.Nil(t, err)
+	target, err := item.Target()
+	require.Nil(t, err)
+	_, _, token, err := client.GetImmutable(context.Background(), loopbackNode(server), target[:])
+	require.Nil(t, err)
+	assert.NotNil(t, client.Put(context.Background(), loopbackNode(server), token, item))
+}
@@ -2,139 +2,414 @@ package dht
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"log"
 	"net"
-	"reflect"
 	"time"
 
-	"github.com/jackpal/bencode-go"
+	"github.com/sjaensch/storrent/bencode"
+	"github.com/sjaensch/storrent/peers"
 )
 
-// KRPCMessage contains the basic fields that every message should have.
-// Unfortunately I wasn't able to incorporate it within the more specific
-// message types. Adding *KRPCMessage instead of duplicating the fields
-// caused a panic when unmarshalling.
+// Values for the "want" argument of find_node and get_peers queries (BEP 32)
+const (
+	WantIPv4 = "n4"
+	WantIPv6 = "n6"
+)
+
+// compact node info: 20 bytes node ID, followed by the IP and 2 bytes port
+const compactNodeLen = 26
+const compactNode6Len = 38
+
+// queryTimeout is how long we wait for a response to a query
+const queryTimeout = 5 * time.Second
+
+// clientVersion is sent in the "v" key of every message
+const clientVersion = "JT00"
+
+// KRPCMessage contains the basic fields that every message has
 type KRPCMessage struct {
 	TransactionID string `bencode:"t"` // Length: 2
 	MessageType   string `bencode:"y"` // Length: 1
 	ClientVersion string `bencode:"v"` // Length: 4
 }
 
+// KRPCQuery contains the fields that every query has
 type KRPCQuery struct {
-	*KRPCMessage
+	KRPCMessage
 	QueryMethod string `bencode:"q"`
+	ReadOnly    bool   `bencode:"ro,omitempty"` // set if we are a read-only node (BEP 43)
+}
+
+// Query is implemented by all query types, giving Request access to the
+// fields it fills in
+type Query interface {
+	Header() *KRPCQuery
+}
+
+// Header returns the common fields of the query
+func (query *KRPCQuery) Header() *KRPCQuery {
+	return query
+}
+
+// KRPCErrorArgs holds the two items of an error: the error code and message
+type KRPCErrorArgs []interface{}
+
+func (e KRPCErrorArgs) error(action string) error {
+	if len(e) != 2 {
+		return fmt.Errorf("Error %s: %v", action, []interface{}(e))
+	}
+	return fmt.Errorf("Error %s: code=%d message=%s", action, e[0], e[1])
 }
 
 type KRPCFindNodeQuery struct {
-	//*KRPCQuery
-	TransactionID string                `bencode:"t"` // Length: 2
-	MessageType   string                `bencode:"y"` // Length: 1
-	ClientVersion string                `bencode:"v"` // Length: 4
-	QueryMethod   string                `bencode:"q"`
-	Arguments     KRPCFindNodeQueryArgs `bencode:"a"`
+	KRPCQuery
+	Arguments KRPCFindNodeQueryArgs `bencode:"a"`
 }
 
 type KRPCFindNodeQueryArgs struct {
-	NodeID       string `bencode:"id"`
-	TargetNodeID string `bencode:"target"`
+	NodeID       string   `bencode:"id"`
+	TargetNodeID string   `bencode:"target"`
+	Want         []string `bencode:"want,omitempty"`
 }
 
 type KRPCFindNodeResponse struct {
-	TransactionID string                   `bencode:"t"` // Length: 2
-	MessageType   string                   `bencode:"y"` // Length: 1
-	ClientVersion string                   `bencode:"v"` // Length: 4
-	Arguments     KRPCFindNodeResponseArgs `bencode:"r"`
-	Error         []interface{}            `bencode:"e"` // two items, error code (int) and error message
+	KRPCMessage
+	Arguments KRPCFindNodeResponseArgs `bencode:"r"`
+	Error     KRPCErrorArgs            `bencode:"e"`
 }
 
 type KRPCFindNodeResponseArgs struct {
 	NodeID string `bencode:"id"`
-	Nodes  string `bencode:"nodes"`
+	Nodes  string `bencode:"nodes,omitempty"`
+	Nodes6 string `bencode:"nodes6,omitempty"`
 }
 
-// Request sends the given query to the node, putting the reply in response.
-// query must be passed by value, response must be a pointer. This is a requirement
-// by the bencode library. We have no type checking here, so we implement
-// it manually.
-func Request(node *Node, query, response interface{}) error {
-	if reflect.ValueOf(query).Kind() != reflect.Struct {
-		return fmt.Errorf("Need to pass query by value")
-	}
-	if reflect.ValueOf(response).Kind() != reflect.Ptr {
-		return fmt.Errorf("Need to pass response as a pointer")
-	}
-	
-	conn, err := net.DialUDP("udp", &net.UDPAddr{Port: 6881}, node.Address)
-	if err != nil {
-		return err
-	}
-	defer conn.Close()
+type KRPCGetPeersQuery struct {
+	KRPCQuery
+	Arguments KRPCGetPeersQueryArgs `bencode:"a"`
+}
+
+type KRPCGetPeersQueryArgs struct {
+	NodeID   string   `bencode:"id"`
+	InfoHash string   `bencode:"info_hash"`
+	Want     []string `bencode:"want,omitempty"`
+	NoSeed   bool     `bencode:"noseed,omitempty"` // exclude seeds from values (BEP 33)
+	Scrape   bool     `bencode:"scrape,omitempty"` // request bloom filters (BEP 33)
+}
+
+type KRPCGetPeersResponse struct {
+	KRPCMessage
+	Arguments KRPCGetPeersResponseArgs `bencode:"r"`
+	Error     KRPCErrorArgs            `bencode:"e"`
+}
+
+type KRPCGetPeersResponseArgs struct {
+	NodeID string   `bencode:"id"`
+	Token  string   `bencode:"token"`
+	Values []string `bencode:"values,omitempty"` // compact peer info, 6 bytes for IPv4 and 18 bytes for IPv6
+	Nodes  string   `bencode:"nodes,omitempty"`
+	Nodes6 string   `bencode:"nodes6,omitempty"`
+
+	SeedFilter string `bencode:"BFsd,omitempty"` // bloom filter of seeds (BEP 33)
+	PeerFilter string `bencode:"BFpe,omitempty"` // bloom filter of downloaders (BEP 33)
+}
+
+type KRPCAnnouncePeerQuery struct {
+	KRPCQuery
+	Arguments KRPCAnnouncePeerQueryArgs `bencode:"a"`
+}
+
+type KRPCAnnouncePeerQueryArgs struct {
+	NodeID      string `bencode:"id"`
+	InfoHash    string `bencode:"info_hash"`
+	Port        int    `bencode:"port"`
+	ImpliedPort bool   `bencode:"implied_port,omitempty"`
+	Token       string `bencode:"token"`
+	Seed        bool   `bencode:"seed,omitempty"` // set if we are seeding (BEP 33)
+}
+
+type KRPCPingQuery struct {
+	KRPCQuery
+	Arguments KRPCPingQueryArgs `bencode:"a"`
+}
+
+type KRPCPingQueryArgs struct {
+	NodeID string `bencode:"id"`
+}
+
+// KRPCPingResponse is the response to ping, announce_peer and put queries
+type KRPCPingResponse struct {
+	KRPCMessage
+	Arguments KRPCPingQueryArgs `bencode:"r"`
+	Error     KRPCErrorArgs     `bencode:"e"`
+}
+
+type KRPCGetQuery struct {
+	KRPCQuery
+	Arguments KRPCGetQueryArgs `bencode:"a"`
+}
+
+type KRPCGetQueryArgs struct {
+	NodeID string   `bencode:"id"`
+	Target string   `bencode:"target"`
+	Seq    *int64   `bencode:"seq,omitempty"` // only return mutable items with a higher sequence number
+	Want   []string `bencode:"want,omitempty"`
+}
+
+type KRPCGetResponse struct {
+	KRPCMessage
+	Arguments KRPCGetResponseArgs `bencode:"r"`
+	Error     KRPCErrorArgs       `bencode:"e"`
+}
+
+// KRPCGetResponseArgs holds the response to a get query. The value can be
+// of any type, so it is decoded separately.
+type KRPCGetResponseArgs struct {
+	NodeID    string             `bencode:"id"`
+	Token     string             `bencode:"token"`
+	Nodes     string             `bencode:"nodes,omitempty"`
+	Nodes6    string             `bencode:"nodes6,omitempty"`
+	Value     bencode.RawMessage `bencode:"v,omitempty"`
+	PublicKey string             `bencode:"k,omitempty"`
+	Seq       int64              `bencode:"seq,omitempty"`
+	Signature string             `bencode:"sig,omitempty"`
+}
+
+// KRPCPutQuery stores an item (BEP 44)
+type KRPCPutQuery struct {
+	KRPCQuery
+	Arguments KRPCPutQueryArgs `bencode:"a"`
+}
+
+// KRPCPutQueryArgs holds the arguments of a put query. Only Value is set
+// for immutable items. Seq and CAS are significant even when they are zero.
+type KRPCPutQueryArgs struct {
+	NodeID    string      `bencode:"id"`
+	Token     string      `bencode:"token"`
+	Value     interface{} `bencode:"v"`
+	PublicKey string      `bencode:"k,omitempty"`
+	Salt      string      `bencode:"salt,omitempty"`
+	Seq       *int64      `bencode:"seq,omitempty"`
+	CAS       *int64      `bencode:"cas,omitempty"`
+	Signature string      `bencode:"sig,omitempty"`
+}
+
+type KRPCSampleInfohashesQuery struct {
+	KRPCQuery
+	Arguments KRPCFindNodeQueryArgs `bencode:"a"` // same arguments as find_node
+}
+
+type KRPCSampleInfohashesResponse struct {
+	KRPCMessage
+	Arguments KRPCSampleInfohashesResponseArgs `bencode:"r"`
+	Error     KRPCErrorArgs                    `bencode:"e"`
+}
+
+type KRPCSampleInfohashesResponseArgs struct {
+	NodeID   string `bencode:"id"`
+	Interval int    `bencode:"interval"` // seconds until the sample changes
+	Nodes    string `bencode:"nodes,omitempty"`
+	Nodes6   string `bencode:"nodes6,omitempty"`
+	Num      int    `bencode:"num"`     // number of infohashes in storage
+	Samples  string `bencode:"samples"` // concatenated 20 byte infohashes
+}
+
+// KRPCResponse is used to send responses to incoming queries. Arguments
+// holds the method specific response arguments.
+type KRPCResponse struct {
+	KRPCMessage
+	Arguments interface{} `bencode:"r"`
+}
+
+// KRPCError is sent in reply to a query that could not be processed
+type KRPCError struct {
+	KRPCMessage
+	Error KRPCErrorArgs `bencode:"e"`
+}
+
+// pendingQuery is a query we sent and haven't received a response for yet
+type pendingQuery struct {
+	address  *net.UDPAddr
+	response chan []byte
+}
+
+// Request sends the given query to the node, decoding the reply into
+// response, which must be a pointer. The query's TransactionID is replaced
+// with a unique one. Waiting for the reply ends when ctx is done.
+func (dht *DHT) Request(ctx context.Context, node *Node, query Query, response interface{}) error {
+	tid, responseChan := dht.newTransaction(node.Address)
+	defer dht.finishTransaction(tid)
+
+	header := query.Header()
+	header.TransactionID = tid
+	header.ReadOnly = dht.IsReadOnly()
 
 	bencodeBytes, err := KRPCEncode(query)
 	if err != nil {
 		return err
 	}
-	n, err := conn.Write(bencodeBytes)
+	n, err := dht.conn.WriteTo(bencodeBytes, node.Address)
 	if err != nil {
 		return err
 	}
 	log.Printf("KRPC query bytes=%d data=%s", n, bencodeBytes)
 
-	deadline := time.Now().Add(5 * time.Second)
-	err = conn.SetReadDeadline(deadline)
-	if err != nil {
-		return err
+	select {
+	case packet := <-responseChan:
+		return bencode.Unmarshal(packet, response)
+	case <-dht.clock.After(queryTimeout):
+		return fmt.Errorf("Query to %s timed out", node.Address)
+	case <-dht.done:
+		return fmt.Errorf("DHT closed")
+	case <-ctx.Done():
+		return ctx.Err()
 	}
+}
 
-	buffer := make([]byte, 4096)
-	nRead, addr, err := conn.ReadFrom(buffer)
-	if err != nil {
-		return err
+// newTransaction allocates a transaction ID and registers it, so that the
+// response to the query can be delivered.
+func (dht *DHT) newTransaction(address *net.UDPAddr) (string, chan []byte) {
+	dht.mu.Lock()
+	defer dht.mu.Unlock()
+
+	tid := make([]byte, 2)
+	for {
+		dht.nextTID++
+		binary.BigEndian.PutUint16(tid, dht.nextTID)
+		if _, ok := dht.pending[string(tid)]; !ok {
+			break
+		}
+	}
+	responseChan := make(chan []byte, 1)
+	dht.pending[string(tid)] = &pendingQuery{
+		address:  address,
+		response: responseChan,
 	}
-	log.Printf("UDP packet received: bytes=%d from=%s data=%s", nRead, addr.String(), string(buffer))
+	return string(tid), responseChan
+}
 
-	err = bencode.Unmarshal(bytes.NewReader(buffer), response)
-	return err
+func (dht *DHT) finishTransaction(tid string) {
+	dht.mu.Lock()
+	defer dht.mu.Unlock()
+	delete(dht.pending, tid)
 }
 
 func (resp *KRPCFindNodeResponse) toNodes() (int, *Node, error) {
 	if resp.MessageType == "e" {
-		return 0, nil, fmt.Errorf("Error finding nodes: code=%d message=%s", resp.Error[0], resp.Error[1])
+		return 0, nil, resp.Error.error("finding nodes")
 	}
-	var first, cur *Node
-	nodestr := resp.Arguments.Nodes
-	count := len(nodestr) / 26
+	nodes := parseNodes(resp.Arguments.Nodes, net.IPv4len)
+	nodes = append(nodes, parseNodes(resp.Arguments.Nodes6, net.IPv6len)...)
+
+	return len(nodes), linkNodes(nodes), nil
+}
+
+func (resp *KRPCGetPeersResponse) toPeersAndNodes() ([]peers.Peer, *Node, string, error) {
+	if resp.MessageType == "e" {
+		return nil, nil, "", resp.Error.error("getting peers")
+	}
+	var found []peers.Peer
+	for _, value := range resp.Arguments.Values {
+		var p []peers.Peer
+		var err error
+		// IPv4 and IPv6 peers are distinguished by their length
+		if len(value) == net.IPv6len+2 {
+			p, err = peers.Unmarshal6([]byte(value))
+		} else {
+			p, err = peers.Unmarshal([]byte(value))
+		}
+		if err != nil {
+			return nil, nil, "", err
+		}
+		found = append(found, p...)
+	}
+	nodes := parseNodes(resp.Arguments.Nodes, net.IPv4len)
+	nodes = append(nodes, parseNodes(resp.Arguments.Nodes6, net.IPv6len)...)
+
+	return found, linkNodes(nodes), resp.Arguments.Token, nil
+}
+
+// parseNodes decodes compact node info, with ipLen being the length of the IP
+// address (4 for the "nodes" key, 16 for "nodes6"). Trailing garbage is ignored.
+func parseNodes(nodestr string, ipLen int) []*Node {
+	entryLen := compactNodeLen
+	if ipLen == net.IPv6len {
+		entryLen = compactNode6Len
+	}
+	count := len(nodestr) / entryLen
+	nodes := make([]*Node, count)
 	for i := 0; i < count; i++ {
+		entry := nodestr[i*entryLen : (i+1)*entryLen]
 		new := Node{
 			ID: new([20]byte), // will be filled below
 			Address: &net.UDPAddr{
 				// the IP we receive is in network byte order, and it's supposed to be in network byte order here as well
-				IP:   []byte(nodestr[i*26+20 : i*26+24]),
-				Port: int(binary.BigEndian.Uint16([]byte(nodestr[i*26+24 : i*26+26]))),
+				IP:   []byte(entry[20 : 20+ipLen]),
+				Port: int(binary.BigEndian.Uint16([]byte(entry[20+ipLen:]))),
 			},
-			LastActive: time.Now(),
 		}
-		copy(new.ID[:], []byte(nodestr[i*26:i*26+20]))
+		copy(new.ID[:], []byte(entry[:20]))
+		nodes[i] = &new
+	}
+	return nodes
+}
+
+// encodeNodes creates compact node info for the nodes matching the address
+// family given by ipLen, skipping all others.
+func encodeNodes(nodes []*Node, ipLen int) string {
+	var buf bytes.Buffer
+	for _, node := range nodes {
+		ip := node.Address.IP.To4()
+		if ipLen == net.IPv6len {
+			if ip != nil {
+				continue
+			}
+			ip = node.Address.IP.To16()
+		}
+		if ip == nil {
+			continue
+		}
+		port := make([]byte, 2)
+		binary.BigEndian.PutUint16(port, uint16(node.Address.Port))
+		buf.Write(node.ID[:])
+		buf.Write(ip)
+		buf.Write(port)
+	}
+	return buf.String()
+}
+
+// linkNodes turns the slice into a linked list, returning its head
+func linkNodes(nodes []*Node) *Node {
+	var first, cur *Node
+	for _, node := range nodes {
 		if cur == nil {
-			first = &new
-			cur = first
+			first = node
 		} else {
-			cur.Next = &new
-			cur = &new
+			cur.Next = node
 		}
+		cur = node
 	}
+	return first
+}
 
-	return count, first, nil
+// newKRPCQuery returns the common fields of a query for method
+func newKRPCQuery(method string) KRPCQuery {
+	return KRPCQuery{
+		KRPCMessage: KRPCMessage{
+			TransactionID: "aa",
+			MessageType:   "q",
+			ClientVersion: clientVersion,
+		},
+		QueryMethod: method,
+	}
 }
 
 func NewKRPCFindNodeQuery(source []byte, target []byte) KRPCFindNodeQuery {
 	return KRPCFindNodeQuery{
-		QueryMethod:   "find_node",
-		TransactionID: "aa",
-		MessageType:   "q",
-		ClientVersion: "JT00",
+		KRPCQuery: newKRPCQuery("find_node"),
 		Arguments: KRPCFindNodeQueryArgs{
 			NodeID:       string(source[:]),
 			TargetNodeID: string(target[:]),
@@ -142,15 +417,89 @@ func NewKRPCFindNodeQuery(source []byte, target []byte) KRPCFindNodeQuery {
 	}
 }
 
-func KRPCEncode(query interface{}) ([]byte, error) {
-	// We'll need to buffer the output by bencode.Marshal, and send it
-	// in one write. If we let it write directly to conn it will create
-	// many tiny UDP packets and it won't work.
-	var bencodeBuf bytes.Buffer
-	err := bencode.Marshal(&bencodeBuf, query)
+func NewKRPCGetPeersQuery(source []byte, infohash []byte) KRPCGetPeersQuery {
+	return KRPCGetPeersQuery{
+		KRPCQuery: newKRPCQuery("get_peers"),
+		Arguments: KRPCGetPeersQueryArgs{
+			NodeID:   string(source[:]),
+			InfoHash: string(infohash[:]),
+		},
+	}
+}
+
+func NewKRPCAnnouncePeerQuery(source []byte, infohash []byte, port int, token string, seed bool) KRPCAnnouncePeerQuery {
+	return KRPCAnnouncePeerQuery{
+		KRPCQuery: newKRPCQuery("announce_peer"),
+		Arguments: KRPCAnnouncePeerQueryArgs{
+			NodeID:   string(source[:]),
+			InfoHash: string(infohash[:]),
+			Port:     port,
+			Token:    token,
+			Seed:     seed,
+		},
+	}
+}
+
+func NewKRPCPingQuery(source []byte) KRPCPingQuery {
+	return KRPCPingQuery{
+		KRPCQuery: newKRPCQuery("ping"),
+		Arguments: KRPCPingQueryArgs{
+			NodeID: string(source[:]),
+		},
+	}
+}
+
+// NewKRPCGetQuery creates a get query. For mutable items, seq can be set to
+// only get items with a higher sequence number.
+func NewKRPCGetQuery(source []byte, target []byte, seq *int64) KRPCGetQuery {
+	return KRPCGetQuery{
+		KRPCQuery: newKRPCQuery("get"),
+		Arguments: KRPCGetQueryArgs{
+			NodeID: string(source[:]),
+			Target: string(target[:]),
+			Seq:    seq,
+		},
+	}
+}
+
+// NewKRPCPutQuery creates a put query for the item. cas is only sent for
+// mutable items, and only if it isn't nil.
+func NewKRPCPutQuery(source []byte, token string, item *Item, cas *int64) (KRPCPutQuery, error) {
+	_, err := item.encodedValue()
 	if err != nil {
-		return nil, err
+		return KRPCPutQuery{}, err
 	}
+	query := KRPCPutQuery{
+		KRPCQuery: newKRPCQuery("put"),
+		Arguments: KRPCPutQueryArgs{
+			NodeID: string(source[:]),
+			Token:  token,
+			Value:  item.Value,
+		},
+	}
+	if item.IsMutable() {
+		seq := item.Seq
+		query.Arguments.PublicKey = string(item.PublicKey)
+		query.Arguments.Salt = string(item.Salt)
+		query.Arguments.Seq = &seq
+		query.Arguments.Signature = string(item.Signature)
+		query.Arguments.CAS = cas
+	}
+	return query, nil
+}
+
+func NewKRPCSampleInfohashesQuery(source []byte, target []byte) KRPCSampleInfohashesQuery {
+	return KRPCSampleInfohashesQuery{
+		KRPCQuery: newKRPCQuery("sample_infohashes"),
+		Arguments: KRPCFindNodeQueryArgs{
+			NodeID:       string(source[:]),
+			TargetNodeID: string(target[:]),
+		},
+	}
+}
 
-	return bencodeBuf.Bytes(), nil
+// KRPCEncode encodes a message. It has to be sent in a single write, as
+// every write on a UDP connection is a packet of its own.
+func KRPCEncode(msg interface{}) ([]byte, error) {
+	return bencode.Marshal(msg)
 }
@@ -0,0 +1,193 @@
+package dht
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sjaensch/storrent/peers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncodeAndParseNodes(t *testing.T) {
+	nodes := []*Node{
+		{ID: &[20]byte{1}, Address: &net.UDPAddr{IP: net.IP{192, 0, 2, 1}, Port: 6881}},
+		{ID: &[20]byte{2}, Address: &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 6882}},
+		{ID: &[20]byte{3}, Address: &net.UDPAddr{IP: net.ParseIP("192.0.2.3"), Port: 6883}},
+	}
+
+	nodestr := encodeNodes(nodes, net.IPv4len)
+	require.Len(t, nodestr, 2*compactNodeLen)
+	nodestr6 := encodeNodes(nodes, net.IPv6len)
+	require.Len(t, nodestr6, compactNode6Len)
+
+	parsed := parseNodes(nodestr, net.IPv4len)
+	require.Len(t, parsed, 2)
+	assert.Equal(t, nodes[0].ID, parsed[0].ID)
+	assert.True(t, sameAddress(nodes[0].Address, parsed[0].Address))
+	assert.Equal(t, nodes[2].ID, parsed[1].ID)
+	assert.True(t, sameAddress(nodes[2].Address, parsed[1].Address))
+
+	parsed6 := parseNodes(nodestr6, net.IPv6len)
+	require.Len(t, parsed6, 1)
+	assert.Equal(t, nodes[1].ID, parsed6[0].ID)
+	assert.True(t, sameAddress(nodes[1].Address, parsed6[0].Address))
+}
+
+func TestFindNodeResponseToNodes(t *testing.T) {
+	response := KRPCFindNodeResponse{
+		KRPCMessage: KRPCMessage{MessageType: "r"},
+		Arguments: KRPCFindNodeResponseArgs{
+			Nodes:  encodeNodes([]*Node{{ID: &[20]byte{1}, Address: &net.UDPAddr{IP: net.IP{192, 0, 2, 1}, Port: 1}}}, net.IPv4len),
+			Nodes6: encodeNodes([]*Node{{ID: &[20]byte{2}, Address: &net.UDPAddr{IP: net.IPv6loopback, Port: 2}}}, net.IPv6len),
+		},
+	}
+	count, first, err := response.toNodes()
+	require.Nil(t, err)
+	assert.Equal(t, 2, count)
+	assert.False(t, first.isIPv6())
+	assert.True(t, first.Next.isIPv6())
+	assert.Nil(t, first.Next.Next)
+}
+
+func TestGetPeersResponseValues(t *testing.T) {
+	response := KRPCGetPeersResponse{
+		KRPCMessage: KRPCMessage{MessageType: "r"},
+		Arguments: KRPCGetPeersResponseArgs{
+			Token: "token",
+			Values: []string{
+				string([]byte{192, 0, 2, 1, 0x1a, 0xe1}),
+				string([]byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x1a, 0xe2}),
+			},
+		},
+	}
+	found, nodes, token, err := response.toPeersAndNodes()
+	require.Nil(t, err)
+	assert.Nil(t, nodes)
+	assert.Equal(t, "token", token)
+	require.Len(t, found, 2)
+	assert.Equal(t, "192.0.2.1:6881", found[0].String())
+	assert.Equal(t, "[2001:db8::1]:6882", found[1].String())
+}
+
+func TestWantedFamilies(t *testing.T) {
+	addr4 := &net.UDPAddr{IP: net.IP{192, 0, 2, 1}}
+	addr6 := &net.UDPAddr{IP: net.ParseIP("2001:db8::1")}
+	tests := map[string]struct {
+		want     []string
+		addr     *net.UDPAddr
+		wantIPv4 bool
+		wantIPv6 bool
+	}{
+		"default IPv4":   {nil, addr4, true, false},
+		"default IPv6":   {nil, addr6, false, true},
+		"explicit both":  {[]string{WantIPv4, WantIPv6}, addr4, true, true},
+		"explicit only6": {[]string{WantIPv6}, addr4, false, true},
+	}
+	for name, test := range tests {
+		wantIPv4, wantIPv6 := wantedFamilies(test.want, test.addr)
+		assert.Equal(t, test.wantIPv4, wantIPv4, name)
+		assert.Equal(t, test.wantIPv6, wantIPv6, name)
+	}
+}
+
+func newLoopbackDHT(t *testing.T, network, address string) *DHT {
+	conn, err := net.ListenPacket(network, address)
+	if err != nil {
+		t.Skipf("Can't listen on %s: %v", address, err)
+	}
+	return New(conn)
+}
+
+func loopbackNode(dht *DHT) *Node {
+	return &Node{
+		ID:      dht.NodeID,
+		Address: dht.conn.LocalAddr().(*net.UDPAddr),
+	}
+}
+
+func TestAnnounceAndGetPeers(t *testing.T) {
+	for _, address := range []string{"127.0.0.1:0", "[::1]:0"} {
+		server := newLoopbackDHT(t, "udp", address)
+		defer server.Close()
+		client := newLoopbackDHT(t, "udp", address)
+		defer client.Close()
+
+		infohash := []byte("aaaaaaaaaaaaaaaaaaaa")
+		found, nodes, token, err := client.GetPeers(context.Background(), loopbackNode(server), infohash)
+		require.Nil(t, err)
+		assert.Empty(t, found)
+		// the server learned about the client from the query and returns it
+		require.NotNil(t, nodes)
+		assert.Equal(t, client.NodeID, nodes.ID)
+
+		err = client.AnnouncePeer(context.Background(), loopbackNode(server), infohash, 6889, token, false)
+		require.Nil(t, err)
+		err = client.AnnouncePeer(context.Background(), loopbackNode(server), infohash, 6889, "bad token", false)
+		assert.NotNil(t, err)
+
+		found, _, _, err = client.GetPeers(context.Background(), loopbackNode(server), infohash)
+		require.Nil(t, err)
+		ip := client.conn.LocalAddr().(*net.UDPAddr).IP
+		assert.Equal(t, []peers.Peer{{IP: ip, Port: 6889}}, normalize(found))
+	}
+}
+
+func TestFindNodeReturnsBothFamilies(t *testing.T) {
+	server := newLoopbackDHT(t, "udp", "127.0.0.1:0")
+	defer server.Close()
+	client := newLoopbackDHT(t, "udp", "127.0.0.1:0")
+	defer client.Close()
+
+	node6 := &Node{
+		ID:      &[20]byte{6},
+		Address: &net.UDPAddr{IP: net.ParseIP("2001:db8::6"), Port: 6881},
+	}
+	server.InsertNode(node6)
+
+	nodes, err := client.FindNode(context.Background(), loopbackNode(server), make([]byte, 20))
+	require.Nil(t, err)
+	var found6 bool
+	for node := nodes; node != nil; node = node.Next {
+		if node.isIPv6() {
+			found6 = true
+			assert.Equal(t, node6.ID, node.ID)
+		}
+	}
+	assert.True(t, found6)
+}
+
+func TestRequestCanceled(t *testing.T) {
+	client := newLoopbackDHT(t, "udp", "127.0.0.1:0")
+	defer client.Close()
+	// a socket that never answers
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer silent.Close()
+	node := &Node{ID: &[20]byte{1}, Address: silent.LocalAddr().(*net.UDPAddr)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	_, err = client.Ping(ctx, node)
+	assert.Equal(t, context.Canceled, err)
+
+	// lookups don't start on a cancelled context
+	client.InsertNode(node)
+	_, err = client.LookupPeers(ctx, make([]byte, 20))
+	assert.Equal(t, context.Canceled, err)
+}
+
+// normalize converts peer IPs to their shortest representation, so they can be compared
+func normalize(found []peers.Peer) []peers.Peer {
+	for i := range found {
+		if ip := found[i].IP.To4(); ip != nil {
+			found[i].IP = ip
+		}
+	}
+	return found
+}
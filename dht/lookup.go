@@ -0,0 +1,208 @@
+package dht
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+
+	"github.com/sjaensch/storrent/peers"
+)
+
+// lookupParallelism is the number of queries in flight during a lookup
+const lookupParallelism = 3
+
+// lookup performs an iterative lookup for target. Starting with the nodes in
+// our routing table, the closest nodes are queried, and the nodes they return
+// are queried in turn, until the closest nodes have all responded or failed.
+// query sends the actual query to a node and returns the closer nodes from the
+// response. The closest nodes that responded are returned. Once ctx is done,
+// no more queries are sent.
+func (dht *DHT) lookup(ctx context.Context, target []byte, query func(node *Node) (*Node, error)) []*Node {
+	candidates := dht.knownNodes()
+	seen := make(map[string]bool)
+	for _, node := range candidates {
+		seen[node.Address.String()] = true
+	}
+	queried := make(map[string]bool)
+	failed := make(map[string]bool)
+	var responded []*Node
+	var mu sync.Mutex
+
+	for {
+		sort.Slice(candidates, func(i, j int) bool {
+			return closer(candidates[i].ID[:], candidates[j].ID[:], target)
+		})
+
+		// query the closest nodes that we haven't queried yet, ignoring the
+		// ones that failed
+		var batch []*Node
+		closest := 0
+		for _, node := range candidates {
+			if closest == maxNodesPerBucket || len(batch) == lookupParallelism {
+				break
+			}
+			address := node.Address.String()
+			if failed[address] {
+				continue
+			}
+			closest++
+			if !queried[address] {
+				queried[address] = true
+				batch = append(batch, node)
+			}
+		}
+		if len(batch) == 0 || ctx.Err() != nil {
+			break
+		}
+
+		var wg sync.WaitGroup
+		for _, node := range batch {
+			wg.Add(1)
+			go func(node *Node) {
+				defer wg.Done()
+				nodes, err := query(node)
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil {
+					log.Printf("Lookup query to %s failed: %v", node.Address, err)
+					failed[node.Address.String()] = true
+					return
+				}
+				responded = append(responded, node)
+				for node := nodes; node != nil; node = node.Next {
+					address := node.Address.String()
+					if !seen[address] && *node.ID != *dht.NodeID {
+						seen[address] = true
+						candidates = append(candidates, node)
+					}
+				}
+			}(node)
+		}
+		wg.Wait()
+	}
+
+	// the nodes that answered are alive, keep them in our routing table
+	for _, node := range responded {
+		alive := *node
+		alive.LastActive = dht.now()
+		dht.InsertNode(&alive)
+	}
+
+	sort.Slice(responded, func(i, j int) bool {
+		return closer(responded[i].ID[:], responded[j].ID[:], target)
+	})
+	if len(responded) > maxNodesPerBucket {
+		responded = responded[:maxNodesPerBucket]
+	}
+	return responded
+}
+
+// LookupPeers searches the DHT for peers downloading the given infohash
+func (dht *DHT) LookupPeers(ctx context.Context, infohash []byte) ([]peers.Peer, error) {
+	found := make(map[string]peers.Peer)
+	var mu sync.Mutex
+	responded := dht.lookup(ctx, infohash, func(node *Node) (*Node, error) {
+		values, nodes, _, err := dht.GetPeers(ctx, node, infohash)
+		if err != nil {
+			return nil, err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, peer := range values {
+			found[peer.String()] = peer
+		}
+		return nodes, nil
+	})
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if len(responded) == 0 {
+		return nil, fmt.Errorf("No DHT node responded")
+	}
+
+	result := make([]peers.Peer, 0, len(found))
+	for _, peer := range found {
+		result = append(result, peer)
+	}
+	return result, nil
+}
+
+// Announce tells the nodes closest to infohash that we are downloading it
+// (or seeding it, if seed is set) on the given port. It returns the number
+// of nodes that accepted the announcement.
+func (dht *DHT) Announce(ctx context.Context, infohash []byte, port int, seed bool) (int, error) {
+	tokens := make(map[string]string)
+	var mu sync.Mutex
+	responded := dht.lookup(ctx, infohash, func(node *Node) (*Node, error) {
+		_, nodes, token, err := dht.GetPeers(ctx, node, infohash)
+		if err != nil {
+			return nil, err
+		}
+		mu.Lock()
+		tokens[node.Address.String()] = token
+		mu.Unlock()
+		return nodes, nil
+	})
+
+	if ctx.Err() != nil {
+		return 0, ctx.Err()
+	}
+	announced := 0
+	for _, node := range responded {
+		err := dht.AnnouncePeer(ctx, node, infohash, port, tokens[node.Address.String()], seed)
+		if err != nil {
+			log.Printf("Announcing to %s failed: %v", node.Address, err)
+			continue
+		}
+		announced++
+	}
+	if announced == 0 {
+		return 0, fmt.Errorf("No DHT node accepted the announcement")
+	}
+	return announced, nil
+}
+
+// Scrape estimates the number of seeders and leechers of the infohash (BEP 33),
+// by merging the bloom filters of the nodes closest to it.
+func (dht *DHT) Scrape(ctx context.Context, infohash []byte) (seeders, leechers int, err error) {
+	filters := make(map[string]*KRPCGetPeersResponseArgs)
+	var mu sync.Mutex
+	responded := dht.lookup(ctx, infohash, func(node *Node) (*Node, error) {
+		response, err := dht.getPeers(ctx, node, infohash, true)
+		if err != nil {
+			return nil, err
+		}
+		_, nodes, _, err := response.toPeersAndNodes()
+		if err != nil {
+			return nil, err
+		}
+		mu.Lock()
+		filters[node.Address.String()] = &response.Arguments
+		mu.Unlock()
+		return nodes, nil
+	})
+	if ctx.Err() != nil {
+		return 0, 0, ctx.Err()
+	}
+	if len(responded) == 0 {
+		return 0, 0, fmt.Errorf("No DHT node responded")
+	}
+
+	var seeds, downloaders BloomFilter
+	for _, node := range responded {
+		args := filters[node.Address.String()]
+		if len(args.SeedFilter) == len(seeds) {
+			var bf BloomFilter
+			copy(bf[:], args.SeedFilter)
+			seeds.Merge(&bf)
+		}
+		if len(args.PeerFilter) == len(downloaders) {
+			var bf BloomFilter
+			copy(bf[:], args.PeerFilter)
+			downloaders.Merge(&bf)
+		}
+	}
+	return int(seeds.Estimate() + 0.5), int(downloaders.Estimate() + 0.5), nil
+}
@@ -0,0 +1,69 @@
+package dht
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/sjaensch/storrent/peers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newLoopbackNetwork creates count DHT nodes on loopback. Each node only knows
+// its predecessor, so lookups have to traverse the network.
+func newLoopbackNetwork(t *testing.T, count int) []*DHT {
+	dhts := make([]*DHT, count)
+	for i := range dhts {
+		dhts[i] = newLoopbackDHT(t, "udp", "127.0.0.1:0")
+		if i > 0 {
+			dhts[i].InsertNode(loopbackNode(dhts[i-1]))
+		}
+	}
+	return dhts
+}
+
+func closeAll(dhts []*DHT) {
+	for _, dht := range dhts {
+		dht.Close()
+	}
+}
+
+func TestAnnounceAndLookupPeers(t *testing.T) {
+	dhts := newLoopbackNetwork(t, 6)
+	defer closeAll(dhts)
+
+	infohash := []byte("aaaaaaaaaaaaaaaaaaaa")
+	announced, err := dhts[len(dhts)-1].Announce(context.Background(), infohash, 6889, false)
+	require.Nil(t, err)
+	assert.True(t, announced > 0)
+
+	found, err := dhts[len(dhts)-2].LookupPeers(context.Background(), infohash)
+	require.Nil(t, err)
+	require.Len(t, found, 1)
+	assert.True(t, found[0].IP.Equal(net.IP{127, 0, 0, 1}))
+	assert.Equal(t, uint16(6889), found[0].Port)
+}
+
+func TestScrape(t *testing.T) {
+	dhts := newLoopbackNetwork(t, 4)
+	defer closeAll(dhts)
+
+	infohash := []byte("aaaaaaaaaaaaaaaaaaaa")
+	for i := 0; i < 3; i++ {
+		dhts[0].storePeer(infohash, peersForScrape(i), true)
+		dhts[1].storePeer(infohash, peersForScrape(i), true)
+	}
+	for i := 3; i < 10; i++ {
+		dhts[2].storePeer(infohash, peersForScrape(i), false)
+	}
+
+	seeders, leechers, err := dhts[3].Scrape(context.Background(), infohash)
+	require.Nil(t, err)
+	assert.Equal(t, 3, seeders)
+	assert.Equal(t, 7, leechers)
+}
+
+func peersForScrape(i int) peers.Peer {
+	return peers.Peer{IP: net.IP{192, 0, 2, byte(i)}, Port: 6881}
+}
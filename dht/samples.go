@@ -0,0 +1,188 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxSamples is the number of infohashes we return per sample_infohashes
+// query, so that the response fits into a single UDP packet
+const maxSamples = 20
+
+// sampleInterval is how long we keep returning the same sample
+const sampleInterval = 15 * time.Minute
+
+// crawlParallelism is the number of sample_infohashes queries in flight while crawling
+const crawlParallelism = 8
+
+// Samples is the result of a sample_infohashes query (BEP 51)
+type Samples struct {
+	Infohashes [][20]byte    // random sample of the infohashes the node stores peers for
+	Num        int           // total number of infohashes the node stores peers for
+	Interval   time.Duration // time until the node returns a different sample
+}
+
+// SampleInfohashes asks the node for a sample of the infohashes it stores
+// peers for. Nodes close to target are returned as well, so the keyspace
+// can be crawled.
+func (dht *DHT) SampleInfohashes(ctx context.Context, node *Node, target []byte) (*Samples, *Node, error) {
+	query := NewKRPCSampleInfohashesQuery(dht.NodeID[:], target)
+	query.Arguments.Want = []string{WantIPv4, WantIPv6}
+	response := KRPCSampleInfohashesResponse{}
+	err := dht.Request(ctx, node, &query, &response)
+	if err != nil {
+		return nil, nil, err
+	}
+	if response.MessageType == "e" {
+		return nil, nil, response.Error.error("sampling infohashes")
+	}
+	if len(response.Arguments.Samples)%20 != 0 {
+		return nil, nil, fmt.Errorf("Received malformed samples of length %d", len(response.Arguments.Samples))
+	}
+
+	samples := &Samples{
+		Infohashes: make([][20]byte, len(response.Arguments.Samples)/20),
+		Num:        response.Arguments.Num,
+		Interval:   time.Duration(response.Arguments.Interval) * time.Second,
+	}
+	for i := range samples.Infohashes {
+		copy(samples.Infohashes[i][:], response.Arguments.Samples[i*20:(i+1)*20])
+	}
+	nodes := parseNodes(response.Arguments.Nodes, net.IPv4len)
+	nodes = append(nodes, parseNodes(response.Arguments.Nodes6, net.IPv6len)...)
+	return samples, linkNodes(nodes), nil
+}
+
+// CrawlInfohashes walks the keyspace, sending sample_infohashes queries to at
+// most maxQueries nodes, starting with the ones in our routing table. Each
+// query targets a different region of the keyspace so that the crawl spreads
+// out. All distinct infohashes found are returned, including those found
+// before ctx was done.
+func (dht *DHT) CrawlInfohashes(ctx context.Context, maxQueries int) [][20]byte {
+	candidates := dht.knownNodes()
+	queried := make(map[string]bool)
+	found := make(map[[20]byte]bool)
+	var infohashes [][20]byte
+	var mu sync.Mutex
+
+	for step := 0; len(queried) < maxQueries; step++ {
+		target := keyspaceTarget(step)
+		sort.Slice(candidates, func(i, j int) bool {
+			return closer(candidates[i].ID[:], candidates[j].ID[:], target[:])
+		})
+
+		// pick the closest nodes we haven't queried yet
+		var batch []*Node
+		for _, node := range candidates {
+			if len(batch) == crawlParallelism || len(queried) == maxQueries {
+				break
+			}
+			if !queried[node.Address.String()] {
+				queried[node.Address.String()] = true
+				batch = append(batch, node)
+			}
+		}
+		if len(batch) == 0 || ctx.Err() != nil {
+			break
+		}
+
+		var wg sync.WaitGroup
+		for _, node := range batch {
+			wg.Add(1)
+			go func(node *Node) {
+				defer wg.Done()
+				samples, nodes, err := dht.SampleInfohashes(ctx, node, target[:])
+				if err != nil {
+					log.Printf("Sampling infohashes from %s failed: %v", node.Address, err)
+					return
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				for _, infohash := range samples.Infohashes {
+					if !found[infohash] {
+						found[infohash] = true
+						infohashes = append(infohashes, infohash)
+					}
+				}
+				for node := nodes; node != nil; node = node.Next {
+					if *node.ID != *dht.NodeID {
+						candidates = append(candidates, node)
+					}
+				}
+			}(node)
+		}
+		wg.Wait()
+	}
+
+	return infohashes
+}
+
+// keyspaceTarget returns a target in a different region of the keyspace for
+// each step, cycling through all 256 prefixes of the first byte.
+func keyspaceTarget(step int) [20]byte {
+	// reverse the bits of step, so consecutive steps are far apart
+	var prefix [20]byte
+	for i := 0; i < 8; i++ {
+		prefix[0] |= byte((step>>i)&1) << (7 - i)
+	}
+	return randomIDWithPrefix(prefix, 8)
+}
+
+// knownNodes returns copies of all nodes in our routing tables
+func (dht *DHT) knownNodes() []*Node {
+	dht.mu.Lock()
+	defer dht.mu.Unlock()
+	var nodes []*Node
+	collect := func(node *Node) {
+		nodeCopy := *node
+		nodeCopy.Next = nil
+		nodes = append(nodes, &nodeCopy)
+	}
+	dht.BucketTree.walk(collect)
+	dht.BucketTree6.walk(collect)
+	return nodes
+}
+
+// handleSampleInfohashes answers a sample_infohashes query with a random
+// sample of the infohashes in our peer store, plus the nodes closest to the target.
+func (dht *DHT) handleSampleInfohashes(query *krpcIncoming, addr *net.UDPAddr) KRPCSampleInfohashesResponseArgs {
+	args := &query.Arguments
+	nodes, nodes6 := dht.closestNodes([]byte(args.Target), args.Want, addr)
+
+	dht.mu.Lock()
+	defer dht.mu.Unlock()
+	now := dht.now()
+	if dht.samples == nil || now.Sub(dht.sampled) > sampleInterval {
+		dht.samples = make([][20]byte, 0, len(dht.peerStore))
+		for infohash := range dht.peerStore {
+			dht.samples = append(dht.samples, infohash)
+		}
+		rand.Shuffle(len(dht.samples), func(i, j int) {
+			dht.samples[i], dht.samples[j] = dht.samples[j], dht.samples[i]
+		})
+		if len(dht.samples) > maxSamples {
+			dht.samples = dht.samples[:maxSamples]
+		}
+		dht.sampled = now
+	}
+
+	var samples bytes.Buffer
+	for _, infohash := range dht.samples {
+		samples.Write(infohash[:])
+	}
+	return KRPCSampleInfohashesResponseArgs{
+		NodeID:   string(dht.NodeID[:]),
+		Interval: int((sampleInterval - now.Sub(dht.sampled)) / time.Second),
+		Nodes:    nodes,
+		Nodes6:   nodes6,
+		Num:      len(dht.peerStore),
+		Samples:  samples.String(),
+	}
+}
@@ -0,0 +1,64 @@
+package dht
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/sjaensch/storrent/peers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSampleInfohashes(t *testing.T) {
+	server := newLoopbackDHT(t, "udp", "127.0.0.1:0")
+	defer server.Close()
+	client := newLoopbackDHT(t, "udp", "127.0.0.1:0")
+	defer client.Close()
+
+	for i := 0; i < maxSamples+5; i++ {
+		server.storePeer([]byte{byte(i), 19: 0}, peers.Peer{IP: net.IP{192, 0, 2, 1}, Port: 6881}, false)
+	}
+
+	samples, _, err := client.SampleInfohashes(context.Background(), loopbackNode(server), make([]byte, 20))
+	require.Nil(t, err)
+	assert.Equal(t, maxSamples+5, samples.Num)
+	assert.Len(t, samples.Infohashes, maxSamples)
+	assert.True(t, samples.Interval > 0 && samples.Interval <= sampleInterval)
+
+	// the sample doesn't change within the interval
+	again, _, err := client.SampleInfohashes(context.Background(), loopbackNode(server), make([]byte, 20))
+	require.Nil(t, err)
+	assert.Equal(t, samples.Infohashes, again.Infohashes)
+}
+
+func TestKeyspaceTarget(t *testing.T) {
+	prefixes := make(map[byte]bool)
+	for step := 0; step < 256; step++ {
+		target := keyspaceTarget(step)
+		prefixes[target[0]] = true
+	}
+	assert.Len(t, prefixes, 256)
+	assert.Equal(t, byte(0x80), keyspaceTarget(1)[0])
+}
+
+func TestCrawlInfohashes(t *testing.T) {
+	crawler := newLoopbackDHT(t, "udp", "127.0.0.1:0")
+	defer crawler.Close()
+	first := newLoopbackDHT(t, "udp", "127.0.0.1:0")
+	defer first.Close()
+	second := newLoopbackDHT(t, "udp", "127.0.0.1:0")
+	defer second.Close()
+
+	// the crawler only knows the first node, which knows the second one
+	crawler.InsertNode(loopbackNode(first))
+	first.InsertNode(loopbackNode(second))
+	first.storePeer([]byte("aaaaaaaaaaaaaaaaaaaa"), peers.Peer{IP: net.IP{192, 0, 2, 1}, Port: 6881}, false)
+	second.storePeer([]byte("bbbbbbbbbbbbbbbbbbbb"), peers.Peer{IP: net.IP{192, 0, 2, 2}, Port: 6881}, false)
+
+	infohashes := crawler.CrawlInfohashes(context.Background(), 10)
+	assert.ElementsMatch(t, [][20]byte{
+		{'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a'},
+		{'b', 'b', 'b', 'b', 'b', 'b', 'b', 'b', 'b', 'b', 'b', 'b', 'b', 'b', 'b', 'b', 'b', 'b', 'b', 'b'},
+	}, infohashes)
+}
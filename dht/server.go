@@ -0,0 +1,434 @@
+package dht
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"log"
+	"net"
+	"time"
+
+	"github.com/sjaensch/storrent/bencode"
+	"github.com/sjaensch/storrent/peers"
+)
+
+// KRPC error codes as defined in BEP 5
+const (
+	errGeneric       = 201
+	errServer        = 202
+	errProtocol      = 203
+	errMethodUnknown = 204
+
+	// BEP 44 errors
+	errMessageTooBig    = 205
+	errInvalidSignature = 206
+	errSaltTooBig       = 207
+	errCASMismatch      = 301
+	errSeqTooLow        = 302
+)
+
+// tokenRotation is how often the secret used for announce tokens changes.
+// Tokens remain valid for up to twice that time.
+const tokenRotation = 5 * time.Minute
+
+// Announced peers are forgotten after peerLifetime unless they announce
+// again. The limits keep the peer store from growing without bounds.
+const (
+	peerLifetime        = 30 * time.Minute
+	maxPeersPerInfohash = 1000
+	maxInfohashes       = 10000
+)
+
+// krpcIncoming is used to decode any message we receive. For responses
+// only the header fields are of interest, the whole packet is handed to
+// the waiting query.
+type krpcIncoming struct {
+	KRPCQuery
+	Arguments krpcQueryArgs `bencode:"a"`
+}
+
+// krpcQueryArgs contains the arguments of all query methods we answer.
+// Seq and CAS are nil if they weren't part of the query.
+type krpcQueryArgs struct {
+	NodeID      string             `bencode:"id"`
+	Target      string             `bencode:"target"`
+	InfoHash    string             `bencode:"info_hash"`
+	Port        int                `bencode:"port"`
+	ImpliedPort bool               `bencode:"implied_port"`
+	Token       string             `bencode:"token"`
+	Want        []string           `bencode:"want"`
+	Value       bencode.RawMessage `bencode:"v"`
+	PublicKey   string             `bencode:"k"`
+	Salt        string             `bencode:"salt"`
+	Seq         *int64             `bencode:"seq"`
+	CAS         *int64             `bencode:"cas"`
+	Signature   string             `bencode:"sig"`
+	Seed        bool               `bencode:"seed"`
+	NoSeed      bool               `bencode:"noseed"`
+	Scrape      bool               `bencode:"scrape"`
+}
+
+// storedPeer is a peer that announced itself to us
+type storedPeer struct {
+	peer      peers.Peer
+	seed      bool
+	announced time.Time
+}
+
+// serve reads packets from the connection until the DHT is closed, answering
+// queries and delivering responses to the queries waiting for them.
+func (dht *DHT) serve() {
+	buffer := make([]byte, 65536)
+	for {
+		n, addr, err := dht.conn.ReadFrom(buffer)
+		if err != nil {
+			select {
+			case <-dht.done:
+			default:
+				log.Printf("Reading from DHT connection failed: %v", err)
+			}
+			return
+		}
+		packet := make([]byte, n)
+		copy(packet, buffer[:n])
+		dht.handlePacket(packet, addr)
+	}
+}
+
+func (dht *DHT) handlePacket(packet []byte, addr net.Addr) {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return
+	}
+	msg := krpcIncoming{}
+	err := bencode.Unmarshal(packet, &msg)
+	if err != nil {
+		log.Printf("Dropping malformed KRPC packet from %s: %v", addr, err)
+		return
+	}
+
+	switch msg.MessageType {
+	case "q":
+		if dht.IsReadOnly() {
+			// read-only nodes never answer queries (BEP 43)
+			return
+		}
+		dht.handleQuery(&msg, udpAddr)
+	case "r", "e":
+		dht.mu.Lock()
+		pending, ok := dht.pending[msg.TransactionID]
+		dht.mu.Unlock()
+		if !ok || !sameAddress(pending.address, udpAddr) {
+			log.Printf("Dropping unexpected KRPC response from %s", addr)
+			return
+		}
+		select {
+		case pending.response <- packet:
+		default:
+			// we already have a response for this transaction
+		}
+	}
+}
+
+func (dht *DHT) handleQuery(query *krpcIncoming, addr *net.UDPAddr) {
+	args := &query.Arguments
+	if len(args.NodeID) != 20 {
+		dht.sendError(query, addr, errProtocol, "invalid node id")
+		return
+	}
+
+	// the querying node is obviously alive, remember it, unless it is
+	// read-only and won't answer our queries
+	node := &Node{
+		ID:         new([20]byte),
+		Address:    addr,
+		LastActive: dht.now(),
+	}
+	copy(node.ID[:], args.NodeID)
+	if *node.ID != *dht.NodeID && !query.ReadOnly {
+		dht.InsertNode(node)
+	}
+
+	var response interface{}
+	switch query.QueryMethod {
+	case "ping":
+		response = KRPCPingQueryArgs{
+			NodeID: string(dht.NodeID[:]),
+		}
+	case "find_node":
+		if len(args.Target) != 20 {
+			dht.sendError(query, addr, errProtocol, "invalid target")
+			return
+		}
+		nodes, nodes6 := dht.closestNodes([]byte(args.Target), args.Want, addr)
+		response = KRPCFindNodeResponseArgs{
+			NodeID: string(dht.NodeID[:]),
+			Nodes:  nodes,
+			Nodes6: nodes6,
+		}
+	case "get_peers":
+		if len(args.InfoHash) != 20 {
+			dht.sendError(query, addr, errProtocol, "invalid info_hash")
+			return
+		}
+		getPeersResponse := KRPCGetPeersResponseArgs{
+			NodeID: string(dht.NodeID[:]),
+			Token:  dht.token(addr),
+		}
+		getPeersResponse.Values = dht.storedPeers([]byte(args.InfoHash), args.Want, args.NoSeed, addr)
+		if args.Scrape {
+			seeds, downloaders := dht.scrapeFilters([]byte(args.InfoHash))
+			getPeersResponse.SeedFilter = string(seeds[:])
+			getPeersResponse.PeerFilter = string(downloaders[:])
+		}
+		// we always return nodes, even if we have values, so that lookups
+		// can continue to the closest nodes
+		getPeersResponse.Nodes, getPeersResponse.Nodes6 = dht.closestNodes([]byte(args.InfoHash), args.Want, addr)
+		response = getPeersResponse
+	case "announce_peer":
+		if len(args.InfoHash) != 20 {
+			dht.sendError(query, addr, errProtocol, "invalid info_hash")
+			return
+		}
+		if !dht.validToken(args.Token, addr) {
+			dht.sendError(query, addr, errProtocol, "bad token")
+			return
+		}
+		port := args.Port
+		if args.ImpliedPort {
+			port = addr.Port
+		}
+		if port <= 0 || port > 65535 {
+			dht.sendError(query, addr, errProtocol, "invalid port")
+			return
+		}
+		dht.storePeer([]byte(args.InfoHash), peers.Peer{IP: addr.IP, Port: uint16(port)}, args.Seed)
+		response = KRPCPingQueryArgs{
+			NodeID: string(dht.NodeID[:]),
+		}
+	case "sample_infohashes":
+		if len(args.Target) != 20 {
+			dht.sendError(query, addr, errProtocol, "invalid target")
+			return
+		}
+		response = dht.handleSampleInfohashes(query, addr)
+	case "get":
+		if len(args.Target) != 20 {
+			dht.sendError(query, addr, errProtocol, "invalid target")
+			return
+		}
+		response = dht.handleGet(query, addr)
+	case "put":
+		code, message := dht.handlePut(query, addr)
+		if code != 0 {
+			dht.sendError(query, addr, code, message)
+			return
+		}
+		response = KRPCPingQueryArgs{
+			NodeID: string(dht.NodeID[:]),
+		}
+	default:
+		dht.sendError(query, addr, errMethodUnknown, "Method Unknown")
+		return
+	}
+
+	dht.send(KRPCResponse{
+		KRPCMessage: KRPCMessage{
+			TransactionID: query.TransactionID,
+			MessageType:   "r",
+			ClientVersion: clientVersion,
+		},
+		Arguments: response,
+	}, addr)
+}
+
+func (dht *DHT) sendError(query *krpcIncoming, addr net.Addr, code int, message string) {
+	dht.send(KRPCError{
+		KRPCMessage: KRPCMessage{
+			TransactionID: query.TransactionID,
+			MessageType:   "e",
+			ClientVersion: clientVersion,
+		},
+		Error: KRPCErrorArgs{code, message},
+	}, addr)
+}
+
+func (dht *DHT) send(msg interface{}, addr net.Addr) {
+	data, err := KRPCEncode(msg)
+	if err != nil {
+		log.Printf("Encoding KRPC message failed: %v", err)
+		return
+	}
+	_, err = dht.conn.WriteTo(data, addr)
+	if err != nil {
+		log.Printf("Sending KRPC message to %s failed: %v", addr, err)
+	}
+}
+
+// closestNodes returns compact node info for the nodes closest to target,
+// for the address families the querying node wants.
+func (dht *DHT) closestNodes(target []byte, want []string, addr *net.UDPAddr) (nodes, nodes6 string) {
+	wantIPv4, wantIPv6 := wantedFamilies(want, addr)
+
+	dht.mu.Lock()
+	defer dht.mu.Unlock()
+	if wantIPv4 {
+		nodes = encodeNodes(dht.BucketTree.closestNodes(target, maxNodesPerBucket), net.IPv4len)
+	}
+	if wantIPv6 {
+		nodes6 = encodeNodes(dht.BucketTree6.closestNodes(target, maxNodesPerBucket), net.IPv6len)
+	}
+	return nodes, nodes6
+}
+
+// wantedFamilies evaluates the "want" argument of a query (BEP 32). Without it,
+// nodes of the same address family as the querying node are returned.
+func wantedFamilies(want []string, addr *net.UDPAddr) (wantIPv4, wantIPv6 bool) {
+	if len(want) == 0 {
+		isIPv4 := addr.IP.To4() != nil
+		return isIPv4, !isIPv4
+	}
+	for _, w := range want {
+		switch w {
+		case WantIPv4:
+			wantIPv4 = true
+		case WantIPv6:
+			wantIPv6 = true
+		}
+	}
+	return wantIPv4, wantIPv6
+}
+
+func (dht *DHT) storePeer(infohash []byte, peer peers.Peer, seed bool) {
+	var key [20]byte
+	copy(key[:], infohash)
+
+	dht.mu.Lock()
+	defer dht.mu.Unlock()
+	stored := dht.peerStore[key]
+	if stored == nil {
+		if len(dht.peerStore) >= maxInfohashes {
+			return
+		}
+		stored = make(map[string]storedPeer)
+		dht.peerStore[key] = stored
+	}
+	addr := peer.String()
+	if _, ok := stored[addr]; !ok && len(stored) >= maxPeersPerInfohash {
+		// make room by dropping the peer that announced longest ago
+		var oldest string
+		for a, p := range stored {
+			if oldest == "" || p.announced.Before(stored[oldest].announced) {
+				oldest = a
+			}
+		}
+		delete(stored, oldest)
+	}
+	stored[addr] = storedPeer{
+		peer:      peer,
+		seed:      seed,
+		announced: dht.now(),
+	}
+}
+
+// expirePeers drops the peers that haven't announced for peerLifetime
+func (dht *DHT) expirePeers() {
+	dht.mu.Lock()
+	defer dht.mu.Unlock()
+	now := dht.now()
+	for key, stored := range dht.peerStore {
+		for addr, p := range stored {
+			if now.Sub(p.announced) > peerLifetime {
+				delete(stored, addr)
+			}
+		}
+		if len(stored) == 0 {
+			delete(dht.peerStore, key)
+		}
+	}
+}
+
+// storedPeers returns compact peer info for the peers announced for infohash,
+// for the address families the querying node wants. Seeds are left out if
+// noSeed is set.
+func (dht *DHT) storedPeers(infohash []byte, want []string, noSeed bool, addr *net.UDPAddr) []string {
+	var key [20]byte
+	copy(key[:], infohash)
+	wantIPv4, wantIPv6 := wantedFamilies(want, addr)
+
+	dht.mu.Lock()
+	defer dht.mu.Unlock()
+	var values []string
+	for _, stored := range dht.peerStore[key] {
+		if noSeed && stored.seed {
+			continue
+		}
+		isIPv4 := stored.peer.IP.To4() != nil
+		if (isIPv4 && wantIPv4) || (!isIPv4 && wantIPv6) {
+			values = append(values, string(stored.peer.Marshal()))
+		}
+	}
+	return values
+}
+
+// scrapeFilters returns bloom filters of the IPs of the seeds and downloaders
+// announced for infohash (BEP 33).
+func (dht *DHT) scrapeFilters(infohash []byte) (seeds, downloaders BloomFilter) {
+	var key [20]byte
+	copy(key[:], infohash)
+
+	dht.mu.Lock()
+	defer dht.mu.Unlock()
+	for _, stored := range dht.peerStore[key] {
+		if stored.seed {
+			seeds.Add(stored.peer.IP)
+		} else {
+			downloaders.Add(stored.peer.IP)
+		}
+	}
+	return seeds, downloaders
+}
+
+// token generates the token a node needs to announce to us, tied to its IP.
+func (dht *DHT) token(addr *net.UDPAddr) string {
+	dht.mu.Lock()
+	defer dht.mu.Unlock()
+	dht.rotateSecret()
+	return makeToken(dht.secret, addr)
+}
+
+func (dht *DHT) validToken(token string, addr *net.UDPAddr) bool {
+	dht.mu.Lock()
+	defer dht.mu.Unlock()
+	dht.rotateSecret()
+	return token == makeToken(dht.secret, addr) || token == makeToken(dht.oldSecret, addr)
+}
+
+// rotateSecret replaces the secret once it is older than tokenRotation. If
+// it wasn't replaced for twice that time, the tokens of both secrets have
+// expired. dht.mu must be held.
+func (dht *DHT) rotateSecret() {
+	now := dht.now()
+	elapsed := now.Sub(dht.rotated)
+	if elapsed <= tokenRotation {
+		return
+	}
+	if elapsed > 2*tokenRotation {
+		rand.Read(dht.oldSecret[:])
+	} else {
+		dht.oldSecret = dht.secret
+	}
+	rand.Read(dht.secret[:])
+	dht.rotated = now
+}
+
+func makeToken(secret [20]byte, addr *net.UDPAddr) string {
+	hash := sha1.New()
+	hash.Write(secret[:])
+	hash.Write(addr.IP.To16())
+	return string(hash.Sum(nil)[:8])
+}
+
+// sameAddress returns true if both addresses refer to the same IP and port.
+func sameAddress(a, b *net.UDPAddr) bool {
+	return a != nil && b != nil && a.IP.Equal(b.IP) && a.Port == b.Port
+}
@@ -0,0 +1,229 @@
+// Package simnet provides an in-memory UDP network and a manually advanced
+// clock, so that many DHT nodes can be tested together without touching the
+// real network or waiting for timeouts.
+package simnet
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// queueLength is the number of packets a Conn buffers before dropping new ones
+const queueLength = 1024
+
+// ErrClosed is returned when reading from a closed Conn
+var ErrClosed = errors.New("simnet: use of closed connection")
+
+type packet struct {
+	data []byte
+	from *net.UDPAddr
+}
+
+// Network delivers packets between the Conns created from it
+type Network struct {
+	mu      sync.Mutex
+	conns   map[string]*Conn
+	down    map[string]bool
+	next    uint32 // used to assign addresses
+	packets int    // number of packets delivered
+}
+
+// Conn is an in-memory net.PacketConn
+type Conn struct {
+	network   *Network
+	addr      *net.UDPAddr
+	incoming  chan packet
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewNetwork creates an empty network
+func NewNetwork() *Network {
+	return &Network{
+		conns: make(map[string]*Conn),
+		down:  make(map[string]bool),
+	}
+}
+
+// Listen creates a Conn with a new IPv4 address in 10.0.0.0/8
+func (n *Network) Listen() *Conn {
+	n.mu.Lock()
+	n.next++
+	ip := net.IP{10, byte(n.next >> 16), byte(n.next >> 8), byte(n.next)}
+	n.mu.Unlock()
+	return n.listen(&net.UDPAddr{IP: ip, Port: 6881})
+}
+
+// Listen6 creates a Conn with a new IPv6 address in fd00::/8
+func (n *Network) Listen6() *Conn {
+	n.mu.Lock()
+	n.next++
+	ip := net.ParseIP("fd00::")
+	ip[13], ip[14], ip[15] = byte(n.next>>16), byte(n.next>>8), byte(n.next)
+	n.mu.Unlock()
+	return n.listen(&net.UDPAddr{IP: ip, Port: 6881})
+}
+
+func (n *Network) listen(addr *net.UDPAddr) *Conn {
+	conn := &Conn{
+		network:  n,
+		addr:     addr,
+		incoming: make(chan packet, queueLength),
+		closed:   make(chan struct{}),
+	}
+	n.mu.Lock()
+	n.conns[addr.String()] = conn
+	n.mu.Unlock()
+	return conn
+}
+
+// SetDown simulates the host at addr going offline (or coming back). Packets
+// sent to or from a host that is down are dropped.
+func (n *Network) SetDown(addr net.Addr, down bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.down[addr.String()] = down
+}
+
+// Packets returns the number of packets delivered so far
+func (n *Network) Packets() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.packets
+}
+
+func (n *Network) deliver(data []byte, from *net.UDPAddr, to net.Addr) {
+	n.mu.Lock()
+	dest, ok := n.conns[to.String()]
+	if !ok || n.down[to.String()] || n.down[from.String()] {
+		n.mu.Unlock()
+		return
+	}
+	n.packets++
+	n.mu.Unlock()
+
+	p := packet{
+		data: append([]byte{}, data...),
+		from: from,
+	}
+	select {
+	case dest.incoming <- p:
+	case <-dest.closed:
+	default:
+		// queue is full, drop the packet just like UDP would
+	}
+}
+
+// ReadFrom implements net.PacketConn
+func (c *Conn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case p := <-c.incoming:
+		return copy(b, p.data), p.from, nil
+	case <-c.closed:
+		return 0, nil, ErrClosed
+	}
+}
+
+// WriteTo implements net.PacketConn. Packets to unknown addresses are silently dropped.
+func (c *Conn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, ErrClosed
+	default:
+	}
+	c.network.deliver(b, c.addr, addr)
+	return len(b), nil
+}
+
+// Close implements net.PacketConn
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.network.mu.Lock()
+		delete(c.network.conns, c.addr.String())
+		c.network.mu.Unlock()
+	})
+	return nil
+}
+
+// LocalAddr implements net.PacketConn
+func (c *Conn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+// SetDeadline is not supported and does nothing
+func (c *Conn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+// SetReadDeadline is not supported and does nothing
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+// SetWriteDeadline is not supported and does nothing
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// Clock is a clock that only moves when Advance is called
+type Clock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []waiter
+}
+
+type waiter struct {
+	deadline time.Time
+	ch       chan time.Time
+}
+
+// NewClock creates a clock set to the given time
+func NewClock(now time.Time) *Clock {
+	return &Clock{
+		now: now,
+	}
+}
+
+// Now returns the current time of the clock
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// After returns a channel that receives the time once the clock has been
+// advanced by at least d.
+func (c *Clock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, waiter{
+		deadline: c.now.Add(d),
+		ch:       ch,
+	})
+	return ch
+}
+
+// Advance moves the clock forward, firing all channels returned by After
+// whose time has come.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	remaining := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.deadline.After(c.now) {
+			remaining = append(remaining, w)
+		} else {
+			w.ch <- c.now
+		}
+	}
+	c.waiters = remaining
+}
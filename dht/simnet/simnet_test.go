@@ -0,0 +1,58 @@
+package simnet
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeliver(t *testing.T) {
+	network := NewNetwork()
+	a := network.Listen()
+	b := network.Listen6()
+	assert.NotEqual(t, a.LocalAddr().String(), b.LocalAddr().String())
+
+	_, err := a.WriteTo([]byte("hello"), b.LocalAddr())
+	require.Nil(t, err)
+	buf := make([]byte, 100)
+	n, from, err := b.ReadFrom(buf)
+	require.Nil(t, err)
+	assert.Equal(t, "hello", string(buf[:n]))
+	assert.Equal(t, a.LocalAddr(), from)
+	assert.Equal(t, 1, network.Packets())
+
+	// packets to hosts that are down are dropped
+	network.SetDown(b.LocalAddr(), true)
+	_, err = a.WriteTo([]byte("dropped"), b.LocalAddr())
+	require.Nil(t, err)
+	network.SetDown(b.LocalAddr(), false)
+	_, err = a.WriteTo([]byte("again"), b.LocalAddr())
+	require.Nil(t, err)
+	n, _, err = b.ReadFrom(buf)
+	require.Nil(t, err)
+	assert.Equal(t, "again", string(buf[:n]))
+
+	b.Close()
+	_, _, err = b.ReadFrom(buf)
+	assert.Equal(t, ErrClosed, err)
+}
+
+func TestClock(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewClock(start)
+	assert.Equal(t, start, clock.Now())
+
+	short := clock.After(time.Second)
+	long := clock.After(time.Minute)
+	clock.Advance(2 * time.Second)
+	assert.Equal(t, start.Add(2*time.Second), <-short)
+	select {
+	case <-long:
+		t.Error("long timer fired too early")
+	default:
+	}
+	clock.Advance(time.Minute)
+	assert.Equal(t, start.Add(62*time.Second), <-long)
+}
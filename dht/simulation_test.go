@@ -0,0 +1,311 @@
+package dht
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/sjaensch/storrent/dht/simnet"
+	"github.com/sjaensch/storrent/peers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// simulation is a network of DHT nodes exchanging KRPC packets in memory
+type simulation struct {
+	network *simnet.Network
+	clock   *simnet.Clock
+	nodes   []*DHT
+}
+
+// newSimulation creates count nodes with deterministic node IDs. Every node
+// bootstraps from the first one. Call close when done.
+func newSimulation(t *testing.T, count int, ipv6 bool) *simulation {
+	// hundreds of nodes produce a lot of log output
+	log.SetOutput(ioutil.Discard)
+
+	s := &simulation{
+		network: simnet.NewNetwork(),
+		clock:   simnet.NewClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)),
+	}
+	rng := rand.New(rand.NewSource(int64(count)))
+	for i := 0; i < count; i++ {
+		var conn *simnet.Conn
+		if ipv6 {
+			conn = s.network.Listen6()
+		} else {
+			conn = s.network.Listen()
+		}
+		var id [20]byte
+		rng.Read(id[:])
+		dht := newWithID(conn, s.clock, id)
+		s.nodes = append(s.nodes, dht)
+
+		if i > 0 {
+			err := dht.Bootstrap(context.Background(), []*net.UDPAddr{s.address(0)}, nil)
+			require.Nil(t, err)
+		}
+	}
+	return s
+}
+
+// close shuts down all nodes
+func (s *simulation) close() {
+	for _, dht := range s.nodes {
+		dht.Close()
+	}
+	log.SetOutput(os.Stderr)
+}
+
+func (s *simulation) address(i int) *net.UDPAddr {
+	return s.nodes[i].conn.LocalAddr().(*net.UDPAddr)
+}
+
+// closestIDs returns the IDs of all nodes, sorted by their distance to target
+func (s *simulation) closestIDs(target []byte) [][20]byte {
+	IDs := make([][20]byte, len(s.nodes))
+	for i, dht := range s.nodes {
+		IDs[i] = *dht.NodeID
+	}
+	sort.Slice(IDs, func(i, j int) bool {
+		return closer(IDs[i][:], IDs[j][:], target)
+	})
+	return IDs
+}
+
+// runWithTimeouts runs fn while advancing the clock whenever no packets have
+// been exchanged for a while, so that queries to unreachable nodes time out.
+func (s *simulation) runWithTimeouts(fn func()) {
+	done := make(chan struct{})
+	go func() {
+		fn()
+		close(done)
+	}()
+	packets := s.network.Packets()
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(20 * time.Millisecond):
+			if current := s.network.Packets(); current != packets {
+				packets = current
+				continue
+			}
+			s.clock.Advance(queryTimeout)
+		}
+	}
+}
+
+func TestSimulatedLookup(t *testing.T) {
+	for _, ipv6 := range []bool{false, true} {
+		s := newSimulation(t, 200, ipv6)
+		defer s.close()
+		rng := rand.New(rand.NewSource(42))
+
+		for i := 0; i < 10; i++ {
+			target := make([]byte, 20)
+			rng.Read(target)
+			searcher := s.nodes[rng.Intn(len(s.nodes))]
+
+			closest := searcher.lookup(context.Background(), target, searcher.findNodeQuery(context.Background(), target))
+			require.Len(t, closest, maxNodesPerBucket)
+			expected := s.closestIDs(target)
+			if expected[0] == *searcher.NodeID {
+				// the searcher doesn't find itself
+				expected = expected[1:]
+			}
+			assert.Equal(t, expected[0], *closest[0].ID)
+		}
+	}
+}
+
+func TestSimulatedAnnounceAndGetPeers(t *testing.T) {
+	s := newSimulation(t, 100, false)
+	defer s.close()
+	infohash := []byte("aaaaaaaaaaaaaaaaaaaa")
+
+	for i := 0; i < 5; i++ {
+		announced, err := s.nodes[i*10].Announce(context.Background(), infohash, 6881, i%2 == 0)
+		require.Nil(t, err)
+		assert.Equal(t, maxNodesPerBucket, announced)
+	}
+
+	found, err := s.nodes[99].LookupPeers(context.Background(), infohash)
+	require.Nil(t, err)
+	assert.Len(t, found, 5)
+
+	seeders, leechers, err := s.nodes[98].Scrape(context.Background(), infohash)
+	require.Nil(t, err)
+	assert.Equal(t, 3, seeders)
+	assert.Equal(t, 2, leechers)
+}
+
+func TestSimulatedRefresh(t *testing.T) {
+	s := newSimulation(t, 50, false)
+	defer s.close()
+	dht := s.nodes[0]
+
+	known := dht.knownNodes()
+	require.True(t, len(known) > 1)
+	gone := known[0]
+	s.network.SetDown(gone.Address, true)
+
+	// after some idle time all nodes are questionable and have to be pinged
+	s.clock.Advance(activePeriod + time.Minute)
+	s.runWithTimeouts(func() { dht.Refresh(context.Background()) })
+
+	remaining := dht.knownNodes()
+	for _, node := range remaining {
+		assert.NotEqual(t, gone.ID, node.ID)
+		assert.True(t, node.isGood(s.clock.Now()))
+	}
+	assert.True(t, len(remaining) >= len(known)-1)
+
+	// all buckets were refreshed
+	assert.Empty(t, dht.bucketTargets(s.clock.Now().Add(-refreshInterval)))
+}
+
+func TestSimulatedTokenExpiry(t *testing.T) {
+	s := newSimulation(t, 2, false)
+	defer s.close()
+	server := &Node{ID: s.nodes[0].NodeID, Address: s.address(0)}
+	client := s.nodes[1]
+	infohash := []byte("aaaaaaaaaaaaaaaaaaaa")
+
+	_, _, token, err := client.GetPeers(context.Background(), server, infohash)
+	require.Nil(t, err)
+
+	// tokens survive one rotation of the secret...
+	s.clock.Advance(tokenRotation + time.Second)
+	_, _, _, err = client.GetPeers(context.Background(), server, infohash)
+	require.Nil(t, err)
+	require.Nil(t, client.AnnouncePeer(context.Background(), server, infohash, 6881, token, false))
+
+	// ...but not two
+	s.clock.Advance(tokenRotation + time.Second)
+	_, _, _, err = client.GetPeers(context.Background(), server, infohash)
+	require.Nil(t, err)
+	assert.NotNil(t, client.AnnouncePeer(context.Background(), server, infohash, 6881, token, false))
+}
+
+func TestSimulatedTokenExpiryWithoutQueries(t *testing.T) {
+	s := newSimulation(t, 2, false)
+	defer s.close()
+	server := &Node{ID: s.nodes[0].NodeID, Address: s.address(0)}
+	client := s.nodes[1]
+	infohash := []byte("aaaaaaaaaaaaaaaaaaaa")
+
+	_, _, token, err := client.GetPeers(context.Background(), server, infohash)
+	require.Nil(t, err)
+
+	// tokens expire even if the server hands out no new ones
+	s.clock.Advance(tokenRotation + time.Second)
+	require.Nil(t, client.AnnouncePeer(context.Background(), server, infohash, 6881, token, false))
+	s.clock.Advance(2*tokenRotation + time.Second)
+	assert.NotNil(t, client.AnnouncePeer(context.Background(), server, infohash, 6881, token, false))
+}
+
+func TestSimulatedPeerExpiry(t *testing.T) {
+	s := newSimulation(t, 2, false)
+	defer s.close()
+	dht := s.nodes[0]
+	infohash := []byte("aaaaaaaaaaaaaaaaaaaa")
+	dht.storePeer(infohash, peers.Peer{IP: net.IP{192, 0, 2, 1}, Port: 6881}, false)
+
+	s.clock.Advance(peerLifetime / 2)
+	dht.storePeer(infohash, peers.Peer{IP: net.IP{192, 0, 2, 2}, Port: 6881}, false)
+
+	// only the peer that didn't announce again in time is dropped
+	s.clock.Advance(peerLifetime/2 + time.Second)
+	dht.expirePeers()
+	values := dht.storedPeers(infohash, nil, false, s.address(1))
+	assert.Equal(t, []string{string(peers.Peer{IP: net.IP{192, 0, 2, 2}, Port: 6881}.Marshal())}, values)
+
+	s.clock.Advance(peerLifetime / 2)
+	dht.expirePeers()
+	assert.Empty(t, dht.peerStore)
+}
+
+func TestSimulatedPeerLimits(t *testing.T) {
+	s := newSimulation(t, 1, false)
+	defer s.close()
+	dht := s.nodes[0]
+
+	// the peer that announced longest ago makes room for a new one
+	infohash := []byte("aaaaaaaaaaaaaaaaaaaa")
+	for i := 0; i <= maxPeersPerInfohash; i++ {
+		dht.storePeer(infohash, peers.Peer{IP: net.IP{10, 0, byte(i >> 8), byte(i)}, Port: 6881}, false)
+		s.clock.Advance(time.Millisecond)
+	}
+	var key [20]byte
+	copy(key[:], infohash)
+	assert.Len(t, dht.peerStore[key], maxPeersPerInfohash)
+	assert.NotContains(t, dht.peerStore[key], "10.0.0.0:6881")
+
+	// new infohashes are refused once the store is full
+	for i := 1; i <= maxInfohashes; i++ {
+		dht.storePeer([]byte{byte(i >> 8), byte(i), 19: 1}, peers.Peer{IP: net.IP{192, 0, 2, 1}, Port: 6881}, false)
+	}
+	assert.Len(t, dht.peerStore, maxInfohashes)
+	assert.Contains(t, dht.peerStore, key)
+}
+
+func TestSimulatedItemExpiry(t *testing.T) {
+	s := newSimulation(t, 2, false)
+	defer s.close()
+	server := &Node{ID: s.nodes[0].NodeID, Address: s.address(0)}
+	client := s.nodes[1]
+
+	item, err := NewImmutableItem("value")
+	require.Nil(t, err)
+	target, err := item.Target()
+	require.Nil(t, err)
+	_, _, token, err := client.GetImmutable(context.Background(), server, target[:])
+	require.Nil(t, err)
+	require.Nil(t, client.Put(context.Background(), server, token, item))
+
+	s.clock.Advance(itemLifetime + time.Second)
+	s.nodes[0].expireItems()
+	s.nodes[0].mu.Lock()
+	defer s.nodes[0].mu.Unlock()
+	assert.Empty(t, s.nodes[0].items)
+}
+
+func TestSimulatedReadOnly(t *testing.T) {
+	s := newSimulation(t, 50, false)
+	defer s.close()
+	readOnly := NewWithClock(s.network.Listen(), s.clock)
+	defer readOnly.Close()
+	readOnly.SetReadOnly(true)
+
+	require.Nil(t, readOnly.Bootstrap(context.Background(), []*net.UDPAddr{s.address(0)}, nil))
+	assert.NotEmpty(t, readOnly.knownNodes())
+
+	// lookups and announces work...
+	infohash := []byte("aaaaaaaaaaaaaaaaaaaa")
+	_, err := readOnly.Announce(context.Background(), infohash, 6881, false)
+	require.Nil(t, err)
+	found, err := s.nodes[10].LookupPeers(context.Background(), infohash)
+	require.Nil(t, err)
+	assert.Len(t, found, 1)
+
+	// ...but no other node added the read-only node to its routing table
+	for _, dht := range s.nodes {
+		for _, node := range dht.knownNodes() {
+			assert.NotEqual(t, *readOnly.NodeID, *node.ID)
+		}
+	}
+
+	// and it doesn't answer queries
+	readOnlyNode := &Node{ID: readOnly.NodeID, Address: readOnly.conn.LocalAddr().(*net.UDPAddr)}
+	s.runWithTimeouts(func() {
+		_, err = s.nodes[0].Ping(context.Background(), readOnlyNode)
+	})
+	assert.NotNil(t, err)
+}
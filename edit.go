@@ -0,0 +1,124 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sjaensch/storrent/torrentfile"
+)
+
+func edit(args []string) {
+	flags := flag.NewFlagSet("edit", flag.ExitOnError)
+	var trackers, addTrackers, webSeeds, addWebSeeds stringList
+	flags.Var(&trackers, "a", "replace the trackers with this announce URL, can be given multiple times. Separate URLs with commas to put them in the same tier")
+	flags.Var(&addTrackers, "add-tracker", "add a tier of comma separated announce URLs, can be given multiple times")
+	noTrackers := flags.Bool("no-trackers", false, "remove all trackers")
+	flags.Var(&webSeeds, "w", "replace the web seeds with this URL, can be given multiple times")
+	flags.Var(&addWebSeeds, "add-web-seed", "add a web seed URL, can be given multiple times")
+	noWebSeeds := flags.Bool("no-web-seeds", false, "remove all web seeds")
+	comment := flags.String("c", "", "comment, removed if empty")
+	createdBy := flags.String("created-by", "", "created by, removed if empty")
+	outPath := flags.String("o", "", "output file (default: overwrite the torrent file)")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: storrent edit [options] <torrent file>\n\n")
+		fmt.Fprintf(flags.Output(), "The info dictionary is left untouched, so the info hash stays the same.\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	inPath := flags.Arg(0)
+	if *outPath == "" {
+		*outPath = inPath
+	}
+
+	tf, err := torrentfile.Open(inPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var opts torrentfile.EditOptions
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "c":
+			opts.Comment = comment
+		case "created-by":
+			opts.CreatedBy = createdBy
+		}
+	})
+
+	if len(trackers) > 0 || len(addTrackers) > 0 || *noTrackers {
+		var tiers []string
+		if len(trackers) == 0 && !*noTrackers {
+			tiers = currentTiers(&tf)
+		}
+		tiers = append(tiers, trackers...)
+		tiers = append(tiers, addTrackers...)
+		announce, announceList := trackerTiers(tiers)
+		opts.Announce = &announce
+		opts.AnnounceList = &announceList
+	}
+	if len(webSeeds) > 0 || len(addWebSeeds) > 0 || *noWebSeeds {
+		var seeds []string
+		if len(webSeeds) == 0 && !*noWebSeeds {
+			seeds = tf.WebSeeds
+		}
+		seeds = append(seeds, webSeeds...)
+		seeds = append(seeds, addWebSeeds...)
+		opts.WebSeeds = &seeds
+	}
+
+	err = writeEdited(inPath, *outPath, opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Wrote %s, info hash %x\n", *outPath, tf.InfoHash)
+}
+
+// currentTiers returns the trackers of the torrent in the format of -a flags
+func currentTiers(tf *torrentfile.TorrentFile) []string {
+	var tiers []string
+	for _, tier := range tf.AnnounceList {
+		tiers = append(tiers, strings.Join(tier, ","))
+	}
+	if len(tiers) == 0 && tf.Announce != "" {
+		tiers = append(tiers, tf.Announce)
+	}
+	return tiers
+}
+
+// writeEdited writes the edited torrent to a temporary file next to outPath
+// first, so that inPath can be overwritten without losing it on errors
+func writeEdited(inPath, outPath string, opts torrentfile.EditOptions) error {
+	in, err := os.Open(inPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := ioutil.TempFile(filepath.Dir(outPath), ".storrent-edit")
+	if err != nil {
+		return err
+	}
+	err = torrentfile.Edit(in, opts, out)
+	if err == nil {
+		err = out.Chmod(0644)
+	}
+	if err == nil {
+		err = out.Close()
+	}
+	if err == nil {
+		err = os.Rename(out.Name(), outPath)
+	}
+	if err != nil {
+		out.Close()
+		os.Remove(out.Name())
+	}
+	return err
+}
@@ -2,7 +2,4 @@ module github.com/sjaensch/storrent
 
 go 1.14
 
-require (
-	github.com/jackpal/bencode-go v0.0.0-20180813173944-227668e840fa
-	github.com/stretchr/testify v1.5.1
-)
+require github.com/stretchr/testify v1.5.1
@@ -8,10 +8,18 @@ import (
 // A Handshake is a special message that a peer uses to identify itself
 type Handshake struct {
 	Pstr     string
+	Reserved [8]byte // bits announcing protocol extensions
 	InfoHash [20]byte
 	PeerID   [20]byte
 }
 
+// extensionBit is the bit in the sixth reserved byte signalling support
+// for the extension protocol (BEP 10)
+const extensionBit = 0x10
+
+// v2Bit is the bit in the last reserved byte signalling support for v2 torrents (BEP 52)
+const v2Bit = 0x10
+
 // New creates a new handshake with the standard pstr
 func New(infoHash, peerID [20]byte) *Handshake {
 	return &Handshake{
@@ -27,7 +35,7 @@ func (h *Handshake) Serialize() []byte {
 	buf[0] = byte(len(h.Pstr))
 	curr := 1
 	curr += copy(buf[curr:], h.Pstr)
-	curr += copy(buf[curr:], make([]byte, 8)) // 8 reserved bytes
+	curr += copy(buf[curr:], h.Reserved[:])
 	curr += copy(buf[curr:], h.InfoHash[:])
 	curr += copy(buf[curr:], h.PeerID[:])
 	return buf
@@ -53,16 +61,40 @@ func Read(r io.Reader) (*Handshake, error) {
 		return nil, err
 	}
 
+	var reserved [8]byte
 	var infoHash, peerID [20]byte
 
+	copy(reserved[:], handshakeBuf[pstrlen:pstrlen+8])
 	copy(infoHash[:], handshakeBuf[pstrlen+8:pstrlen+8+20])
 	copy(peerID[:], handshakeBuf[pstrlen+8+20:])
 
 	h := Handshake{
 		Pstr:     string(handshakeBuf[0:pstrlen]),
+		Reserved: reserved,
 		InfoHash: infoHash,
 		PeerID:   peerID,
 	}
 
 	return &h, nil
 }
+
+// SetV2 announces support for v2 torrents
+func (h *Handshake) SetV2() {
+	h.Reserved[7] |= v2Bit
+}
+
+// SupportsV2 tells if the sender of the handshake supports v2 torrents
+func (h *Handshake) SupportsV2() bool {
+	return h.Reserved[7]&v2Bit != 0
+}
+
+// SetExtensionProtocol announces support for the extension protocol
+func (h *Handshake) SetExtensionProtocol() {
+	h.Reserved[5] |= extensionBit
+}
+
+// SupportsExtensionProtocol tells if the sender of the handshake supports
+// the extension protocol
+func (h *Handshake) SupportsExtensionProtocol() bool {
+	return h.Reserved[5]&extensionBit != 0
+}
@@ -73,6 +73,16 @@ func TestRead(t *testing.T) {
 			output: nil,
 			fails:  true,
 		},
+		"reserved bits are kept": {
+			input: []byte{19, 66, 105, 116, 84, 111, 114, 114, 101, 110, 116, 32, 112, 114, 111, 116, 111, 99, 111, 108, 0, 0, 0, 0, 0, 0x10, 0, 0x10, 134, 212, 200, 0, 36, 164, 105, 190, 76, 80, 188, 90, 16, 44, 247, 23, 128, 49, 0, 116, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20},
+			output: &Handshake{
+				Pstr:     "BitTorrent protocol",
+				Reserved: [8]byte{0, 0, 0, 0, 0, 0x10, 0, 0x10},
+				InfoHash: [20]byte{134, 212, 200, 0, 36, 164, 105, 190, 76, 80, 188, 90, 16, 44, 247, 23, 128, 49, 0, 116},
+				PeerID:   [20]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20},
+			},
+			fails: false,
+		},
 		"pstrlen is 0": {
 			input:  []byte{0, 0, 0},
 			output: nil,
@@ -91,3 +101,21 @@ func TestRead(t *testing.T) {
 		assert.Equal(t, test.output, m)
 	}
 }
+
+func TestV2(t *testing.T) {
+	h := New([20]byte{}, [20]byte{})
+	assert.False(t, h.SupportsV2())
+	h.SetV2()
+	assert.True(t, h.SupportsV2())
+	buf := h.Serialize()
+	assert.Equal(t, []byte{0, 0, 0, 0, 0, 0, 0, 0x10}, buf[20:28])
+}
+
+func TestExtensionProtocol(t *testing.T) {
+	h := New([20]byte{}, [20]byte{})
+	assert.False(t, h.SupportsExtensionProtocol())
+	h.SetExtensionProtocol()
+	assert.True(t, h.SupportsExtensionProtocol())
+	buf := h.Serialize()
+	assert.Equal(t, []byte{0, 0, 0, 0, 0, 0x10, 0, 0}, buf[20:28])
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sjaensch/storrent/torrentfile"
+)
+
+// torrentInfo is what the info command prints, as JSON with -json
+type torrentInfo struct {
+	Name        string     `json:"name"`
+	InfoHash    string     `json:"info_hash,omitempty"`
+	InfoHashV2  string     `json:"info_hash_v2,omitempty"`
+	PieceLength int        `json:"piece_length,omitempty"`
+	Pieces      int        `json:"pieces,omitempty"`
+	Length      int        `json:"length,omitempty"`
+	Private     bool       `json:"private"`
+	Source      string     `json:"source,omitempty"`
+	Trackers    [][]string `json:"trackers"`
+	WebSeeds    []string   `json:"web_seeds"`
+	HTTPSeeds   []string   `json:"http_seeds,omitempty"`
+	Peers       []string   `json:"peers,omitempty"`
+	Files       []fileInfo `json:"files"`
+	HasMetadata bool       `json:"has_metadata"` // false for magnet links
+}
+
+type fileInfo struct {
+	Index   int      `json:"index"`
+	Path    []string `json:"path"` // starting with the name of the torrent
+	Length  int      `json:"length"`
+	Attr    string   `json:"attr,omitempty"`
+	Symlink []string `json:"symlink,omitempty"`
+}
+
+func info(args []string) {
+	flags := flag.NewFlagSet("info", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "print JSON instead of text")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: storrent info [options] <torrent file or magnet link>\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	var ti torrentInfo
+	if strings.HasPrefix(flags.Arg(0), "magnet:") {
+		m, err := torrentfile.ParseMagnet(flags.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+		ti = magnetInfo(m)
+	} else {
+		tf, err := torrentfile.Open(flags.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+		ti = newTorrentInfo(&tf)
+	}
+
+	if *asJSON {
+		// lists are never null, to make scripting easier
+		if ti.Trackers == nil {
+			ti.Trackers = [][]string{}
+		}
+		if ti.WebSeeds == nil {
+			ti.WebSeeds = []string{}
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err := encoder.Encode(ti)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	ti.print(os.Stdout)
+}
+
+func newTorrentInfo(tf *torrentfile.TorrentFile) torrentInfo {
+	ti := torrentInfo{
+		Name:        tf.Name,
+		InfoHash:    hex.EncodeToString(tf.InfoHash[:]),
+		PieceLength: tf.PieceLength,
+		Pieces:      tf.NumPieces(),
+		Length:      tf.Length,
+		Private:     tf.Private,
+		Source:      tf.Source,
+		Trackers:    tf.AnnounceList,
+		WebSeeds:    tf.WebSeeds,
+		HTTPSeeds:   tf.HTTPSeeds,
+		Files:       []fileInfo{},
+		HasMetadata: true,
+	}
+	if tf.IsV2() {
+		ti.InfoHashV2 = hex.EncodeToString(tf.InfoHashV2[:])
+		if !tf.IsHybrid() {
+			// the v1 hash is just the truncated v2 hash
+			ti.InfoHash = ""
+		}
+	}
+	if len(ti.Trackers) == 0 && tf.Announce != "" {
+		ti.Trackers = [][]string{{tf.Announce}}
+	}
+	if !tf.IsMultiFile() {
+		ti.Files = append(ti.Files, fileInfo{Path: []string{tf.Name}, Length: tf.Length})
+	}
+	for i, entry := range tf.Entries {
+		if entry.Path == "" {
+			continue // the file of a single-file v2 torrent, already added
+		}
+		path := append(strings.Split(filepath.ToSlash(entry.Path), "/"), entry.Name)
+		ti.Files = append(ti.Files, fileInfo{
+			Index:   i,
+			Path:    path,
+			Length:  entry.Length,
+			Attr:    entry.Attr,
+			Symlink: entry.Symlink,
+		})
+	}
+	return ti
+}
+
+func magnetInfo(m torrentfile.Magnet) torrentInfo {
+	ti := torrentInfo{
+		Name:     m.Name,
+		WebSeeds: m.WebSeeds,
+		Peers:    m.Peers,
+		Files:    []fileInfo{},
+	}
+	if m.InfoHashV2 != [32]byte{} {
+		ti.InfoHashV2 = hex.EncodeToString(m.InfoHashV2[:])
+	}
+	if m.InfoHash != [20]byte{} {
+		ti.InfoHash = hex.EncodeToString(m.InfoHash[:])
+	}
+	for _, tracker := range m.Trackers {
+		// trackers of a magnet link are tried one after the other
+		ti.Trackers = append(ti.Trackers, []string{tracker})
+	}
+	return ti
+}
+
+func (ti *torrentInfo) print(w io.Writer) {
+	fmt.Fprintf(w, "Name:          %s\n", ti.Name)
+	if ti.InfoHash != "" {
+		fmt.Fprintf(w, "Info hash:     %s\n", ti.InfoHash)
+	}
+	if ti.InfoHashV2 != "" {
+		fmt.Fprintf(w, "Info hash v2:  %s\n", ti.InfoHashV2)
+	}
+	if !ti.HasMetadata {
+		fmt.Fprintf(w, "Metadata:      not available, it has to be fetched from peers\n")
+	} else {
+		fmt.Fprintf(w, "Piece length:  %s\n", formatSize(ti.PieceLength))
+		fmt.Fprintf(w, "Pieces:        %d\n", ti.Pieces)
+		fmt.Fprintf(w, "Total size:    %s (%d bytes)\n", formatSize(ti.Length), ti.Length)
+		fmt.Fprintf(w, "Private:       %s\n", yesNo(ti.Private))
+	}
+	if ti.Source != "" {
+		fmt.Fprintf(w, "Source:        %s\n", ti.Source)
+	}
+	if len(ti.Trackers) > 0 {
+		fmt.Fprintf(w, "Trackers:\n")
+		for i, tier := range ti.Trackers {
+			fmt.Fprintf(w, "  tier %d: %s\n", i, strings.Join(tier, ", "))
+		}
+	}
+	printList(w, "Web seeds", ti.WebSeeds)
+	printList(w, "HTTP seeds", ti.HTTPSeeds)
+	printList(w, "Peers", ti.Peers)
+	if len(ti.Files) > 0 {
+		fmt.Fprintf(w, "Files:\n")
+		printFileTree(w, ti.Files)
+	}
+}
+
+func printList(w io.Writer, title string, items []string) {
+	if len(items) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "%s:\n", title)
+	for _, item := range items {
+		fmt.Fprintf(w, "  %s\n", item)
+	}
+}
+
+// printFileTree prints the files indented by directory. Directories are
+// printed when they change from one file to the next, files are followed
+// by their index, which is used to select files for download. Padding
+// files are left out.
+func printFileTree(w io.Writer, files []fileInfo) {
+	var dir []string
+	for _, file := range files {
+		if strings.Contains(file.Attr, "p") {
+			continue
+		}
+		fileDir := file.Path[:len(file.Path)-1]
+		common := 0
+		for common < len(dir) && common < len(fileDir) && dir[common] == fileDir[common] {
+			common++
+		}
+		for i := common; i < len(fileDir); i++ {
+			fmt.Fprintf(w, "  %s%s/\n", strings.Repeat("  ", i), fileDir[i])
+		}
+		dir = fileDir
+
+		var details []string
+		details = append(details, formatSize(file.Length))
+		if strings.Contains(file.Attr, "x") {
+			details = append(details, "executable")
+		}
+		if strings.Contains(file.Attr, "h") {
+			details = append(details, "hidden")
+		}
+		if strings.Contains(file.Attr, "l") {
+			details = append(details, "-> "+strings.Join(file.Symlink, "/"))
+		}
+		fmt.Fprintf(w, "  %s%s (%s) [%d]\n", strings.Repeat("  ", len(fileDir)), file.Path[len(file.Path)-1], strings.Join(details, ", "), file.Index)
+	}
+}
+
+// formatSize formats a number of bytes with a binary unit
+func formatSize(n int) string {
+	units := []string{"bytes", "KiB", "MiB", "GiB", "TiB"}
+	size := float64(n)
+	unit := 0
+	for size >= 1024 && unit < len(units)-1 {
+		size /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d bytes", n)
+	}
+	return fmt.Sprintf("%.1f %s", size, units[unit])
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
@@ -1,34 +1,192 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 
 	"github.com/sjaensch/storrent/dht"
+	"github.com/sjaensch/storrent/p2p"
+	"github.com/sjaensch/storrent/ratelimit"
 	"github.com/sjaensch/storrent/torrentfile"
 )
 
+const usage = `usage:
+  storrent <torrent file> <save path>
+  storrent download [options] <torrent file> <save path>
+  storrent create [options] <file or directory>
+  storrent edit [options] <torrent file>
+  storrent info [-json] <torrent file or magnet link>
+  storrent verify <torrent file> <path>
+`
+
 func main() {
-	if len(os.Args) != 3 {
-		log.Fatal("expected two arguments: torrent file and save path")
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	switch os.Args[1] {
+	case "download":
+		download(os.Args[2:])
+	case "create":
+		create(os.Args[2:])
+	case "edit":
+		edit(os.Args[2:])
+	case "info":
+		info(os.Args[2:])
+	case "verify":
+		verify(os.Args[2:])
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(os.Stdout, usage)
+	default:
+		download(os.Args[1:])
+	}
+}
+
+func download(args []string) {
+	flags := flag.NewFlagSet("download", flag.ExitOnError)
+	var priorityFlags stringList
+	flags.Var(&priorityFlags, "p", "file priority as <index>=<skip|low|normal|high>, can be given multiple times")
+	only := flags.String("only", "", "comma separated indexes of the files to download, all others are skipped")
+	downloadLimit := flags.String("download-limit", "off", "download limit in bytes per second, with an optional K, M or G suffix")
+	uploadLimit := flags.String("upload-limit", "off", "upload limit in bytes per second, with an optional K, M or G suffix")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: storrent download [options] <torrent file> <save path>\n")
+		flags.PrintDefaults()
+		fmt.Fprintf(flags.Output(), "\n%s", commandsHelp)
+	}
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(2)
 	}
 
-	inPath := os.Args[1]
-	outPath := os.Args[2]
+	inPath := flags.Arg(0)
+	outPath := flags.Arg(1)
 
 	tf, err := torrentfile.Open(inPath)
 	if err != nil {
 		log.Fatal(err)
 	}
-
-	dht, err := dht.BootstrapDHT(tf.InfoHash[:])
+	downloadRate, err := ratelimit.ParseRate(*downloadLimit)
+	if err != nil {
+		log.Fatal(err)
+	}
+	uploadRate, err := ratelimit.ParseRate(*uploadLimit)
 	if err != nil {
 		log.Fatal(err)
 	}
-	log.Printf("Got DHT %v", dht)
+	// the global limiters always exist, so that they can be changed at
+	// runtime. They are the parents of the torrent's limiters.
+	globalDownload := ratelimit.New(downloadRate, nil)
+	globalUpload := ratelimit.New(uploadRate, nil)
+	tf.DownloadLimit = ratelimit.New(0, globalDownload)
+	tf.UploadLimit = ratelimit.New(0, globalUpload)
+	tf.Control = p2p.NewControl()
+	go readCommands(os.Stdin, globalDownload, globalUpload, tf.Control)
+	ctx := stopOnSignal()
+
+	if tf.AllowsDHT() {
+		d, err := dht.BootstrapDHT(ctx, tf.InfoHash[:])
+		if ctx.Err() != nil {
+			os.Exit(1)
+		}
+		if err != nil {
+			log.Printf("Bootstrapping the DHT failed, continuing with the tracker's peers: %v", err)
+		} else {
+			defer d.Close()
+			log.Printf("Got DHT %v", d)
+		}
+	} else {
+		log.Printf("Private torrent, not using the DHT")
+	}
 
-	err = tf.DownloadToFile(outPath)
+	if tf.IsMultiFile() {
+		// multi-file torrents are saved into a directory
+		var priorities []p2p.Priority
+		priorities, err = parsePriorities(len(tf.Entries), *only, priorityFlags)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = tf.DownloadFiles(ctx, outPath, priorities)
+	} else {
+		if *only != "" || len(priorityFlags) > 0 {
+			log.Fatal("File priorities require a multi-file torrent")
+		}
+		err = tf.DownloadToFile(ctx, outPath)
+	}
+	if err == context.Canceled {
+		log.Println("Download stopped, run the same command again to resume it")
+		os.Exit(1)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
 }
+
+// stopOnSignal returns a context that is cancelled on SIGINT or SIGTERM, so
+// that the download is saved before exiting. A second signal exits right
+// away.
+func stopOnSignal() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Printf("Got %s, stopping", sig)
+		signal.Stop(signals)
+		cancel()
+	}()
+	return ctx
+}
+
+// parsePriorities turns the -only and -p flags into file priorities. nil is
+// returned if neither is given.
+func parsePriorities(numFiles int, only string, priorityFlags []string) ([]p2p.Priority, error) {
+	if only == "" && len(priorityFlags) == 0 {
+		return nil, nil
+	}
+	priorities := make([]p2p.Priority, numFiles)
+	parseIndex := func(s string) (int, error) {
+		index, err := strconv.Atoi(s)
+		if err != nil || index < 0 || index >= numFiles {
+			return 0, fmt.Errorf("Invalid file index %q, expected 0 to %d", s, numFiles-1)
+		}
+		return index, nil
+	}
+
+	if only != "" {
+		for i := range priorities {
+			priorities[i] = p2p.PrioritySkip
+		}
+		for _, s := range strings.Split(only, ",") {
+			index, err := parseIndex(s)
+			if err != nil {
+				return nil, err
+			}
+			priorities[index] = p2p.PriorityNormal
+		}
+	}
+	for _, p := range priorityFlags {
+		parts := strings.SplitN(p, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid priority %q, expected <index>=<priority>", p)
+		}
+		index, err := parseIndex(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		priorities[index], err = p2p.ParsePriority(parts[1])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return priorities, nil
+}
@@ -0,0 +1,83 @@
+// Package merkle implements the SHA-256 merkle trees used by BitTorrent v2 (BEP 52)
+package merkle
+
+import (
+	"crypto/sha256"
+)
+
+// BlockSize is the size of the data blocks forming the leaves of the tree
+const BlockSize = 16384
+
+// BlockHashes returns the leaf hashes of data. The last block may be shorter
+// than BlockSize.
+func BlockHashes(data []byte) [][32]byte {
+	hashes := make([][32]byte, 0, (len(data)+BlockSize-1)/BlockSize)
+	for begin := 0; begin < len(data); begin += BlockSize {
+		end := begin + BlockSize
+		if end > len(data) {
+			end = len(data)
+		}
+		hashes = append(hashes, sha256.Sum256(data[begin:end]))
+	}
+	return hashes
+}
+
+// Root calculates the root of a tree with width leaves, of which the first
+// len(hashes) are given. The remaining leaves are set to pad.
+func Root(hashes [][32]byte, width int, pad [32]byte) [32]byte {
+	for width > 1 {
+		next := make([][32]byte, 0, (len(hashes)+1)/2)
+		for i := 0; i < len(hashes); i += 2 {
+			right := pad
+			if i+1 < len(hashes) {
+				right = hashes[i+1]
+			}
+			next = append(next, hashPair(hashes[i], right))
+		}
+		hashes = next
+		pad = hashPair(pad, pad)
+		width /= 2
+	}
+	if len(hashes) == 0 {
+		return pad
+	}
+	return hashes[0]
+}
+
+// PadHash returns the root of a tree consisting of leaves zero hashes
+func PadHash(leaves int) [32]byte {
+	return Root(nil, leaves, [32]byte{})
+}
+
+// PieceRoot returns the root of the subtree with leaves blocks that covers
+// data. Blocks beyond the end of data are zero hashes.
+func PieceRoot(data []byte, leaves int) [32]byte {
+	return Root(BlockHashes(data), leaves, [32]byte{})
+}
+
+// FileRoot returns the pieces root of a file, given its piece layer, where
+// each piece consists of pieceLeaves blocks
+func FileRoot(pieceLayer [][32]byte, pieceLeaves int) [32]byte {
+	return Root(pieceLayer, NextPowerOfTwo(len(pieceLayer)), PadHash(pieceLeaves))
+}
+
+// NextPowerOfTwo returns the smallest power of two that is >= n
+func NextPowerOfTwo(n int) int {
+	p := 1
+	for p < n {
+		p *= 2
+	}
+	return p
+}
+
+// IsPowerOfTwo tells if n is a positive power of two
+func IsPowerOfTwo(n int) bool {
+	return n > 0 && n&(n-1) == 0
+}
+
+func hashPair(left, right [32]byte) [32]byte {
+	var buf [64]byte
+	copy(buf[:32], left[:])
+	copy(buf[32:], right[:])
+	return sha256.Sum256(buf[:])
+}
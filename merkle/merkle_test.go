@@ -0,0 +1,76 @@
+package merkle
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func pair(left, right [32]byte) [32]byte {
+	return sha256.Sum256(append(append([]byte{}, left[:]...), right[:]...))
+}
+
+func TestBlockHashes(t *testing.T) {
+	data := bytes.Repeat([]byte{'x'}, BlockSize+10)
+	hashes := BlockHashes(data)
+	assert.Equal(t, [][32]byte{
+		sha256.Sum256(data[:BlockSize]),
+		sha256.Sum256(data[BlockSize:]),
+	}, hashes)
+	assert.Empty(t, BlockHashes(nil))
+}
+
+func TestRoot(t *testing.T) {
+	a := sha256.Sum256([]byte("a"))
+	b := sha256.Sum256([]byte("b"))
+	c := sha256.Sum256([]byte("c"))
+	var zero [32]byte
+
+	tests := map[string]struct {
+		hashes [][32]byte
+		width  int
+		root   [32]byte
+	}{
+		"single leaf":         {hashes: [][32]byte{a}, width: 1, root: a},
+		"two leaves":          {hashes: [][32]byte{a, b}, width: 2, root: pair(a, b)},
+		"padded to four":      {hashes: [][32]byte{a, b, c}, width: 4, root: pair(pair(a, b), pair(c, zero))},
+		"padded to eight":     {hashes: [][32]byte{a}, width: 8, root: pair(pair(pair(a, zero), pair(zero, zero)), pair(pair(zero, zero), pair(zero, zero)))},
+		"only padding leaves": {hashes: nil, width: 2, root: pair(zero, zero)},
+	}
+	for name, test := range tests {
+		assert.Equal(t, test.root, Root(test.hashes, test.width, zero), name)
+	}
+}
+
+func TestFileRoot(t *testing.T) {
+	// a file of three pieces with two blocks each must have the same root as
+	// the tree built directly from its blocks
+	data := bytes.Repeat([]byte("0123456789"), 5*BlockSize/10+100)
+	blocks := BlockHashes(data)
+	expected := Root(blocks, NextPowerOfTwo(len(blocks)), [32]byte{})
+
+	pieceLength := 2 * BlockSize
+	var layer [][32]byte
+	for begin := 0; begin < len(data); begin += pieceLength {
+		end := begin + pieceLength
+		if end > len(data) {
+			end = len(data)
+		}
+		layer = append(layer, PieceRoot(data[begin:end], 2))
+	}
+	assert.Len(t, layer, 3)
+	assert.Equal(t, expected, FileRoot(layer, 2))
+}
+
+func TestNextPowerOfTwo(t *testing.T) {
+	inputs := []int{0, 1, 2, 3, 5, 8, 1000}
+	outputs := []int{1, 1, 2, 4, 8, 8, 1024}
+	for i, input := range inputs {
+		assert.Equal(t, outputs[i], NextPowerOfTwo(input))
+	}
+	assert.True(t, IsPowerOfTwo(16384))
+	assert.False(t, IsPowerOfTwo(3*16384))
+	assert.False(t, IsPowerOfTwo(0))
+}
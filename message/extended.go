@@ -0,0 +1,24 @@
+package message
+
+import "fmt"
+
+// ExtendedHandshakeID is the extended message ID of the extension handshake
+const ExtendedHandshakeID = 0
+
+// FormatExtended creates an EXTENDED message with the extended message ID
+// the receiver assigned to the extension, or ExtendedHandshakeID
+func FormatExtended(id uint8, payload []byte) *Message {
+	return &Message{ID: MsgExtended, Payload: append([]byte{id}, payload...)}
+}
+
+// ParseExtended returns the extended message ID and the payload of an
+// EXTENDED message
+func ParseExtended(msg *Message) (uint8, []byte, error) {
+	if msg.ID != MsgExtended {
+		return 0, nil, fmt.Errorf("Expected EXTENDED (ID %d), got ID %d", MsgExtended, msg.ID)
+	}
+	if len(msg.Payload) < 1 {
+		return 0, nil, fmt.Errorf("Extended message has no extended message ID")
+	}
+	return msg.Payload[0], msg.Payload[1:], nil
+}
@@ -0,0 +1,51 @@
+package message
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatExtended(t *testing.T) {
+	msg := FormatExtended(ExtendedHandshakeID, []byte("de"))
+	assert.Equal(t, &Message{ID: MsgExtended, Payload: []byte{0, 'd', 'e'}}, msg)
+}
+
+func TestParseExtended(t *testing.T) {
+	tests := map[string]struct {
+		input   *Message
+		id      uint8
+		payload []byte
+		fails   bool
+	}{
+		"parse valid message": {
+			input:   &Message{ID: MsgExtended, Payload: []byte{3, 'd', 'e'}},
+			id:      3,
+			payload: []byte("de"),
+		},
+		"empty payload": {
+			input:   &Message{ID: MsgExtended, Payload: []byte{0}},
+			id:      0,
+			payload: []byte{},
+		},
+		"wrong message type": {
+			input: &Message{ID: MsgPiece, Payload: []byte{0, 'd', 'e'}},
+			fails: true,
+		},
+		"no extended message ID": {
+			input: &Message{ID: MsgExtended, Payload: []byte{}},
+			fails: true,
+		},
+	}
+
+	for name, test := range tests {
+		id, payload, err := ParseExtended(test.input)
+		if test.fails {
+			assert.NotNil(t, err, name)
+		} else {
+			assert.Nil(t, err, name)
+		}
+		assert.Equal(t, test.id, id, name)
+		assert.Equal(t, test.payload, payload, name)
+	}
+}
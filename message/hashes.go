@@ -0,0 +1,89 @@
+package message
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// hashRequestLength is the payload length of HASH REQUEST and HASH REJECT messages
+const hashRequestLength = 32 + 4*4
+
+// A HashRequest asks for Length hashes of a file's merkle tree, starting
+// at Index in the layer BaseLayer (0 being the block layer), together with
+// ProofLayers uncle hashes needed to verify them against the pieces root
+type HashRequest struct {
+	PiecesRoot  [32]byte
+	BaseLayer   int
+	Index       int
+	Length      int
+	ProofLayers int
+}
+
+func (r *HashRequest) serialize() []byte {
+	payload := make([]byte, hashRequestLength)
+	copy(payload[0:32], r.PiecesRoot[:])
+	binary.BigEndian.PutUint32(payload[32:36], uint32(r.BaseLayer))
+	binary.BigEndian.PutUint32(payload[36:40], uint32(r.Index))
+	binary.BigEndian.PutUint32(payload[40:44], uint32(r.Length))
+	binary.BigEndian.PutUint32(payload[44:48], uint32(r.ProofLayers))
+	return payload
+}
+
+func parseHashRequest(payload []byte) HashRequest {
+	r := HashRequest{
+		BaseLayer:   int(binary.BigEndian.Uint32(payload[32:36])),
+		Index:       int(binary.BigEndian.Uint32(payload[36:40])),
+		Length:      int(binary.BigEndian.Uint32(payload[40:44])),
+		ProofLayers: int(binary.BigEndian.Uint32(payload[44:48])),
+	}
+	copy(r.PiecesRoot[:], payload[0:32])
+	return r
+}
+
+// FormatHashRequest creates a HASH REQUEST message
+func FormatHashRequest(r HashRequest) *Message {
+	return &Message{ID: MsgHashRequest, Payload: r.serialize()}
+}
+
+// FormatHashes creates a HASHES message answering a hash request
+func FormatHashes(r HashRequest, hashes [][32]byte) *Message {
+	payload := r.serialize()
+	for _, hash := range hashes {
+		payload = append(payload, hash[:]...)
+	}
+	return &Message{ID: MsgHashes, Payload: payload}
+}
+
+// FormatHashReject creates a HASH REJECT message
+func FormatHashReject(r HashRequest) *Message {
+	return &Message{ID: MsgHashReject, Payload: r.serialize()}
+}
+
+// ParseHashRequest parses a HASH REQUEST or HASH REJECT message
+func ParseHashRequest(msg *Message) (HashRequest, error) {
+	if msg.ID != MsgHashRequest && msg.ID != MsgHashReject {
+		return HashRequest{}, fmt.Errorf("Expected HASH REQUEST (ID %d) or HASH REJECT (ID %d), got ID %d", MsgHashRequest, MsgHashReject, msg.ID)
+	}
+	if len(msg.Payload) != hashRequestLength {
+		return HashRequest{}, fmt.Errorf("Expected payload length %d, got length %d", hashRequestLength, len(msg.Payload))
+	}
+	return parseHashRequest(msg.Payload), nil
+}
+
+// ParseHashes parses a HASHES message into the request it answers and the
+// hashes it contains
+func ParseHashes(msg *Message) (HashRequest, [][32]byte, error) {
+	if msg.ID != MsgHashes {
+		return HashRequest{}, nil, fmt.Errorf("Expected HASHES (ID %d), got ID %d", MsgHashes, msg.ID)
+	}
+	if len(msg.Payload) < hashRequestLength || (len(msg.Payload)-hashRequestLength)%32 != 0 {
+		return HashRequest{}, nil, fmt.Errorf("Malformed HASHES payload of length %d", len(msg.Payload))
+	}
+	r := parseHashRequest(msg.Payload)
+	buf := msg.Payload[hashRequestLength:]
+	hashes := make([][32]byte, len(buf)/32)
+	for i := range hashes {
+		copy(hashes[i][:], buf[i*32:(i+1)*32])
+	}
+	return r, hashes, nil
+}
@@ -0,0 +1,56 @@
+package message
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHashRequest(t *testing.T) {
+	r := HashRequest{
+		PiecesRoot:  [32]byte{1, 2, 3},
+		BaseLayer:   1,
+		Index:       512,
+		Length:      8,
+		ProofLayers: 3,
+	}
+	msg := FormatHashRequest(r)
+	assert.Equal(t, MsgHashRequest, msg.ID)
+	assert.Equal(t, []byte{
+		0x00, 0x00, 0x00, 0x01, // Base layer
+		0x00, 0x00, 0x02, 0x00, // Index
+		0x00, 0x00, 0x00, 0x08, // Length
+		0x00, 0x00, 0x00, 0x03, // Proof layers
+	}, msg.Payload[32:])
+
+	parsed, err := ParseHashRequest(msg)
+	require.Nil(t, err)
+	assert.Equal(t, r, parsed)
+
+	parsed, err = ParseHashRequest(FormatHashReject(r))
+	require.Nil(t, err)
+	assert.Equal(t, r, parsed)
+
+	_, err = ParseHashRequest(&Message{ID: MsgHashRequest, Payload: msg.Payload[:40]})
+	assert.NotNil(t, err)
+	_, err = ParseHashRequest(&Message{ID: MsgHave, Payload: msg.Payload})
+	assert.NotNil(t, err)
+}
+
+func TestHashes(t *testing.T) {
+	r := HashRequest{PiecesRoot: [32]byte{9}, Length: 2}
+	hashes := [][32]byte{{1}, {2}, {3}}
+	msg := FormatHashes(r, hashes)
+	assert.Len(t, msg.Payload, 48+3*32)
+
+	parsedRequest, parsedHashes, err := ParseHashes(msg)
+	require.Nil(t, err)
+	assert.Equal(t, r, parsedRequest)
+	assert.Equal(t, hashes, parsedHashes)
+
+	_, _, err = ParseHashes(&Message{ID: MsgHashes, Payload: msg.Payload[:60]})
+	assert.NotNil(t, err)
+	_, _, err = ParseHashes(FormatHashReject(r))
+	assert.NotNil(t, err)
+}
@@ -27,6 +27,14 @@ const (
 	MsgPiece messageID = 7
 	// MsgCancel cancels a request
 	MsgCancel messageID = 8
+	// MsgExtended is a message of the extension protocol (BEP 10)
+	MsgExtended messageID = 20
+	// MsgHashRequest requests merkle tree hashes of a v2 torrent (BEP 52)
+	MsgHashRequest messageID = 21
+	// MsgHashes delivers the hashes asked for by a hash request
+	MsgHashes messageID = 22
+	// MsgHashReject rejects a hash request
+	MsgHashReject messageID = 23
 )
 
 // Message stores ID and payload of a message
@@ -75,6 +83,20 @@ func ParsePiece(index int, buf []byte, msg *Message) (int, error) {
 	return len(data), nil
 }
 
+// ParsePieceHeader returns the piece index and offset of a PIECE message,
+// e.g. to find the buffer to pass to ParsePiece
+func ParsePieceHeader(msg *Message) (index, begin int, err error) {
+	if msg.ID != MsgPiece {
+		return 0, 0, fmt.Errorf("Expected PIECE (ID %d), got ID %d", MsgPiece, msg.ID)
+	}
+	if len(msg.Payload) < 8 {
+		return 0, 0, fmt.Errorf("Payload too short. %d < 8", len(msg.Payload))
+	}
+	index = int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+	begin = int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	return index, begin, nil
+}
+
 // ParseHave parses a HAVE message
 func ParseHave(msg *Message) (int, error) {
 	if msg.ID != MsgHave {
@@ -153,6 +175,14 @@ func (m *Message) name() string {
 		return "Piece"
 	case MsgCancel:
 		return "Cancel"
+	case MsgExtended:
+		return "Extended"
+	case MsgHashRequest:
+		return "HashRequest"
+	case MsgHashes:
+		return "Hashes"
+	case MsgHashReject:
+		return "HashReject"
 	default:
 		return fmt.Sprintf("Unknown#%d", m.ID)
 	}
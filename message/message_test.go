@@ -138,6 +138,40 @@ func TestParsePiece(t *testing.T) {
 	}
 }
 
+func TestParsePieceHeader(t *testing.T) {
+	tests := map[string]struct {
+		input *Message
+		index int
+		begin int
+		fails bool
+	}{
+		"parse valid message": {
+			input: &Message{ID: MsgPiece, Payload: []byte{0, 0, 0, 4, 0, 0, 0x40, 0, 0xaa, 0xbb}},
+			index: 4,
+			begin: 16384,
+		},
+		"wrong message type": {
+			input: &Message{ID: MsgHave, Payload: []byte{0, 0, 0, 4, 0, 0, 0x40, 0}},
+			fails: true,
+		},
+		"payload too short": {
+			input: &Message{ID: MsgPiece, Payload: []byte{0, 0, 0, 4, 0, 0, 0x40}},
+			fails: true,
+		},
+	}
+
+	for name, test := range tests {
+		index, begin, err := ParsePieceHeader(test.input)
+		if test.fails {
+			assert.NotNil(t, err, name)
+		} else {
+			assert.Nil(t, err, name)
+		}
+		assert.Equal(t, test.index, index, name)
+		assert.Equal(t, test.begin, begin, name)
+	}
+}
+
 func TestParseHave(t *testing.T) {
 	tests := map[string]struct {
 		input  *Message
@@ -253,6 +287,10 @@ func TestString(t *testing.T) {
 		{&Message{MsgRequest, []byte{1, 2, 3}}, "Request [3]"},
 		{&Message{MsgPiece, []byte{1, 2, 3}}, "Piece [3]"},
 		{&Message{MsgCancel, []byte{1, 2, 3}}, "Cancel [3]"},
+		{&Message{MsgExtended, []byte{1, 2, 3}}, "Extended [3]"},
+		{&Message{MsgHashRequest, []byte{1, 2, 3}}, "HashRequest [3]"},
+		{&Message{MsgHashes, []byte{1, 2, 3}}, "Hashes [3]"},
+		{&Message{MsgHashReject, []byte{1, 2, 3}}, "HashReject [3]"},
 		{&Message{99, []byte{1, 2, 3}}, "Unknown#99 [3]"},
 	}
 
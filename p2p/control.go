@@ -0,0 +1,54 @@
+package p2p
+
+import "sync"
+
+// Control pauses and resumes a download. A paused download disconnects from
+// its peers and seeds, but keeps the pieces and blocks it has, and continues
+// where it left off once resumed. Its methods can be called from any
+// goroutine.
+type Control struct {
+	mu      sync.Mutex
+	paused  bool
+	changed chan struct{} // closed and replaced when paused or resumed
+}
+
+// NewControl creates a Control of a download that isn't paused, to be
+// passed to Torrent
+func NewControl() *Control {
+	return &Control{changed: make(chan struct{})}
+}
+
+// Pause pauses the download
+func (c *Control) Pause() {
+	c.set(true)
+}
+
+// Resume continues a paused download
+func (c *Control) Resume() {
+	c.set(false)
+}
+
+// Paused returns true while the download is paused
+func (c *Control) Paused() bool {
+	paused, _ := c.State()
+	return paused
+}
+
+// State returns whether the download is paused, and a channel that is
+// closed when that changes
+func (c *Control) State() (paused bool, changed <-chan struct{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.paused, c.changed
+}
+
+func (c *Control) set(paused bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.paused == paused {
+		return
+	}
+	c.paused = paused
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
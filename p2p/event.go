@@ -0,0 +1,59 @@
+package p2p
+
+import "fmt"
+
+// EventType tells what an Event reports
+type EventType int
+
+// Events of a download
+const (
+	EventPeerConnected EventType = iota
+	EventPeerDisconnected
+	EventPieceVerified
+	EventPieceFailed
+	EventAnnounce
+	EventCompleted
+	EventPaused
+	EventResumed
+)
+
+var eventNames = map[EventType]string{
+	EventPeerConnected:    "peer connected",
+	EventPeerDisconnected: "peer disconnected",
+	EventPieceVerified:    "piece verified",
+	EventPieceFailed:      "piece failed",
+	EventAnnounce:         "announce",
+	EventCompleted:        "completed",
+	EventPaused:           "paused",
+	EventResumed:          "resumed",
+}
+
+func (e EventType) String() string {
+	if name, ok := eventNames[e]; ok {
+		return name
+	}
+	return fmt.Sprintf("EventType(%d)", int(e))
+}
+
+// Event reports the progress of a download. Only the fields that apply to
+// its Type are set.
+type Event struct {
+	Type    EventType
+	Peer    string // address of the peer, or URL of the seed a piece came from
+	Piece   int    // index of the piece
+	Tracker string // announce URL
+	Peers   int    // number of peers the tracker returned
+	Err     error  // why a peer disconnected, or a piece or an announce failed
+}
+
+// EventHandler is called with the events of a download. It's called from
+// several goroutines at once and should return quickly, as the download
+// waits for it.
+type EventHandler func(Event)
+
+// Emit calls the handler, if there is one
+func (h EventHandler) Emit(e Event) {
+	if h != nil {
+		h(e)
+	}
+}
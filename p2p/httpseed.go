@@ -0,0 +1,99 @@
+package p2p
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sjaensch/storrent/ratelimit"
+)
+
+// httpSeedMaxRetryAfter caps the time a busy HTTP seed can make us wait
+const httpSeedMaxRetryAfter = time.Hour
+
+// httpSeedURL returns the URL to request a whole piece from an HTTP seed (BEP 17)
+func httpSeedURL(seed string, infoHash [20]byte, index int) (string, error) {
+	u, err := url.Parse(seed)
+	if err != nil {
+		return "", err
+	}
+	params := u.Query()
+	params.Set("info_hash", string(infoHash[:]))
+	params.Set("piece", strconv.Itoa(index))
+	u.RawQuery = params.Encode()
+	return u.String(), nil
+}
+
+// parseRetryAfter parses the body of a 503 response, which holds the number
+// of seconds to wait before trying again
+func parseRetryAfter(body []byte) (time.Duration, error) {
+	seconds, err := strconv.Atoi(strings.TrimSpace(string(body)))
+	if err != nil || seconds < 0 {
+		return 0, fmt.Errorf("Invalid retry time %q", body)
+	}
+	retryAfter := time.Duration(seconds) * time.Second
+	if retryAfter > httpSeedMaxRetryAfter {
+		retryAfter = httpSeedMaxRetryAfter
+	}
+	return retryAfter, nil
+}
+
+// downloadPieceFromHTTPSeed requests a piece from an HTTP seed. If the seed
+// is busy, the time it wants us to wait is returned along with an error.
+func (t *Torrent) downloadPieceFromHTTPSeed(ctx context.Context, c *http.Client, seed string, pw *pieceWork) ([]byte, time.Duration, error) {
+	pieceURL, err := httpSeedURL(seed, t.InfoHash, pw.index)
+	if err != nil {
+		return nil, 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", pieceURL, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusServiceUnavailable:
+		body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64))
+		if err != nil {
+			return nil, 0, err
+		}
+		retryAfter, err := parseRetryAfter(body)
+		if err != nil {
+			return nil, 0, err
+		}
+		return nil, retryAfter, fmt.Errorf("HTTP seed %s is busy", seed)
+	default:
+		return nil, 0, fmt.Errorf("HTTP seed %s returned status %s", seed, resp.Status)
+	}
+
+	buf := make([]byte, pw.length)
+	_, err = io.ReadFull(ratelimit.Reader(resp.Body, t.DownloadLimit), buf)
+	if err != nil {
+		return nil, 0, err
+	}
+	t.Stats.seedDownloaded(len(buf))
+	return buf, 0, nil
+}
+
+func (t *Torrent) startHTTPSeedWorker(ctx context.Context, seed string, sched *scheduler) {
+	if !strings.HasPrefix(seed, "http://") && !strings.HasPrefix(seed, "https://") {
+		log.Printf("Ignoring HTTP seed %s with unsupported scheme\n", seed)
+		return
+	}
+	c := &http.Client{Timeout: seedTimeout}
+	runSeedWorker(ctx, seed, func(ctx context.Context, pw *pieceWork) ([]byte, time.Duration, error) {
+		return t.downloadPieceFromHTTPSeed(ctx, c, seed, pw)
+	}, sched)
+}
@@ -0,0 +1,81 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPSeedURL(t *testing.T) {
+	infoHash := [20]byte{0xde, 0xad, 0xbe, 0xef, ' ', '&'}
+	u, err := httpSeedURL("http://example.com/seed.php?key=1", infoHash, 7)
+	require.Nil(t, err)
+	assert.Equal(t, "http://example.com/seed.php?info_hash=%DE%AD%BE%EF+%26%00%00%00%00%00%00%00%00%00%00%00%00%00%00&key=1&piece=7", u)
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := map[string]struct {
+		input  string
+		output time.Duration
+		fails  bool
+	}{
+		"seconds":      {input: "120", output: 2 * time.Minute},
+		"whitespace":   {input: " 30\n", output: 30 * time.Second},
+		"capped":       {input: "86400", output: httpSeedMaxRetryAfter},
+		"not a number": {input: "busy", fails: true},
+		"negative":     {input: "-1", fails: true},
+	}
+
+	for name, test := range tests {
+		retryAfter, err := parseRetryAfter([]byte(test.input))
+		if test.fails {
+			assert.NotNil(t, err, name)
+		} else {
+			assert.Nil(t, err, name)
+			assert.Equal(t, test.output, retryAfter, name)
+		}
+	}
+}
+
+func TestDownloadPieceFromHTTPSeed(t *testing.T) {
+	data := bytes.Repeat([]byte{'x'}, 100)
+	infoHash := [20]byte{1, 2, 3}
+	busy := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("info_hash") != string(infoHash[:]) || r.URL.Query().Get("piece") != "1" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if busy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("60"))
+			return
+		}
+		w.Write(data[64:])
+	}))
+	defer server.Close()
+
+	torrent := Torrent{InfoHash: infoHash, PieceLength: 64, Length: len(data)}
+	pw := &pieceWork{index: 1, hash: sha1.Sum(data[64:]), length: 36}
+	c := &http.Client{}
+
+	_, retryAfter, err := torrent.downloadPieceFromHTTPSeed(context.Background(), c, server.URL, pw)
+	assert.NotNil(t, err)
+	assert.Equal(t, time.Minute, retryAfter)
+
+	busy = false
+	buf, retryAfter, err := torrent.downloadPieceFromHTTPSeed(context.Background(), c, server.URL, pw)
+	require.Nil(t, err)
+	assert.Equal(t, time.Duration(0), retryAfter)
+	assert.Nil(t, checkIntegrity(pw, buf))
+
+	_, _, err = torrent.downloadPieceFromHTTPSeed(context.Background(), c, server.URL, &pieceWork{index: 0, length: 64})
+	assert.NotNil(t, err)
+}
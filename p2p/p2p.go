@@ -2,31 +2,38 @@ package p2p
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
 	"fmt"
 	"log"
 	"os"
-	"runtime"
-	"time"
+	"sort"
 
-	"github.com/sjaensch/storrent/client"
-	"github.com/sjaensch/storrent/message"
+	"github.com/sjaensch/storrent/bitfield"
+	"github.com/sjaensch/storrent/merkle"
 	"github.com/sjaensch/storrent/peers"
+	"github.com/sjaensch/storrent/ratelimit"
 )
 
 // MaxBlockSize is the largest number of bytes a request can ask for
 const MaxBlockSize = 16384
 
-// MaxBacklog is the number of unfulfilled requests a client can have in its pipeline
-const MaxBacklog = 5
-
 // TorrentFile represents a single file within a multi-file torrent
 type TorrentFile struct {
-	Length int
-	Path   string
-	Name   string
-	Md5sum string
-	File   *os.File
+	Length  int
+	Path    string
+	Name    string
+	Md5sum  string
+	File    *os.File
+	Padding bool // zeros that align the next file to a piece boundary (BEP 47)
+}
+
+// PieceV2 is a piece of a v2 torrent (BEP 52), which is verified against
+// the root of its subtree of the file's merkle tree
+type PieceV2 struct {
+	Root   [32]byte
+	Leaves int // number of blocks covered by Root, including padding
+	Length int // the last piece of a file may be shorter
 }
 
 // Torrent holds data required to download a torrent from a list of peers
@@ -35,105 +42,80 @@ type Torrent struct {
 	PeerID      [20]byte
 	InfoHash    [20]byte
 	PieceHashes [][20]byte
+	PiecesV2    []PieceV2 // set for v2 and hybrid torrents
 	PieceLength int
 	Length      int
 	Name        string
-	Files       []TorrentFile
+	Files       []TorrentFile // empty for single-file torrents
+	WebSeeds    []string      // URLs of HTTP servers that have the data (BEP 19)
+	HTTPSeeds   []string      // URLs of scripts serving whole pieces (BEP 17)
+
+	// DownloadLimit and UploadLimit throttle the torrent's connections to
+	// peers and seeds. Give them a shared parent for a global limit. nil
+	// doesn't limit.
+	DownloadLimit *ratelimit.Limiter
+	UploadLimit   *ratelimit.Limiter
+
+	// Stats collects the statistics of the download, created by Download
+	// unless set. Poll it with Stats.Snapshot.
+	Stats *Stats
+
+	// Have holds the pieces we have. Download skips the pieces set, and sets
+	// the ones it downloads. It is created by Download unless set.
+	Have bitfield.Bitfield
+
+	// OnEvent, if set, is called with the events of the download
+	OnEvent EventHandler
+
+	// Control pauses and resumes the download, created by Download unless
+	// set
+	Control *Control
+
+	// OnPauseChange, if set, is called when the download is paused, after
+	// its workers stopped, and when it is resumed, before they start again.
+	// On resume, the peers it returns replace Peers unless there are none,
+	// e.g. the ones a tracker returned when told that we started again.
+	OnPauseChange func(ctx context.Context, paused bool) []peers.Peer
+
+	// PiecePriorities holds the priority of each piece, pieces without an
+	// entry have PriorityNormal
+	PiecePriorities []Priority
 }
 
 type pieceWork struct {
-	index  int
-	hash   [20]byte
-	length int
-}
-
-type pieceResult struct {
-	index int
-	buf   []byte
-}
-
-type pieceProgress struct {
-	index      int // index of the piece
-	client     *client.Client
-	buf        []byte
-	downloaded int // number of bytes downloaded, i.e. index into buf to the last downloaded byte + 1
-	requested  int // number of bytes requested for download
-	backlog    int // number of outstanding requests
+	index   int
+	hash    [20]byte
+	v2      *PieceV2
+	length  int
+	padding int // number of zero bytes at the end of the piece, which aren't requested
 }
 
-func (state *pieceProgress) readMessage() error {
-	msg, err := state.client.Read() // this call blocks
-	if err != nil {
-		return err
+// Verify checks data against the merkle root of the piece
+func (p *PieceV2) Verify(data []byte) error {
+	if len(data) != p.Length {
+		return fmt.Errorf("Expected piece of length %d, got %d", p.Length, len(data))
 	}
-
-	if msg == nil { // keep-alive
-		return nil
-	}
-
-	switch msg.ID {
-	case message.MsgUnchoke:
-		state.client.Choked = false
-	case message.MsgChoke:
-		state.client.Choked = true
-	case message.MsgHave:
-		index, err := message.ParseHave(msg)
-		if err != nil {
-			return err
-		}
-		state.client.Bitfield.SetPiece(index)
-	case message.MsgPiece:
-		n, err := message.ParsePiece(state.index, state.buf, msg)
-		if err != nil {
-			return err
-		}
-		state.downloaded += n
-		state.backlog--
+	if merkle.PieceRoot(data, p.Leaves) != p.Root {
+		return fmt.Errorf("Piece does not match its merkle root")
 	}
 	return nil
 }
 
-func attemptDownloadPiece(c *client.Client, pw *pieceWork) ([]byte, error) {
-	state := pieceProgress{
-		index:  pw.index,
-		client: c,
-		buf:    make([]byte, pw.length),
-	}
-
-	// Setting a deadline helps get unresponsive peers unstuck.
-	// 30 seconds is more than enough time to download a 262 KB piece
-	c.Conn.SetDeadline(time.Now().Add(30 * time.Second))
-	defer c.Conn.SetDeadline(time.Time{}) // Disable the deadline
-
-	for state.downloaded < pw.length {
-		// If unchoked, send requests until we have enough unfulfilled requests
-		if !state.client.Choked {
-			for state.backlog < MaxBacklog && state.requested < pw.length {
-				blockSize := MaxBlockSize
-				// Last block might be shorter than the typical block
-				if pw.length-state.requested < blockSize {
-					blockSize = pw.length - state.requested
-				}
+type pieceResult struct {
+	index int
+	buf   []byte
+}
 
-				err := c.SendRequest(pw.index, state.requested, blockSize)
-				if err != nil {
-					return nil, err
-				}
-				state.backlog++
-				state.requested += blockSize
-			}
+func checkIntegrity(pw *pieceWork, buf []byte) error {
+	if pw.v2 != nil {
+		// pieces of hybrid torrents may be followed by padding
+		if len(buf) < pw.v2.Length || pw.v2.Verify(buf[:pw.v2.Length]) != nil {
+			return fmt.Errorf("Index %d failed integrity check", pw.index)
 		}
-
-		err := state.readMessage()
-		if err != nil {
-			return nil, err
+		if pw.hash == [20]byte{} {
+			return nil
 		}
 	}
-
-	return state.buf, nil
-}
-
-func checkIntegrity(pw *pieceWork, buf []byte) error {
 	hash := sha1.Sum(buf)
 	if !bytes.Equal(hash[:], pw.hash[:]) {
 		return fmt.Errorf("Index %d failed integrity check", pw.index)
@@ -141,44 +123,6 @@ func checkIntegrity(pw *pieceWork, buf []byte) error {
 	return nil
 }
 
-func (t *Torrent) startDownloadWorker(peer peers.Peer, workQueue chan *pieceWork, results chan *pieceResult) {
-	c, err := client.New(peer, t.PeerID, t.InfoHash)
-	if err != nil {
-		log.Printf("Could not handshake with %s. Disconnecting\n", peer.IP)
-		return
-	}
-	defer c.Conn.Close()
-	log.Printf("Completed handshake with %s\n", peer.IP)
-
-	c.SendUnchoke()
-	c.SendInterested()
-
-	for pw := range workQueue {
-		if !c.Bitfield.HasPiece(pw.index) {
-			workQueue <- pw // Put piece back on the queue
-			continue
-		}
-
-		// Download the piece
-		buf, err := attemptDownloadPiece(c, pw)
-		if err != nil {
-			log.Println("Exiting", err)
-			workQueue <- pw // Put piece back on the queue
-			return
-		}
-
-		err = checkIntegrity(pw, buf)
-		if err != nil {
-			log.Printf("Piece #%d failed integrity check\n", pw.index)
-			workQueue <- pw // Put piece back on the queue
-			continue
-		}
-
-		c.SendHave(pw.index)
-		results <- &pieceResult{pw.index, buf}
-	}
-}
-
 func (t *Torrent) calculateBoundsForPiece(index int) (begin int, end int) {
 	begin = index * t.PieceLength
 	end = begin + t.PieceLength
@@ -193,36 +137,165 @@ func (t *Torrent) calculatePieceSize(index int) int {
 	return end - begin
 }
 
+// trailingPadding returns the number of padding bytes at the end of each
+// piece that has some. Padding files only ever end a piece, as they align
+// the following file to a piece boundary.
+func (t *Torrent) trailingPadding() map[int]int {
+	padding := make(map[int]int)
+	offset := 0
+	for _, file := range t.Files {
+		begin, end := offset, offset+file.Length
+		offset = end
+		if !file.Padding || file.Length == 0 || (end%t.PieceLength != 0 && end != t.Length) {
+			continue
+		}
+		index := (end - 1) / t.PieceLength
+		if pieceBegin := index * t.PieceLength; begin < pieceBegin {
+			begin = pieceBegin
+		}
+		padding[index] = end - begin
+	}
+	return padding
+}
+
+// numPieces returns the number of pieces, which are described by
+// PieceHashes, PiecesV2 or both
+func (t *Torrent) numPieces() int {
+	if len(t.PieceHashes) > 0 {
+		return len(t.PieceHashes)
+	}
+	return len(t.PiecesV2)
+}
+
 // Download downloads the torrent. This stores the entire file in memory.
-func (t *Torrent) Download() ([]byte, error) {
+// Pieces that are skipped or that we already have are left zeroed. If ctx
+// is cancelled, the pieces downloaded so far, as told by Have, are returned
+// along with ctx's error.
+func (t *Torrent) Download(ctx context.Context) ([]byte, error) {
+	// stops the workers when the download ends
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	log.Println("Starting download for", t.Name)
-	// Init queues for workers to retrieve work and send results
-	workQueue := make(chan *pieceWork, len(t.PieceHashes))
-	results := make(chan *pieceResult)
-	for index, hash := range t.PieceHashes {
-		length := t.calculatePieceSize(index)
-		workQueue <- &pieceWork{index, hash, length}
+	numPieces := t.numPieces()
+	if len(t.Have) < (numPieces+7)/8 {
+		have := make(bitfield.Bitfield, (numPieces+7)/8)
+		copy(have, t.Have)
+		t.Have = have
+	}
+	padding := t.trailingPadding()
+	var wanted []*pieceWork
+	for index := 0; index < numPieces; index++ {
+		if t.piecePriority(index) == PrioritySkip || t.Have.HasPiece(index) {
+			continue
+		}
+		pw := &pieceWork{index: index}
+		if index < len(t.PieceHashes) {
+			pw.hash = t.PieceHashes[index]
+			pw.length = t.calculatePieceSize(index)
+		}
+		if index < len(t.PiecesV2) {
+			pw.v2 = &t.PiecesV2[index]
+			if pw.length == 0 {
+				pw.length = pw.v2.Length
+			}
+		}
+		pw.padding = padding[index]
+		if pw.padding >= pw.length {
+			// nothing to request for a piece made up of padding, its hash
+			// must match the zeros it holds
+			if err := checkIntegrity(pw, make([]byte, pw.length)); err != nil {
+				return nil, err
+			}
+			t.Have.SetPiece(index)
+			continue
+		}
+		wanted = append(wanted, pw)
+	}
+	sort.SliceStable(wanted, func(i, j int) bool {
+		return t.piecePriority(wanted[i].index) > t.piecePriority(wanted[j].index)
+	})
+	if t.Stats == nil {
+		t.Stats = NewStats()
 	}
+	if t.Control == nil {
+		t.Control = NewControl()
+	}
+	t.Stats.start(numPieces, len(wanted))
 
-	// Start workers
-	for _, peer := range t.Peers {
-		go t.startDownloadWorker(peer, workQueue, results)
+	// Init the scheduler for workers to retrieve work and send results
+	results := make(chan *pieceResult)
+	sched := newScheduler(ctx, wanted, results, t.OnEvent)
+
+	// Start workers, unless paused. Pausing stops them, while the scheduler
+	// keeps the state of the pieces for the workers started on resume.
+	paused, changed := t.Control.State()
+	stopWorkers := func() {}
+	if !paused {
+		stopWorkers = t.startWorkers(ctx, sched)
+	} else if t.OnPauseChange != nil {
+		t.OnPauseChange(ctx, true)
 	}
 
-	// Collect results into a buffer until full
+	// Collect results into a buffer until all wanted pieces are there.
+	// Skipped pieces are left zeroed.
 	buf := make([]byte, t.Length)
 	donePieces := 0
-	for donePieces < len(t.PieceHashes) {
-		res := <-results
+	for donePieces < len(wanted) {
+		var res *pieceResult
+		select {
+		case res = <-results:
+		case <-changed:
+			wasPaused := paused
+			paused, changed = t.Control.State()
+			if paused && !wasPaused {
+				stopWorkers()
+				log.Println("Paused download of", t.Name)
+				t.OnEvent.Emit(Event{Type: EventPaused})
+				if t.OnPauseChange != nil {
+					t.OnPauseChange(ctx, true)
+				}
+			} else if !paused && wasPaused {
+				if t.OnPauseChange != nil {
+					if found := t.OnPauseChange(ctx, false); len(found) > 0 {
+						t.Peers = found
+					}
+				}
+				stopWorkers = t.startWorkers(ctx, sched)
+				log.Println("Resumed download of", t.Name)
+				t.OnEvent.Emit(Event{Type: EventResumed})
+			}
+			continue
+		case <-ctx.Done():
+			return buf, ctx.Err()
+		}
 		begin, end := t.calculateBoundsForPiece(res.index)
 		copy(buf[begin:end], res.buf)
+		t.Have.SetPiece(res.index)
 		donePieces++
+		t.Stats.pieceDone()
+		t.OnEvent.Emit(Event{Type: EventPieceVerified, Piece: res.index})
 
-		percent := float64(donePieces) / float64(len(t.PieceHashes)) * 100
-		numWorkers := runtime.NumGoroutine() - 1 // subtract 1 for main thread
-		log.Printf("(%0.2f%%) Downloaded piece #%d from %d peers\n", percent, res.index, numWorkers)
+		percent := float64(donePieces) / float64(len(wanted)) * 100
+		log.Printf("(%0.2f%%) Downloaded piece #%d from %d peers\n", percent, res.index, t.Stats.numPeers())
 	}
-	close(workQueue)
+	t.OnEvent.Emit(Event{Type: EventCompleted})
 
 	return buf, nil
 }
+
+// startWorkers starts downloading from the peers and seeds, returning a
+// function that stops them
+func (t *Torrent) startWorkers(ctx context.Context, sched *scheduler) context.CancelFunc {
+	ctx, cancel := context.WithCancel(ctx)
+	for _, peer := range t.Peers {
+		go t.startDownloadWorker(ctx, peer, sched)
+	}
+	for _, seed := range t.WebSeeds {
+		go t.startWebSeedWorker(ctx, seed, sched)
+	}
+	for _, seed := range t.HTTPSeeds {
+		go t.startHTTPSeedWorker(ctx, seed, sched)
+	}
+	return cancel
+}
@@ -0,0 +1,354 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sjaensch/storrent/bitfield"
+	"github.com/sjaensch/storrent/handshake"
+	"github.com/sjaensch/storrent/message"
+	"github.com/sjaensch/storrent/peers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrailingPadding(t *testing.T) {
+	torrent := Torrent{
+		PieceLength: 100,
+		Length:      430,
+		Files: []TorrentFile{
+			{Length: 150},
+			{Length: 50, Padding: true}, // ends piece 1
+			{Length: 30},
+			{Length: 70, Padding: true}, // ends piece 2
+			{Length: 120},
+			{Length: 10, Padding: true}, // ends the torrent
+		},
+	}
+	assert.Equal(t, map[int]int{1: 50, 2: 70, 4: 10}, torrent.trailingPadding())
+}
+
+// servePeer accepts a single connection and seeds data to it, after
+// announcing reqq in its extension handshake. The first reqq requests are
+// only answered after checking that no further request arrives, and are
+// sent on firstRequests.
+func servePeer(ln net.Listener, torrent *Torrent, data []byte, reqq int, firstRequests chan []blockRequest) error {
+	conn, err := ln.Accept()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	req, err := handshake.Read(conn)
+	if err != nil {
+		return err
+	}
+	if !req.SupportsExtensionProtocol() {
+		return fmt.Errorf("Extension protocol not supported")
+	}
+	res := handshake.New(torrent.InfoHash, [20]byte{})
+	res.SetExtensionProtocol()
+	bf := make(bitfield.Bitfield, 1)
+	for i := range torrent.PieceHashes {
+		bf.SetPiece(i)
+	}
+	extended := message.FormatExtended(message.ExtendedHandshakeID, []byte(fmt.Sprintf("d1:mde4:reqqi%dee", reqq)))
+	conn.Write(res.Serialize())
+	conn.Write((&message.Message{ID: message.MsgBitfield, Payload: bf}).Serialize())
+	conn.Write(extended.Serialize())
+	conn.Write((&message.Message{ID: message.MsgUnchoke}).Serialize())
+
+	var pending []blockRequest
+	answered := false
+	for {
+		msg, err := message.Read(conn)
+		if err != nil {
+			return nil // the download is complete
+		}
+		if msg == nil || msg.ID != message.MsgRequest {
+			continue
+		}
+		r := blockRequest{
+			index:  int(binary.BigEndian.Uint32(msg.Payload[0:4])),
+			begin:  int(binary.BigEndian.Uint32(msg.Payload[4:8])),
+			length: int(binary.BigEndian.Uint32(msg.Payload[8:12])),
+		}
+		if answered {
+			sendBlock(conn, torrent, data, r)
+			continue
+		}
+		pending = append(pending, r)
+		if len(pending) < reqq {
+			continue
+		}
+
+		// the pipeline is full, so no further request may arrive
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		_, err = message.Read(conn)
+		if e, ok := err.(net.Error); !ok || !e.Timeout() {
+			return fmt.Errorf("More than %d requests outstanding", reqq)
+		}
+		conn.SetReadDeadline(time.Time{})
+		answered = true
+		for _, r := range pending {
+			sendBlock(conn, torrent, data, r)
+		}
+		firstRequests <- pending
+	}
+}
+
+func sendBlock(conn net.Conn, torrent *Torrent, data []byte, r blockRequest) {
+	payload := make([]byte, 8+r.length)
+	binary.BigEndian.PutUint32(payload[0:4], uint32(r.index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(r.begin))
+	offset := r.index*torrent.PieceLength + r.begin
+	copy(payload[8:], data[offset:offset+r.length])
+	conn.Write((&message.Message{ID: message.MsgPiece, Payload: payload}).Serialize())
+}
+
+func TestDownloadFromPeer(t *testing.T) {
+	data := make([]byte, 2*MaxBlockSize*3-1000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	torrent := Torrent{
+		PieceLength: 2 * MaxBlockSize,
+		Length:      len(data),
+		Stats:       NewStats(),
+	}
+	var mu sync.Mutex
+	var events []EventType
+	torrent.OnEvent = func(e Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, e.Type)
+	}
+	for i := 0; i < 3; i++ {
+		begin, end := torrent.calculateBoundsForPiece(i)
+		torrent.PieceHashes = append(torrent.PieceHashes, sha1.Sum(data[begin:end]))
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+	addr := ln.Addr().(*net.TCPAddr)
+	torrent.Peers = []peers.Peer{{IP: addr.IP, Port: uint16(addr.Port)}}
+	firstRequests := make(chan []blockRequest, 1)
+	served := make(chan error, 1)
+	go func() {
+		served <- servePeer(ln, &torrent, data, 3, firstRequests)
+	}()
+
+	done := make(chan []byte)
+	go func() {
+		buf, err := torrent.Download(context.Background())
+		assert.Nil(t, err)
+		done <- buf
+	}()
+	var buf []byte
+	select {
+	case buf = <-done:
+	case err := <-served:
+		// the peer only stops early on errors
+		require.Nil(t, err)
+		buf = <-done
+	}
+	assert.Equal(t, data, buf)
+	// the third request is for the next piece, before the first one is complete
+	assert.Equal(t, []blockRequest{{0, 0, MaxBlockSize}, {0, MaxBlockSize, MaxBlockSize}, {1, 0, MaxBlockSize}}, <-firstRequests)
+
+	stats := torrent.Stats.Snapshot()
+	assert.Equal(t, 3, stats.NumPieces)
+	assert.Equal(t, 3, stats.PiecesWanted)
+	assert.Equal(t, 3, stats.PiecesDone)
+	// the bytes of the peer include protocol overhead
+	assert.True(t, stats.Downloaded > int64(len(data)))
+
+	mu.Lock()
+	defer mu.Unlock()
+	// the peer is disconnected once all pieces are in, at some point
+	var progress []EventType
+	for _, e := range events {
+		if e != EventPeerDisconnected {
+			progress = append(progress, e)
+		}
+	}
+	assert.Equal(t, []EventType{EventPeerConnected, EventPieceVerified, EventPieceVerified, EventPieceVerified, EventCompleted}, progress)
+}
+
+func TestDownloadPaddingPiece(t *testing.T) {
+	// the pad file fills the whole second piece
+	data := make([]byte, 3*MaxBlockSize-1000)
+	for i := range data[:MaxBlockSize] {
+		data[i] = byte(i)
+	}
+	for i := 2 * MaxBlockSize; i < len(data); i++ {
+		data[i] = byte(i)
+	}
+	torrent := Torrent{
+		PieceLength: MaxBlockSize,
+		Length:      len(data),
+		Files: []TorrentFile{
+			{Length: MaxBlockSize},
+			{Length: MaxBlockSize, Padding: true},
+			{Length: MaxBlockSize - 1000},
+		},
+	}
+	for i := 0; i < 3; i++ {
+		begin, end := torrent.calculateBoundsForPiece(i)
+		torrent.PieceHashes = append(torrent.PieceHashes, sha1.Sum(data[begin:end]))
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+	addr := ln.Addr().(*net.TCPAddr)
+	torrent.Peers = []peers.Peer{{IP: addr.IP, Port: uint16(addr.Port)}}
+	firstRequests := make(chan []blockRequest, 1)
+	go servePeer(ln, &torrent, data, 2, firstRequests)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	buf, err := torrent.Download(ctx)
+	require.Nil(t, err)
+	assert.Equal(t, data, buf)
+	assert.True(t, torrent.Have.HasPiece(1))
+	// nothing is requested of the padding piece
+	assert.Equal(t, []blockRequest{{0, 0, MaxBlockSize}, {2, 0, MaxBlockSize - 1000}}, <-firstRequests)
+}
+
+func TestDownloadCancel(t *testing.T) {
+	data := make([]byte, 3*64)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	var mu sync.Mutex
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		mu.Unlock()
+		if r.Header.Get("Range") != "bytes=0-63" {
+			// hang until the download is cancelled
+			<-r.Context().Done()
+			return
+		}
+		w.Header().Set("Content-Range", "bytes 0-63/192")
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(data[:64])
+	}))
+	defer server.Close()
+
+	verified := make(chan int, 3)
+	torrent := Torrent{
+		PieceLength: 64,
+		Length:      len(data),
+		Name:        "file",
+		WebSeeds:    []string{server.URL + "/file"},
+		Have:        bitfield.Bitfield{0x40}, // the second piece
+		OnEvent: func(e Event) {
+			if e.Type == EventPieceVerified {
+				verified <- e.Piece
+			}
+		},
+	}
+	for i := 0; i < 3; i++ {
+		torrent.PieceHashes = append(torrent.PieceHashes, sha1.Sum(data[i*64:(i+1)*64]))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	var buf []byte
+	go func() {
+		var err error
+		buf, err = torrent.Download(ctx)
+		done <- err
+	}()
+	assert.Equal(t, 0, <-verified)
+	cancel()
+	assert.Equal(t, context.Canceled, <-done)
+
+	assert.Equal(t, data[:64], buf[:64])
+	assert.Equal(t, make([]byte, 128), buf[64:])
+	assert.Equal(t, bitfield.Bitfield{0xc0}, torrent.Have)
+	mu.Lock()
+	defer mu.Unlock()
+	assert.NotContains(t, ranges, "bytes=64-127")
+}
+
+func TestDownloadPause(t *testing.T) {
+	data := make([]byte, 3*64)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	var mu sync.Mutex
+	stall := true
+	aborted := make(chan struct{}, 3)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		stalled := stall && r.Header.Get("Range") != "bytes=0-63"
+		mu.Unlock()
+		if stalled {
+			// hang until the download is paused
+			<-r.Context().Done()
+			aborted <- struct{}{}
+			return
+		}
+		http.ServeContent(w, r, "file", time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+
+	events := make(chan EventType, 10)
+	var pauseChanges []bool
+	// nothing listens there, so the peer is only dialed
+	announced := []peers.Peer{{IP: net.IP{127, 0, 0, 1}, Port: 1}}
+	torrent := Torrent{
+		PieceLength: 64,
+		Length:      len(data),
+		Name:        "file",
+		WebSeeds:    []string{server.URL + "/file"},
+		Control:     NewControl(),
+		OnEvent: func(e Event) {
+			events <- e.Type
+		},
+		OnPauseChange: func(ctx context.Context, paused bool) []peers.Peer {
+			pauseChanges = append(pauseChanges, paused)
+			return announced
+		},
+	}
+	for i := 0; i < 3; i++ {
+		torrent.PieceHashes = append(torrent.PieceHashes, sha1.Sum(data[i*64:(i+1)*64]))
+	}
+
+	done := make(chan []byte)
+	go func() {
+		buf, err := torrent.Download(context.Background())
+		assert.Nil(t, err)
+		done <- buf
+	}()
+	assert.Equal(t, EventPieceVerified, <-events)
+	torrent.Control.Pause()
+	assert.True(t, torrent.Control.Paused())
+	assert.Equal(t, EventPaused, <-events)
+	// the seed is disconnected
+	<-aborted
+
+	mu.Lock()
+	stall = false
+	mu.Unlock()
+	torrent.Control.Resume()
+	assert.Equal(t, data, <-done)
+	assert.Equal(t, []EventType{EventResumed, EventPieceVerified, EventPieceVerified, EventCompleted}, []EventType{<-events, <-events, <-events, <-events})
+	// the workers started on resume use the peers returned
+	assert.Equal(t, []bool{true, false}, pauseChanges)
+	assert.Equal(t, announced, torrent.Peers)
+}
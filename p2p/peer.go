@@ -0,0 +1,250 @@
+package p2p
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/sjaensch/storrent/client"
+	"github.com/sjaensch/storrent/handshake"
+	"github.com/sjaensch/storrent/message"
+	"github.com/sjaensch/storrent/peers"
+)
+
+// peerTimeout is how long a peer may take to send the next block we're
+// waiting for. Dropping unresponsive peers frees their blocks for others.
+const peerTimeout = 30 * time.Second
+
+// peerDownload downloads blocks from a single peer. Blocks are assigned by
+// the scheduler, possibly from several pieces at once, and requested before
+// the previous ones arrived, so that the pipeline doesn't drain between
+// pieces. Messages are read and written by their own goroutines, so that
+// neither blocks the other.
+type peerDownload struct {
+	client    *client.Client
+	sched     *scheduler
+	stats     *Stats
+	peerStats *peerStats
+	pipeline  *pipeline
+	requests  map[blockRequest]time.Time // outstanding requests and when they were sent
+	lastBlock time.Time                  // when the last requested block arrived
+
+	incoming chan *message.Message
+	outgoing chan *message.Message
+	errs     chan error    // errors of the reader and writer goroutines
+	quit     chan struct{} // closed when the download from the peer ends
+}
+
+func newPeerDownload(c *client.Client, sched *scheduler, stats *Stats) *peerDownload {
+	return &peerDownload{
+		client:    c,
+		sched:     sched,
+		stats:     stats,
+		peerStats: stats.addPeer(c),
+		pipeline:  newPipeline(c.Reqq, time.Now()),
+		requests:  make(map[blockRequest]time.Time),
+		incoming:  make(chan *message.Message),
+		outgoing:  make(chan *message.Message, defaultMaxPipelineDepth),
+		errs:      make(chan error, 2),
+		quit:      make(chan struct{}),
+	}
+}
+
+func (d *peerDownload) readMessages() {
+	for {
+		msg, err := d.client.Read()
+		if err != nil {
+			d.errs <- err
+			return
+		}
+		select {
+		case d.incoming <- msg:
+		case <-d.quit:
+			return
+		}
+	}
+}
+
+func (d *peerDownload) writeMessages() {
+	for msg := range d.outgoing {
+		_, err := d.client.Conn.Write(msg.Serialize())
+		if err != nil {
+			d.errs <- err
+			// keep draining, so sending to outgoing never blocks
+			for range d.outgoing {
+			}
+			return
+		}
+	}
+}
+
+// run downloads blocks until all pieces are complete or the connection
+// fails. Outstanding requests are given back to the scheduler.
+func (d *peerDownload) run(ctx context.Context) error {
+	go d.readMessages()
+	go d.writeMessages()
+	defer func() {
+		close(d.quit)
+		close(d.outgoing)
+		d.sched.release(d.outstanding())
+		d.stats.removePeer(d.peerStats)
+	}()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		// get the update channel before asking for blocks, so that blocks
+		// which become free in between aren't missed
+		update := d.sched.updated()
+		if !d.client.Choked {
+			err := d.fillPipeline(ctx)
+			if err != nil {
+				return err
+			}
+		}
+
+		select {
+		case msg := <-d.incoming:
+			err := d.handleMessage(ctx, msg)
+			if err != nil {
+				return err
+			}
+		case err := <-d.errs:
+			return err
+		case <-update:
+		case <-d.sched.done:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		case now := <-ticker.C:
+			if len(d.requests) > 0 && now.Sub(d.lastBlock) > peerTimeout {
+				return fmt.Errorf("No block received for %s", peerTimeout)
+			}
+		}
+	}
+}
+
+// send queues msg for the writer. It gives up once ctx is done, as a peer
+// that stops reading blocks the writer and fills the queue.
+func (d *peerDownload) send(ctx context.Context, msg *message.Message) error {
+	select {
+	case d.outgoing <- msg:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// fillPipeline requests blocks from the scheduler until there are as many
+// outstanding as the pipeline's depth
+func (d *peerDownload) fillPipeline(ctx context.Context) error {
+	n := d.pipeline.depth - len(d.requests)
+	if n <= 0 {
+		return nil
+	}
+	now := time.Now()
+	if len(d.requests) == 0 {
+		// the peer can only be late once we wait for something
+		d.lastBlock = now
+	}
+	for _, b := range d.sched.assign(d.client.Bitfield, n) {
+		// assigned blocks are outstanding, so that they are released even
+		// if sending fails
+		d.requests[b] = now
+		err := d.send(ctx, message.FormatRequest(b.index, b.begin, b.length))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *peerDownload) outstanding() []blockRequest {
+	var blocks []blockRequest
+	for b := range d.requests {
+		blocks = append(blocks, b)
+	}
+	return blocks
+}
+
+func (d *peerDownload) handleMessage(ctx context.Context, msg *message.Message) error {
+	if msg == nil { // keep-alive
+		return nil
+	}
+	err := d.client.UpdateState(msg)
+	if err != nil {
+		return err
+	}
+
+	switch msg.ID {
+	case message.MsgChoke:
+		// a choking peer discards our requests, so others may have them
+		d.sched.release(d.outstanding())
+		d.requests = make(map[blockRequest]time.Time)
+	case message.MsgExtended:
+		err := d.client.HandleExtended(msg)
+		if err != nil {
+			return err
+		}
+		d.pipeline.setReqq(d.client.Reqq)
+	case message.MsgPiece:
+		return d.receiveBlock(ctx, msg)
+	}
+	return nil
+}
+
+func (d *peerDownload) receiveBlock(ctx context.Context, msg *message.Message) error {
+	index, begin, err := message.ParsePieceHeader(msg)
+	if err != nil {
+		return err
+	}
+	b := blockRequest{index, begin, len(msg.Payload) - 8}
+	sent, ok := d.requests[b]
+	if !ok {
+		return nil // not requested, or given back after a choke
+	}
+	delete(d.requests, b)
+
+	now := time.Now()
+	d.pipeline.blockReceived(b.length, now.Sub(sent), now)
+	d.lastBlock = now
+	complete, err := d.sched.received(b, msg)
+	if err != nil {
+		return err
+	}
+	if complete {
+		d.stats.pieceCompleted(d.peerStats)
+		return d.send(ctx, message.FormatHave(index))
+	}
+	return nil
+}
+
+func (t *Torrent) startDownloadWorker(ctx context.Context, peer peers.Peer, sched *scheduler) {
+	req := handshake.New(t.InfoHash, t.PeerID)
+	req.SetExtensionProtocol()
+	if t.PiecesV2 != nil {
+		req.SetV2()
+	}
+	c, err := client.Dial(ctx, peer, req)
+	if err != nil {
+		log.Printf("Could not handshake with %s. Disconnecting\n", peer.IP)
+		return
+	}
+	defer c.Conn.Close()
+	log.Printf("Completed handshake with %s\n", peer.IP)
+	t.OnEvent.Emit(Event{Type: EventPeerConnected, Peer: peer.String()})
+	c.SetLimits(t.DownloadLimit, t.UploadLimit)
+
+	if c.Extensions {
+		c.SendExtendedHandshake(&client.ExtendedHandshake{V: "storrent"})
+	}
+	c.SendUnchoke()
+	c.SendInterested()
+
+	err = newPeerDownload(c, sched, t.Stats).run(ctx)
+	if err != nil {
+		log.Println("Exiting", err)
+	}
+	t.OnEvent.Emit(Event{Type: EventPeerDisconnected, Peer: peer.String(), Err: err})
+}
@@ -0,0 +1,88 @@
+package p2p
+
+import "time"
+
+const (
+	// initialPipelineDepth is the number of outstanding requests before
+	// anything has been measured
+	initialPipelineDepth = 5
+	minPipelineDepth     = 2
+	// defaultMaxPipelineDepth caps the depth, also for peers that tell us a
+	// larger reqq. It is libtorrent's default, as mentioned in BEP 10.
+	defaultMaxPipelineDepth = 250
+	// rateInterval is how often the download rate is sampled
+	rateInterval = time.Second
+)
+
+// pipeline decides how many requests to keep outstanding with a peer. The
+// depth is twice the bandwidth-delay product of the connection, measured
+// from the download rate and the lowest latency of a request. As long as
+// the depth limits the rate, this grows the depth with every sample, until
+// the connection is saturated or the peer's limit is reached.
+type pipeline struct {
+	depth    int
+	maxDepth int
+	rate     float64       // bytes per second, moving average
+	latency  time.Duration // lowest time from request to block, queueing only adds to it
+
+	sampleStart time.Time
+	sampleBytes int
+}
+
+func newPipeline(reqq int, now time.Time) *pipeline {
+	p := &pipeline{
+		depth:       initialPipelineDepth,
+		maxDepth:    defaultMaxPipelineDepth,
+		sampleStart: now,
+	}
+	p.setReqq(reqq)
+	return p
+}
+
+// setReqq limits the depth to the number of requests the peer accepts, 0
+// meaning unknown. Peers can't raise it above defaultMaxPipelineDepth, which
+// is as many messages as are buffered for sending.
+func (p *pipeline) setReqq(reqq int) {
+	if reqq <= 0 {
+		return
+	}
+	p.maxDepth = reqq
+	if p.maxDepth > defaultMaxPipelineDepth {
+		p.maxDepth = defaultMaxPipelineDepth
+	}
+	if p.maxDepth < minPipelineDepth {
+		p.maxDepth = minPipelineDepth
+	}
+	if p.depth > p.maxDepth {
+		p.depth = p.maxDepth
+	}
+}
+
+// blockReceived records a block of n bytes, which arrived latency after it
+// was requested
+func (p *pipeline) blockReceived(n int, latency time.Duration, now time.Time) {
+	if p.latency == 0 || latency < p.latency {
+		p.latency = latency
+	}
+	p.sampleBytes += n
+	elapsed := now.Sub(p.sampleStart)
+	if elapsed < rateInterval {
+		return
+	}
+	rate := float64(p.sampleBytes) / elapsed.Seconds()
+	if p.rate == 0 {
+		p.rate = rate
+	} else {
+		p.rate = (p.rate + rate) / 2
+	}
+	p.sampleStart = now
+	p.sampleBytes = 0
+
+	p.depth = int(2*p.rate*p.latency.Seconds()/MaxBlockSize) + 1
+	if p.depth < minPipelineDepth {
+		p.depth = minPipelineDepth
+	}
+	if p.depth > p.maxDepth {
+		p.depth = p.maxDepth
+	}
+}
@@ -0,0 +1,56 @@
+package p2p
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPipelineDepth(t *testing.T) {
+	start := time.Unix(1000, 0)
+	latency := 100 * time.Millisecond
+
+	// a fast peer whose rate is only limited by the depth
+	p := newPipeline(0, start)
+	assert.Equal(t, initialPipelineDepth, p.depth)
+	now := start
+	previous := p.depth
+	for i := 0; i < 10; i++ {
+		// depth blocks per latency
+		now = now.Add(rateInterval)
+		p.blockReceived(p.depth*MaxBlockSize*int(rateInterval/latency), latency, now)
+		assert.True(t, p.depth > previous || p.depth == defaultMaxPipelineDepth, "depth %d after %d", p.depth, previous)
+		previous = p.depth
+	}
+	assert.Equal(t, defaultMaxPipelineDepth, p.depth)
+
+	// the peer's reqq is a hard limit
+	p.setReqq(40)
+	assert.Equal(t, 40, p.depth)
+	p.blockReceived(100*MaxBlockSize, latency, now.Add(rateInterval))
+	assert.Equal(t, 40, p.depth)
+
+	// but can't exceed the default
+	p.setReqq(1000000000)
+	assert.Equal(t, defaultMaxPipelineDepth, p.maxDepth)
+
+	// a slow peer, 4 blocks per second at 100ms latency
+	p = newPipeline(0, start)
+	now = start
+	for i := 0; i < 10; i++ {
+		now = now.Add(rateInterval)
+		p.blockReceived(4*MaxBlockSize, latency, now)
+	}
+	assert.Equal(t, minPipelineDepth, p.depth)
+
+	// the depth only changes once per interval
+	p = newPipeline(0, start)
+	p.blockReceived(MaxBlockSize, latency, start.Add(rateInterval/2))
+	assert.Equal(t, initialPipelineDepth, p.depth)
+
+	// 12.5 MiB/s with 20ms latency make a bandwidth-delay product of 16 blocks
+	p = newPipeline(0, start)
+	p.blockReceived(800*MaxBlockSize, 20*time.Millisecond, start.Add(rateInterval))
+	assert.Equal(t, 2*16+1, p.depth)
+}
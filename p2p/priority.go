@@ -0,0 +1,48 @@
+package p2p
+
+import "fmt"
+
+// Priority determines whether and in which order pieces are downloaded.
+// Pieces with a higher priority are queued first. The zero value is
+// PriorityNormal.
+type Priority int
+
+// Piece and file priorities
+const (
+	PrioritySkip   Priority = -2
+	PriorityLow    Priority = -1
+	PriorityNormal Priority = 0
+	PriorityHigh   Priority = 1
+)
+
+var priorityNames = map[Priority]string{
+	PrioritySkip:   "skip",
+	PriorityLow:    "low",
+	PriorityNormal: "normal",
+	PriorityHigh:   "high",
+}
+
+func (p Priority) String() string {
+	if name, ok := priorityNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("Priority(%d)", int(p))
+}
+
+// ParsePriority returns the priority with the given name
+func ParsePriority(name string) (Priority, error) {
+	for p, n := range priorityNames {
+		if n == name {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown priority %q", name)
+}
+
+// piecePriority returns the priority of the piece at index
+func (t *Torrent) piecePriority(index int) Priority {
+	if index < len(t.PiecePriorities) {
+		return t.PiecePriorities[index]
+	}
+	return PriorityNormal
+}
@@ -0,0 +1,18 @@
+package p2p
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePriority(t *testing.T) {
+	for _, p := range []Priority{PrioritySkip, PriorityLow, PriorityNormal, PriorityHigh} {
+		parsed, err := ParsePriority(p.String())
+		assert.Nil(t, err)
+		assert.Equal(t, p, parsed)
+	}
+	_, err := ParsePriority("urgent")
+	assert.NotNil(t, err)
+	assert.Equal(t, "Priority(7)", Priority(7).String())
+}
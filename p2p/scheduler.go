@@ -0,0 +1,251 @@
+package p2p
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/sjaensch/storrent/bitfield"
+	"github.com/sjaensch/storrent/message"
+)
+
+// blockRequest is a block of a piece, requested from a peer at once
+type blockRequest struct {
+	index  int
+	begin  int
+	length int
+}
+
+type blockState uint8
+
+const (
+	blockFree blockState = iota
+	blockRequested
+	blockReceived
+)
+
+// schedPiece is a wanted piece and which of its blocks are there
+type schedPiece struct {
+	work    *pieceWork
+	buf     []byte       // allocated when the piece is started
+	blocks  []blockState // nil unless the piece is started
+	missing int          // number of blocks that haven't been received
+}
+
+func (p *schedPiece) start() {
+	// padding is left zeroed
+	length := p.work.length - p.work.padding
+	p.buf = make([]byte, p.work.length)
+	p.blocks = make([]blockState, (length+MaxBlockSize-1)/MaxBlockSize)
+	p.missing = len(p.blocks)
+}
+
+func (p *schedPiece) block(i int) blockRequest {
+	begin := i * MaxBlockSize
+	length := MaxBlockSize
+	// Last block might be shorter than the typical block
+	if rest := p.work.length - p.work.padding - begin; rest < length {
+		length = rest
+	}
+	return blockRequest{p.work.index, begin, length}
+}
+
+// scheduler hands out the blocks of the wanted pieces to peers and the
+// pieces to HTTP seeds. It collects the blocks, verifies pieces once all
+// their blocks are there and sends them to results.
+type scheduler struct {
+	mu        sync.Mutex
+	queue     []*schedPiece // pieces that haven't been started, in the order to start them
+	started   []*schedPiece // pieces with blocks requested or received
+	remaining int           // number of pieces that aren't complete
+	results   chan *pieceResult
+	onEvent   EventHandler
+	ctx       context.Context
+	update    chan struct{} // closed and replaced when blocks or pieces become free
+	done      chan struct{} // closed when all pieces are complete
+}
+
+// newScheduler creates a scheduler for the pieces, which are started in the
+// given order. Pieces failing the integrity check are reported to onEvent.
+// Once ctx is done, complete pieces are no longer sent to results.
+func newScheduler(ctx context.Context, pieces []*pieceWork, results chan *pieceResult, onEvent EventHandler) *scheduler {
+	s := &scheduler{
+		remaining: len(pieces),
+		results:   results,
+		onEvent:   onEvent,
+		ctx:       ctx,
+		update:    make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	for _, pw := range pieces {
+		s.queue = append(s.queue, &schedPiece{work: pw})
+	}
+	if s.remaining == 0 {
+		close(s.done)
+	}
+	return s
+}
+
+// updated returns a channel that is closed the next time blocks or pieces
+// become free, e.g. because a peer disconnected. Get it before asking for
+// work, so no update is missed.
+func (s *scheduler) updated() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.update
+}
+
+// notify wakes up everyone waiting for work. s.mu must be held.
+func (s *scheduler) notify() {
+	close(s.update)
+	s.update = make(chan struct{})
+}
+
+// assign hands out up to n free blocks of pieces the peer has. Blocks of
+// started pieces come first, so that pieces complete quickly, possibly with
+// blocks from several peers. Then pieces are started in order.
+func (s *scheduler) assign(have bitfield.Bitfield, n int) []blockRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var blocks []blockRequest
+	for _, p := range s.started {
+		if len(blocks) == n {
+			return blocks
+		}
+		if have.HasPiece(p.work.index) {
+			blocks = s.assignBlocks(p, blocks, n)
+		}
+	}
+	for i := 0; i < len(s.queue) && len(blocks) < n; {
+		p := s.queue[i]
+		if !have.HasPiece(p.work.index) {
+			i++
+			continue
+		}
+		s.queue = append(s.queue[:i], s.queue[i+1:]...)
+		p.start()
+		s.started = append(s.started, p)
+		blocks = s.assignBlocks(p, blocks, n)
+	}
+	return blocks
+}
+
+func (s *scheduler) assignBlocks(p *schedPiece, blocks []blockRequest, n int) []blockRequest {
+	for i, state := range p.blocks {
+		if len(blocks) == n {
+			break
+		}
+		if state == blockFree {
+			p.blocks[i] = blockRequested
+			blocks = append(blocks, p.block(i))
+		}
+	}
+	return blocks
+}
+
+func (s *scheduler) startedPiece(index int) *schedPiece {
+	for _, p := range s.started {
+		if p.work.index == index {
+			return p
+		}
+	}
+	return nil
+}
+
+// release makes blocks that won't be received free again, e.g. when a peer
+// chokes us or disconnects
+func (s *scheduler) release(blocks []blockRequest) {
+	if len(blocks) == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, b := range blocks {
+		p := s.startedPiece(b.index)
+		if p != nil && p.blocks[b.begin/MaxBlockSize] == blockRequested {
+			p.blocks[b.begin/MaxBlockSize] = blockFree
+		}
+	}
+	s.notify()
+}
+
+// received stores the block of a PIECE message. If it completes the piece,
+// the piece is verified and sent to results, and true is returned.
+func (s *scheduler) received(b blockRequest, msg *message.Message) (bool, error) {
+	s.mu.Lock()
+	p := s.startedPiece(b.index)
+	if p == nil || p.blocks[b.begin/MaxBlockSize] != blockRequested {
+		s.mu.Unlock()
+		return false, fmt.Errorf("Block %d of piece #%d was not requested", b.begin/MaxBlockSize, b.index)
+	}
+	n, err := message.ParsePiece(b.index, p.buf, msg)
+	if err == nil && n != b.length {
+		err = fmt.Errorf("Expected block of length %d, got %d", b.length, n)
+	}
+	if err != nil {
+		p.blocks[b.begin/MaxBlockSize] = blockFree
+		s.notify()
+		s.mu.Unlock()
+		return false, err
+	}
+	p.blocks[b.begin/MaxBlockSize] = blockReceived
+	p.missing--
+	if p.missing > 0 {
+		s.mu.Unlock()
+		return false, nil
+	}
+	for i := range s.started {
+		if s.started[i] == p {
+			s.started = append(s.started[:i], s.started[i+1:]...)
+			break
+		}
+	}
+	s.mu.Unlock()
+
+	// no one writes to a complete piece, so it's verified without the lock
+	err = checkIntegrity(p.work, p.buf)
+	if err != nil {
+		log.Printf("Piece #%d failed integrity check\n", p.work.index)
+		s.onEvent.Emit(Event{Type: EventPieceFailed, Piece: p.work.index, Err: err})
+		s.releasePiece(p.work)
+		return false, nil
+	}
+	s.complete(p.work, p.buf)
+	return true, nil
+}
+
+// claimPiece takes a piece that hasn't been started, to be fetched as a
+// whole. nil is returned if there is none.
+func (s *scheduler) claimPiece() *pieceWork {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.queue) == 0 {
+		return nil
+	}
+	p := s.queue[0]
+	s.queue = s.queue[1:]
+	return p.work
+}
+
+// releasePiece returns a claimed or failed piece to the front of the queue
+func (s *scheduler) releasePiece(pw *pieceWork) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queue = append([]*schedPiece{{work: pw}}, s.queue...)
+	s.notify()
+}
+
+// complete sends a verified piece to results
+func (s *scheduler) complete(pw *pieceWork, buf []byte) {
+	s.mu.Lock()
+	s.remaining--
+	if s.remaining == 0 {
+		close(s.done)
+	}
+	s.mu.Unlock()
+	select {
+	case s.results <- &pieceResult{pw.index, buf}:
+	case <-s.ctx.Done():
+	}
+}
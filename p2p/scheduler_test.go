@@ -0,0 +1,93 @@
+package p2p
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"testing"
+
+	"github.com/sjaensch/storrent/bitfield"
+	"github.com/sjaensch/storrent/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func pieceMessage(b blockRequest, data []byte) *message.Message {
+	payload := make([]byte, 8+b.length)
+	binary.BigEndian.PutUint32(payload[0:4], uint32(b.index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(b.begin))
+	copy(payload[8:], data[b.begin:b.begin+b.length])
+	return &message.Message{ID: message.MsgPiece, Payload: payload}
+}
+
+func TestScheduler(t *testing.T) {
+	pieceLength := 2*MaxBlockSize + 100
+	data := make([][]byte, 2)
+	var pieces []*pieceWork
+	for i := range data {
+		data[i] = make([]byte, pieceLength)
+		data[i][0] = byte(i + 1)
+		pieces = append(pieces, &pieceWork{index: i, hash: sha1.Sum(data[i]), length: pieceLength})
+	}
+	results := make(chan *pieceResult, 2)
+	var events []Event
+	s := newScheduler(context.Background(), pieces, results, func(e Event) { events = append(events, e) })
+	both := bitfield.Bitfield{0xc0}
+	first := bitfield.Bitfield{0x80}
+
+	// two peers share the blocks of the first piece
+	blocksA := s.assign(both, 2)
+	assert.Equal(t, []blockRequest{{0, 0, MaxBlockSize}, {0, MaxBlockSize, MaxBlockSize}}, blocksA)
+	blocksB := s.assign(first, 5)
+	assert.Equal(t, []blockRequest{{0, 2 * MaxBlockSize, 100}}, blocksB)
+	for _, b := range append(blocksA, blocksB...) {
+		complete, err := s.received(b, pieceMessage(b, data[0]))
+		require.Nil(t, err)
+		assert.Equal(t, b == blocksB[0], complete)
+	}
+	res := <-results
+	assert.Equal(t, 0, res.index)
+	assert.Equal(t, data[0], res.buf)
+
+	// blocks that weren't requested are rejected
+	_, err := s.received(blocksA[0], pieceMessage(blocksA[0], data[0]))
+	assert.NotNil(t, err)
+
+	// released blocks are handed out again
+	update := s.updated()
+	blocksA = s.assign(both, 1)
+	assert.Equal(t, []blockRequest{{1, 0, MaxBlockSize}}, blocksA)
+	assert.Empty(t, s.assign(first, 1))
+	s.release(blocksA)
+	assert.Equal(t, blocksA, s.assign(both, 1))
+	select {
+	case <-update:
+	default:
+		assert.Fail(t, "release did not notify")
+	}
+
+	// a piece that fails the integrity check is queued again
+	blocksA = append(blocksA, s.assign(both, 5)...)
+	require.Len(t, blocksA, 3)
+	for _, b := range blocksA {
+		complete, err := s.received(b, pieceMessage(b, data[0]))
+		require.Nil(t, err)
+		assert.False(t, complete)
+	}
+	require.Len(t, events, 1)
+	assert.Equal(t, EventPieceFailed, events[0].Type)
+	assert.Equal(t, 1, events[0].Piece)
+	pw := s.claimPiece()
+	require.NotNil(t, pw)
+	assert.Equal(t, 1, pw.index)
+	assert.Nil(t, s.claimPiece())
+
+	s.complete(pw, data[1])
+	res = <-results
+	assert.Equal(t, 1, res.index)
+	select {
+	case <-s.done:
+	default:
+		assert.Fail(t, "scheduler is not done")
+	}
+}
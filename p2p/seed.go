@@ -0,0 +1,73 @@
+package p2p
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// seedTimeout limits how long fetching a single piece from an HTTP seed may take
+const seedTimeout = 60 * time.Second
+
+// Failing HTTP seeds are retried after seedMinBackoff, doubling the delay
+// with every failure in a row up to seedMaxBackoff
+const seedMinBackoff = 5 * time.Second
+const seedMaxBackoff = 5 * time.Minute
+
+// fetchPieceFunc downloads a piece from a seed. If the seed asks us to come
+// back later, the error is accompanied by the time to wait.
+type fetchPieceFunc func(ctx context.Context, pw *pieceWork) (buf []byte, retryAfter time.Duration, err error)
+
+// runSeedWorker claims whole pieces from the scheduler and fetches them
+// from a server until ctx is done. Failing servers are backed off.
+func runSeedWorker(ctx context.Context, seed string, fetch fetchPieceFunc, sched *scheduler) {
+	backoff := seedMinBackoff
+	for {
+		update := sched.updated()
+		pw := sched.claimPiece()
+		if pw == nil {
+			// wait for a piece to become free again
+			select {
+			case <-update:
+				continue
+			case <-sched.done:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		buf, retryAfter, err := fetch(ctx, pw)
+		if ctx.Err() != nil {
+			sched.releasePiece(pw)
+			return
+		}
+		if err == nil {
+			err = checkIntegrity(pw, buf)
+			if err != nil {
+				sched.onEvent.Emit(Event{Type: EventPieceFailed, Peer: seed, Piece: pw.index, Err: err})
+			}
+		}
+		if err != nil {
+			delay := backoff
+			if retryAfter > 0 {
+				delay = retryAfter
+			} else {
+				backoff *= 2
+				if backoff > seedMaxBackoff {
+					backoff = seedMaxBackoff
+				}
+			}
+			log.Printf("Downloading piece #%d from %s failed, retrying in %s: %v\n", pw.index, seed, delay, err)
+			sched.releasePiece(pw)
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+		backoff = seedMinBackoff
+		sched.complete(pw, buf)
+	}
+}
@@ -0,0 +1,157 @@
+package p2p
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sjaensch/storrent/client"
+	"github.com/sjaensch/storrent/ratelimit"
+)
+
+// PeerStats is a snapshot of the statistics of a connected peer
+type PeerStats struct {
+	client.Stats
+	PiecesCompleted int // pieces whose last block came from the peer
+}
+
+// TorrentStats is a snapshot of the statistics of a torrent's download
+type TorrentStats struct {
+	Downloaded   int64   // bytes from peers, including protocol overhead, and from HTTP seeds
+	Uploaded     int64   // bytes to peers
+	DownloadRate float64 // bytes per second over the last seconds
+	UploadRate   float64 // bytes per second over the last seconds
+	NumPieces    int
+	PiecesWanted int // pieces that aren't skipped
+	PiecesDone   int
+	Peers        []PeerStats // connected peers
+	Elapsed      time.Duration
+}
+
+type peerStats struct {
+	client          *client.Client
+	piecesCompleted int
+}
+
+// Stats collects the statistics of a torrent's download. Snapshot can be
+// called from any goroutine while downloading. A nil Stats collects nothing.
+type Stats struct {
+	mu           sync.Mutex
+	started      time.Time
+	numPieces    int
+	piecesWanted int
+	piecesDone   int
+	peers        []*peerStats
+	// bytes of peers that are gone
+	closedDownloaded int64
+	closedUploaded   int64
+	seeds            *ratelimit.Meter
+}
+
+// NewStats creates an empty Stats, to be passed to Torrent
+func NewStats() *Stats {
+	return &Stats{seeds: ratelimit.NewMeter()}
+}
+
+// Snapshot returns the current statistics
+func (s *Stats) Snapshot() TorrentStats {
+	if s == nil {
+		return TorrentStats{}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := TorrentStats{
+		Downloaded:   s.closedDownloaded + s.seeds.Total(),
+		Uploaded:     s.closedUploaded,
+		DownloadRate: s.seeds.Rate(),
+		NumPieces:    s.numPieces,
+		PiecesWanted: s.piecesWanted,
+		PiecesDone:   s.piecesDone,
+		Peers:        []PeerStats{},
+	}
+	if !s.started.IsZero() {
+		stats.Elapsed = time.Since(s.started)
+	}
+	for _, p := range s.peers {
+		peer := PeerStats{Stats: p.client.Stats(), PiecesCompleted: p.piecesCompleted}
+		stats.Downloaded += peer.Downloaded
+		stats.Uploaded += peer.Uploaded
+		stats.DownloadRate += peer.DownloadRate
+		stats.UploadRate += peer.UploadRate
+		stats.Peers = append(stats.Peers, peer)
+	}
+	return stats
+}
+
+func (s *Stats) start(numPieces, piecesWanted int) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.started = time.Now()
+	s.numPieces = numPieces
+	s.piecesWanted = piecesWanted
+}
+
+func (s *Stats) numPeers() int {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.peers)
+}
+
+func (s *Stats) addPeer(c *client.Client) *peerStats {
+	p := &peerStats{client: c}
+	if s == nil {
+		return p
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.peers = append(s.peers, p)
+	return p
+}
+
+// removePeer keeps the bytes of a disconnected peer in the totals
+func (s *Stats) removePeer(p *peerStats) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.peers {
+		if s.peers[i] == p {
+			s.peers = append(s.peers[:i], s.peers[i+1:]...)
+			break
+		}
+	}
+	stats := p.client.Stats()
+	s.closedDownloaded += stats.Downloaded
+	s.closedUploaded += stats.Uploaded
+}
+
+func (s *Stats) pieceCompleted(p *peerStats) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p.piecesCompleted++
+}
+
+func (s *Stats) pieceDone() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.piecesDone++
+}
+
+func (s *Stats) seedDownloaded(n int) {
+	if s == nil {
+		return
+	}
+	s.seeds.Add(n)
+}
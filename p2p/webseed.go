@@ -0,0 +1,134 @@
+package p2p
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sjaensch/storrent/ratelimit"
+)
+
+// fileRange is a byte range within a single file of a web seed
+type fileRange struct {
+	url   string // empty for padding, which is not fetched
+	begin int    // offset within the file
+	end   int
+}
+
+// webSeedURL returns the URL of a file on a web seed (BEP 19). components
+// is the path of the file within a multi-file torrent, starting with the
+// name of the torrent, or just the name for single-file torrents.
+func webSeedURL(seed string, components []string, multiFile bool) string {
+	if !multiFile && !strings.HasSuffix(seed, "/") {
+		// the URL points directly at the file
+		return seed
+	}
+	escaped := make([]string, len(components))
+	for i, component := range components {
+		escaped[i] = url.PathEscape(component)
+	}
+	if !strings.HasSuffix(seed, "/") {
+		seed += "/"
+	}
+	return seed + strings.Join(escaped, "/")
+}
+
+// webSeedRanges maps the byte range [begin, end) of the torrent data to the
+// files of the web seed
+func (t *Torrent) webSeedRanges(seed string, begin, end int) []fileRange {
+	if len(t.Files) == 0 {
+		return []fileRange{{webSeedURL(seed, []string{t.Name}, false), begin, end}}
+	}
+
+	var ranges []fileRange
+	offset := 0
+	for _, file := range t.Files {
+		fileBegin, fileEnd := offset, offset+file.Length
+		offset = fileEnd
+		if fileEnd <= begin || fileBegin >= end || file.Length == 0 {
+			continue
+		}
+		components := append(strings.Split(filepath.ToSlash(file.Path), "/"), file.Name)
+		r := fileRange{
+			begin: 0,
+			end:   file.Length,
+		}
+		if !file.Padding {
+			r.url = webSeedURL(seed, components, true)
+		}
+		if begin > fileBegin {
+			r.begin = begin - fileBegin
+		}
+		if end < fileEnd {
+			r.end = end - fileBegin
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges
+}
+
+// fetchRange reads the range r of a file on a web seed into buf, as fast as
+// limit allows
+func fetchRange(ctx context.Context, c *http.Client, r fileRange, buf []byte, limit *ratelimit.Limiter) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", r.url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", r.begin, r.end-1))
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent:
+	case resp.StatusCode == http.StatusOK && r.begin == 0:
+		// the server ignored the range, but the data we need comes first
+	default:
+		return fmt.Errorf("Web seed %s returned status %s", r.url, resp.Status)
+	}
+	_, err = io.ReadFull(ratelimit.Reader(resp.Body, limit), buf)
+	return err
+}
+
+// downloadPieceFromWebSeed fetches a piece from a web seed, which may take
+// several requests if the piece spans multiple files
+func (t *Torrent) downloadPieceFromWebSeed(ctx context.Context, c *http.Client, seed string, pw *pieceWork) ([]byte, error) {
+	buf := make([]byte, pw.length)
+	begin := pw.index * t.PieceLength
+	offset := 0
+	for _, r := range t.webSeedRanges(seed, begin, begin+pw.length) {
+		n := r.end - r.begin
+		if r.url != "" {
+			err := fetchRange(ctx, c, r, buf[offset:offset+n], t.DownloadLimit)
+			if err != nil {
+				return nil, err
+			}
+		}
+		offset += n
+	}
+	if offset != pw.length {
+		return nil, fmt.Errorf("Web seed %s has no data for piece #%d", seed, pw.index)
+	}
+	t.Stats.seedDownloaded(len(buf))
+	return buf, nil
+}
+
+func (t *Torrent) startWebSeedWorker(ctx context.Context, seed string, sched *scheduler) {
+	if !strings.HasPrefix(seed, "http://") && !strings.HasPrefix(seed, "https://") {
+		log.Printf("Ignoring web seed %s, only HTTP is supported\n", seed)
+		return
+	}
+	c := &http.Client{Timeout: seedTimeout}
+	runSeedWorker(ctx, seed, func(ctx context.Context, pw *pieceWork) ([]byte, time.Duration, error) {
+		buf, err := t.downloadPieceFromWebSeed(ctx, c, seed, pw)
+		return buf, 0, err
+	}, sched)
+}
@@ -0,0 +1,83 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebSeedURL(t *testing.T) {
+	tests := map[string]struct {
+		seed       string
+		components []string
+		multiFile  bool
+		output     string
+	}{
+		"single file": {
+			seed:       "http://example.com/file.iso",
+			components: []string{"file.iso"},
+			output:     "http://example.com/file.iso",
+		},
+		"single file in directory": {
+			seed:       "http://example.com/isos/",
+			components: []string{"file.iso"},
+			output:     "http://example.com/isos/file.iso",
+		},
+		"multi file": {
+			seed:       "http://example.com/data",
+			components: []string{"torrent", "sub", "a b.txt"},
+			multiFile:  true,
+			output:     "http://example.com/data/torrent/sub/a%20b.txt",
+		},
+	}
+
+	for name, test := range tests {
+		assert.Equal(t, test.output, webSeedURL(test.seed, test.components, test.multiFile), name)
+	}
+}
+
+func TestDownloadPieceFromWebSeed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storrent")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	a := bytes.Repeat([]byte{'a'}, 100)
+	b := bytes.Repeat([]byte{'b'}, 150)
+	require.Nil(t, os.MkdirAll(filepath.Join(dir, "content", "sub"), 0755))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "content", "a.txt"), a, 0644))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "content", "sub", "b.txt"), b, 0644))
+	server := httptest.NewServer(http.FileServer(http.Dir(dir)))
+	defer server.Close()
+
+	data := append(append([]byte{}, a...), b...)
+	torrent := Torrent{
+		PieceLength: 64,
+		Length:      len(data),
+		Name:        "content",
+		Files: []TorrentFile{
+			{Length: 100, Path: "content", Name: "a.txt"},
+			{Length: 150, Path: filepath.Join("content", "sub"), Name: "b.txt"},
+		},
+	}
+	c := &http.Client{}
+	for index := 0; index*torrent.PieceLength < len(data); index++ {
+		begin, end := torrent.calculateBoundsForPiece(index)
+		pw := &pieceWork{index: index, hash: sha1.Sum(data[begin:end]), length: end - begin}
+		buf, err := torrent.downloadPieceFromWebSeed(context.Background(), c, server.URL, pw)
+		require.Nil(t, err)
+		assert.Nil(t, checkIntegrity(pw, buf))
+	}
+
+	torrent.Files[1].Name = "missing.txt"
+	_, err = torrent.downloadPieceFromWebSeed(context.Background(), c, server.URL, &pieceWork{index: 1, length: 64})
+	assert.NotNil(t, err)
+}
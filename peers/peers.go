@@ -15,7 +15,17 @@ type Peer struct {
 
 // Unmarshal parses peer IP addresses and ports from a buffer
 func Unmarshal(peersBin []byte) ([]Peer, error) {
-	const peerSize = 6 // 4 for IP, 2 for port
+	return unmarshal(peersBin, net.IPv4len)
+}
+
+// Unmarshal6 parses IPv6 peer addresses and ports from a buffer, as found in
+// the "peers6" tracker response key and in DHT "values" (BEP 7, BEP 32)
+func Unmarshal6(peersBin []byte) ([]Peer, error) {
+	return unmarshal(peersBin, net.IPv6len)
+}
+
+func unmarshal(peersBin []byte, ipLen int) ([]Peer, error) {
+	peerSize := ipLen + 2 // IP plus 2 bytes for port
 	numPeers := len(peersBin) / peerSize
 	if len(peersBin)%peerSize != 0 {
 		err := fmt.Errorf("Received malformed peers")
@@ -24,12 +34,25 @@ func Unmarshal(peersBin []byte) ([]Peer, error) {
 	peers := make([]Peer, numPeers)
 	for i := 0; i < numPeers; i++ {
 		offset := i * peerSize
-		peers[i].IP = net.IP(peersBin[offset : offset+4])
-		peers[i].Port = binary.BigEndian.Uint16([]byte(peersBin[offset+4 : offset+6]))
+		peers[i].IP = net.IP(peersBin[offset : offset+ipLen])
+		peers[i].Port = binary.BigEndian.Uint16([]byte(peersBin[offset+ipLen : offset+peerSize]))
 	}
 	return peers, nil
 }
 
+// Marshal encodes the peer in compact form: 4 bytes IP and 2 bytes port for
+// IPv4 peers, 16 bytes IP and 2 bytes port for IPv6 peers.
+func (p Peer) Marshal() []byte {
+	ip := p.IP.To4()
+	if ip == nil {
+		ip = p.IP.To16()
+	}
+	buf := make([]byte, len(ip)+2)
+	copy(buf, ip)
+	binary.BigEndian.PutUint16(buf[len(ip):], p.Port)
+	return buf
+}
+
 func (p Peer) String() string {
 	return net.JoinHostPort(p.IP.String(), strconv.Itoa(int(p.Port)))
 }
@@ -53,3 +53,43 @@ func TestString(t *testing.T) {
 		assert.Equal(t, test.output, s)
 	}
 }
+
+func TestUnmarshal6(t *testing.T) {
+	input := []byte{
+		0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x1a, 0xe1,
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x01, 0xbb,
+	}
+	expected := []Peer{
+		{IP: net.ParseIP("2001:db8::1"), Port: 6881},
+		{IP: net.IPv6loopback, Port: 443},
+	}
+	peers, err := Unmarshal6(input)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, peers)
+
+	_, err = Unmarshal6(input[:20])
+	assert.NotNil(t, err)
+}
+
+func TestMarshal(t *testing.T) {
+	tests := []struct {
+		input  Peer
+		output []byte
+	}{
+		{
+			input:  Peer{IP: net.IP{127, 0, 0, 1}, Port: 80},
+			output: []byte{127, 0, 0, 1, 0x00, 0x50},
+		},
+		{
+			input:  Peer{IP: net.ParseIP("127.0.0.1"), Port: 443}, // 16 byte representation
+			output: []byte{127, 0, 0, 1, 0x01, 0xbb},
+		},
+		{
+			input:  Peer{IP: net.IPv6loopback, Port: 6881},
+			output: []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x1a, 0xe1},
+		},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.output, test.input.Marshal())
+	}
+}
@@ -0,0 +1,107 @@
+package ratelimit
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// meterWindow is the number of seconds rates are averaged over
+const meterWindow = 5
+
+// Meter counts bytes and measures their rate over the last seconds. A nil
+// Meter counts nothing.
+type Meter struct {
+	total int64 // accessed atomically
+
+	mu      sync.Mutex
+	buckets [meterWindow + 1]int64 // bytes per second, indexed by the unix second modulo the length
+	second  int64                  // the second of the newest bucket
+
+	now func() time.Time // replaced by tests
+}
+
+// NewMeter creates a meter that hasn't counted anything
+func NewMeter() *Meter {
+	return &Meter{now: time.Now}
+}
+
+// Add counts n bytes
+func (m *Meter) Add(n int) {
+	if m == nil || n <= 0 {
+		return
+	}
+	atomic.AddInt64(&m.total, int64(n))
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	second := m.advance()
+	m.buckets[second%int64(len(m.buckets))] += int64(n)
+}
+
+// Total returns the number of bytes counted
+func (m *Meter) Total() int64 {
+	if m == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&m.total)
+}
+
+// Rate returns the bytes per second over the last complete seconds
+func (m *Meter) Rate() float64 {
+	if m == nil {
+		return 0
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	second := m.advance()
+	var sum int64
+	for i, bytes := range m.buckets {
+		// the current second isn't complete
+		if int64(i) != second%int64(len(m.buckets)) {
+			sum += bytes
+		}
+	}
+	return float64(sum) / meterWindow
+}
+
+// advance clears the buckets of the seconds since the newest bucket and
+// returns the current second. m.mu must be held.
+func (m *Meter) advance() int64 {
+	second := m.now().Unix()
+	if second-m.second >= int64(len(m.buckets)) {
+		m.buckets = [meterWindow + 1]int64{}
+	} else {
+		for s := m.second + 1; s <= second; s++ {
+			m.buckets[s%int64(len(m.buckets))] = 0
+		}
+	}
+	if second > m.second {
+		m.second = second
+	}
+	return m.second
+}
+
+type meteredConn struct {
+	net.Conn
+	download *Meter
+	upload   *Meter
+}
+
+// MeterConn counts the bytes read from conn with download and the bytes
+// written with upload
+func MeterConn(conn net.Conn, download, upload *Meter) net.Conn {
+	return &meteredConn{conn, download, upload}
+}
+
+func (c *meteredConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.download.Add(n)
+	return n, err
+}
+
+func (c *meteredConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.upload.Add(n)
+	return n, err
+}
@@ -0,0 +1,55 @@
+package ratelimit
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMeter(t *testing.T) {
+	now := time.Unix(1000, 0)
+	m := NewMeter()
+	m.now = func() time.Time { return now }
+
+	for i := 0; i < 10; i++ {
+		m.Add(1000)
+		now = now.Add(500 * time.Millisecond)
+	}
+	assert.Equal(t, int64(10000), m.Total())
+	assert.Equal(t, 2000.0, m.Rate())
+
+	// the rate drops as seconds without traffic pass
+	now = now.Add(3 * time.Second)
+	assert.Equal(t, 800.0, m.Rate())
+	now = now.Add(time.Minute)
+	assert.Equal(t, 0.0, m.Rate())
+	assert.Equal(t, int64(10000), m.Total())
+
+	var nilMeter *Meter
+	nilMeter.Add(10)
+	assert.Equal(t, int64(0), nilMeter.Total())
+	assert.Equal(t, 0.0, nilMeter.Rate())
+}
+
+func TestMeterConn(t *testing.T) {
+	download, upload := NewMeter(), NewMeter()
+	client, server := net.Pipe()
+	conn := MeterConn(client, download, upload)
+
+	go func() {
+		server.Write([]byte("hello"))
+		ioutil.ReadAll(server)
+	}()
+	buf := make([]byte, 5)
+	_, err := conn.Read(buf)
+	require.Nil(t, err)
+	_, err = conn.Write([]byte("hi"))
+	require.Nil(t, err)
+	conn.Close()
+	assert.Equal(t, int64(5), download.Total())
+	assert.Equal(t, int64(2), upload.Total())
+}
@@ -0,0 +1,194 @@
+// Package ratelimit limits the bandwidth of connections with token buckets
+// and measures it
+package ratelimit
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// chunkSize is the most a single read or write passes at once. Waiting for
+// small chunks in turn shares a limit fairly between connections.
+const chunkSize = 16 * 1024
+
+// Limiter is a token bucket limiting a rate in bytes per second. A nil
+// Limiter doesn't limit. Limiters can be nested, e.g. per-torrent limiters
+// with a global parent: bytes have to pass both.
+type Limiter struct {
+	parent *Limiter
+
+	mu     sync.Mutex
+	rate   int     // bytes per second, 0 means unlimited
+	tokens float64 // bytes that may pass right away, negative while others wait
+	last   time.Time
+
+	// replaced by tests
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+// New creates a limiter with the given rate in bytes per second, 0 meaning
+// unlimited. parent may be nil.
+func New(rate int, parent *Limiter) *Limiter {
+	l := &Limiter{
+		parent: parent,
+		now:    time.Now,
+		sleep:  time.Sleep,
+	}
+	l.SetRate(rate)
+	return l
+}
+
+// SetRate changes the rate, 0 meaning unlimited. It can be called while
+// connections are being limited.
+func (l *Limiter) SetRate(rate int) {
+	if rate < 0 {
+		rate = 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = rate
+	// start with a full bucket, which holds a second's worth of bytes
+	l.tokens = float64(rate)
+	l.last = l.now()
+}
+
+// Rate returns the rate in bytes per second, 0 meaning unlimited
+func (l *Limiter) Rate() int {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// WaitN blocks until n bytes may pass. Callers are served in the order they
+// called, so connections sharing a limiter get their fair share.
+func (l *Limiter) WaitN(n int) {
+	if l == nil {
+		return
+	}
+	l.sleep(l.reserve(n))
+	l.parent.WaitN(n)
+}
+
+// reserve takes n tokens from the bucket, going into debt if there aren't
+// enough, and returns how long to wait until the debt is paid off
+func (l *Limiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate == 0 {
+		return 0
+	}
+	now := l.now()
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+	if l.tokens > float64(l.rate) {
+		l.tokens = float64(l.rate)
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+}
+
+// Conn limits the reads and writes of a connection
+type Conn struct {
+	net.Conn
+	download *Limiter
+	upload   *Limiter
+}
+
+// NewConn limits reads from conn by download and writes by upload, either
+// of which may be nil
+func NewConn(conn net.Conn, download, upload *Limiter) *Conn {
+	return &Conn{Conn: conn, download: download, upload: upload}
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	if c.download != nil && len(p) > chunkSize {
+		p = p[:chunkSize]
+	}
+	n, err := c.Conn.Read(p)
+	c.download.WaitN(n)
+	return n, err
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	if c.upload == nil {
+		return c.Conn.Write(p)
+	}
+	written := 0
+	for written < len(p) {
+		chunk := p[written:]
+		if len(chunk) > chunkSize {
+			chunk = chunk[:chunkSize]
+		}
+		c.upload.WaitN(len(chunk))
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+type reader struct {
+	r io.Reader
+	l *Limiter
+}
+
+// Reader limits reads from r, e.g. the body of an HTTP response
+func Reader(r io.Reader, l *Limiter) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &reader{r, l}
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if len(p) > chunkSize {
+		p = p[:chunkSize]
+	}
+	n, err := r.r.Read(p)
+	r.l.WaitN(n)
+	return n, err
+}
+
+// maxInt is the largest int, math.MaxInt needs Go 1.17
+const maxInt = int(^uint(0) >> 1)
+
+// ParseRate parses a rate in bytes per second, with an optional binary
+// suffix K, M or G, e.g. "500K". "0" and "off" mean unlimited.
+func ParseRate(rate string) (int, error) {
+	s := strings.TrimSpace(rate)
+	if s == "off" {
+		return 0, nil
+	}
+	unit := 1
+	switch {
+	case strings.HasSuffix(s, "K"), strings.HasSuffix(s, "k"):
+		unit = 1024
+	case strings.HasSuffix(s, "M"), strings.HasSuffix(s, "m"):
+		unit = 1024 * 1024
+	case strings.HasSuffix(s, "G"), strings.HasSuffix(s, "g"):
+		unit = 1024 * 1024 * 1024
+	}
+	if unit > 1 {
+		s = s[:len(s)-1]
+	}
+	value, err := strconv.ParseFloat(s, 64)
+	// NaN fails every comparison, infinities are out of range
+	if err != nil || !(value >= 0) || value*float64(unit) >= float64(maxInt) {
+		return 0, fmt.Errorf("Invalid rate %q", rate)
+	}
+	return int(value * float64(unit)), nil
+}
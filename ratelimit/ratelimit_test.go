@@ -0,0 +1,147 @@
+package ratelimit
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClock makes a limiter sleep instantly, recording the sleeps
+type fakeClock struct {
+	now    time.Time
+	sleeps []time.Duration
+}
+
+func (c *fakeClock) install(l *Limiter) {
+	l.now = func() time.Time { return c.now }
+	l.sleep = func(d time.Duration) {
+		c.sleeps = append(c.sleeps, d)
+		c.now = c.now.Add(d)
+	}
+	l.last = c.now
+}
+
+func TestLimiter(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	l := New(1000, nil)
+	clock.install(l)
+
+	// the bucket starts full
+	l.WaitN(1000)
+	// then bytes pass at the rate
+	l.WaitN(500)
+	l.WaitN(250)
+	assert.Equal(t, []time.Duration{0, 500 * time.Millisecond, 250 * time.Millisecond}, clock.sleeps)
+
+	// an idle limiter allows a burst of a second's worth
+	clock.sleeps = nil
+	clock.now = clock.now.Add(time.Minute)
+	l.WaitN(1000)
+	l.WaitN(100)
+	assert.Equal(t, []time.Duration{0, 100 * time.Millisecond}, clock.sleeps)
+
+	// the rate can be changed
+	clock.sleeps = nil
+	l.SetRate(100)
+	l.WaitN(100)
+	l.WaitN(100)
+	assert.Equal(t, []time.Duration{0, time.Second}, clock.sleeps)
+	assert.Equal(t, 100, l.Rate())
+
+	// 0 is unlimited
+	clock.sleeps = nil
+	l.SetRate(0)
+	l.WaitN(1000000)
+	assert.Equal(t, []time.Duration{0}, clock.sleeps)
+
+	var nilLimiter *Limiter
+	nilLimiter.WaitN(1000)
+	assert.Equal(t, 0, nilLimiter.Rate())
+}
+
+func TestLimiterParent(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	global := New(1000, nil)
+	clock.install(global)
+	a := New(0, global)
+	clock.install(a)
+	b := New(200, global)
+	clock.install(b)
+
+	// bytes pass both the child's and the parent's limit
+	a.WaitN(800)
+	b.WaitN(200)
+	b.WaitN(200)
+	assert.Equal(t, []time.Duration{0, 0, 0, 0, time.Second, 0}, clock.sleeps)
+	a.WaitN(1000)
+	assert.Equal(t, 200*time.Millisecond, clock.sleeps[len(clock.sleeps)-1])
+}
+
+func TestConn(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	download := New(chunkSize, nil)
+	clock.install(download)
+	upload := New(chunkSize, nil)
+	clock.install(upload)
+
+	client, server := net.Pipe()
+	conn := NewConn(client, download, upload)
+	data := bytes.Repeat([]byte("x"), 3*chunkSize)
+
+	go func() {
+		server.Write(data)
+		server.Close()
+	}()
+	received, err := ioutil.ReadAll(conn)
+	require.Nil(t, err)
+	assert.Equal(t, data, received)
+	// the first chunk is covered by the full bucket
+	assert.Equal(t, 2*time.Second, clock.now.Sub(time.Unix(1000, 0)))
+
+	client, server = net.Pipe()
+	conn = NewConn(client, download, upload)
+	clock.sleeps = nil
+	go ioutil.ReadAll(server)
+	n, err := conn.Write(data)
+	require.Nil(t, err)
+	assert.Equal(t, len(data), n)
+	assert.Equal(t, []time.Duration{0, time.Second, time.Second}, clock.sleeps)
+	conn.Close()
+}
+
+func TestParseRate(t *testing.T) {
+	tests := map[string]struct {
+		input  string
+		output int
+		fails  bool
+	}{
+		"bytes":         {input: "1000", output: 1000},
+		"kibibytes":     {input: "500K", output: 500 * 1024},
+		"lowercase":     {input: "2m", output: 2 * 1024 * 1024},
+		"fraction":      {input: "1.5G", output: 3 * 512 * 1024 * 1024},
+		"unlimited":     {input: "0", output: 0},
+		"off":           {input: "off", output: 0},
+		"negative":      {input: "-1K", fails: true},
+		"unknown unit":  {input: "5T", fails: true},
+		"not a number":  {input: "fast", fails: true},
+		"only the unit": {input: "K", fails: true},
+		"not a rate":    {input: "NaN", fails: true},
+		"infinite":      {input: "Inf", fails: true},
+		"too big":       {input: "1e30G", fails: true},
+	}
+
+	for name, test := range tests {
+		rate, err := ParseRate(test.input)
+		if test.fails {
+			assert.NotNil(t, err, name)
+		} else {
+			assert.Nil(t, err, name)
+			assert.Equal(t, test.output, rate, name)
+		}
+	}
+}
@@ -0,0 +1,453 @@
+package torrentfile
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sjaensch/storrent/bencode"
+	"github.com/sjaensch/storrent/merkle"
+)
+
+const minPieceLength = 16 * 1024
+const maxPieceLength = 16 * 1024 * 1024
+
+// targetPieceCount is the number of pieces we aim for when choosing a piece length
+const targetPieceCount = 1500
+
+// CreateOptions holds the metadata for a new torrent. All fields are optional.
+type CreateOptions struct {
+	Announce     string
+	AnnounceList [][]string // tiers of tracker URLs (BEP 12)
+	Comment      string
+	CreatedBy    string
+	CreationDate time.Time // omitted if zero
+	Private      bool      // BEP 27
+	Source       string    // changes the info hash, e.g. to cross-seed on several private trackers
+	WebSeeds     []string  // url-list (BEP 19)
+	PieceLength  int       // chosen based on the total size if zero
+	Hybrid       bool      // add v2 metadata next to the v1 metadata (BEP 52)
+}
+
+// Create builds a torrent for the file or directory at path and writes the
+// bencoded torrent to w. Pieces are hashed in parallel. The info hash of the
+// new torrent is returned.
+func Create(path string, opts CreateOptions, w io.Writer) ([20]byte, error) {
+	files, err := collectFiles(path)
+	if err != nil {
+		return [20]byte{}, err
+	}
+
+	pieceLength := opts.PieceLength
+	if pieceLength == 0 {
+		pieceLength = choosePieceLength(files.length)
+	}
+	if pieceLength <= 0 || pieceLength%minPieceLength != 0 {
+		return [20]byte{}, fmt.Errorf("Piece length %d is not a multiple of %d", pieceLength, minPieceLength)
+	}
+	if opts.Hybrid {
+		if !merkle.IsPowerOfTwo(pieceLength) {
+			return [20]byte{}, fmt.Errorf("Piece length %d of a hybrid torrent is not a power of two", pieceLength)
+		}
+		files = files.aligned(pieceLength)
+	}
+	err = files.open()
+	if err != nil {
+		return [20]byte{}, err
+	}
+	defer files.close()
+	pieces, err := hashPieces(files, pieceLength)
+	if err != nil {
+		return [20]byte{}, err
+	}
+
+	info := map[string]interface{}{
+		"name":         filepath.Base(filepath.Clean(path)),
+		"piece length": pieceLength,
+		"pieces":       string(pieces),
+	}
+	if files.isDir {
+		fileList := make([]interface{}, len(files.spans))
+		for i, span := range files.spans {
+			file := map[string]interface{}{
+				"length": span.length,
+				"path":   span.components,
+			}
+			if span.pad {
+				file["attr"] = "p"
+			}
+			fileList[i] = file
+		}
+		info["files"] = fileList
+	} else {
+		info["length"] = files.length
+	}
+	if opts.Private {
+		info["private"] = 1
+	}
+	if opts.Source != "" {
+		info["source"] = opts.Source
+	}
+	var pieceLayers map[string]interface{}
+	if opts.Hybrid {
+		var fileTree map[string]interface{}
+		fileTree, pieceLayers, err = hashFileTree(files, pieceLength, info["name"].(string))
+		if err != nil {
+			return [20]byte{}, err
+		}
+		info["meta version"] = MetaVersion2
+		info["file tree"] = fileTree
+	}
+
+	infoBytes, err := bencode.Marshal(info)
+	if err != nil {
+		return [20]byte{}, err
+	}
+
+	torrent := map[string]interface{}{
+		"info": bencode.RawMessage(infoBytes),
+	}
+	if opts.Announce != "" {
+		torrent["announce"] = opts.Announce
+	}
+	if len(opts.AnnounceList) > 0 {
+		torrent["announce-list"] = opts.AnnounceList
+	}
+	if opts.Comment != "" {
+		torrent["comment"] = opts.Comment
+	}
+	if opts.CreatedBy != "" {
+		torrent["created by"] = opts.CreatedBy
+	}
+	if !opts.CreationDate.IsZero() {
+		torrent["creation date"] = opts.CreationDate.Unix()
+	}
+	if len(opts.WebSeeds) > 0 {
+		torrent["url-list"] = opts.WebSeeds
+	}
+	if len(pieceLayers) > 0 {
+		torrent["piece layers"] = pieceLayers
+	}
+
+	// the encoder writes the torrent in one go, so there's no partial
+	// output on errors
+	err = bencode.NewEncoder(w).Encode(torrent)
+	if err != nil {
+		return [20]byte{}, err
+	}
+	return sha1.Sum(infoBytes), nil
+}
+
+// choosePieceLength picks a power of two piece length, so that the torrent
+// has around targetPieceCount pieces.
+func choosePieceLength(totalLength int) int {
+	pieceLength := minPieceLength
+	for pieceLength < maxPieceLength && totalLength/pieceLength > targetPieceCount {
+		pieceLength *= 2
+	}
+	return pieceLength
+}
+
+// fileSpan is a single file within the contiguous data of a torrent
+type fileSpan struct {
+	path       string   // path on disk
+	components []string // path within the torrent, without the torrent name
+	offset     int      // offset of the file within the torrent data
+	length     int
+	pad        bool     // padding file (BEP 47), consisting of zeros
+	file       *os.File // set while the file set is open
+}
+
+// fileSet maps the contiguous data of a torrent onto the files it consists of
+type fileSet struct {
+	spans  []fileSpan
+	length int
+	isDir  bool // multi-file torrent
+}
+
+// collectFiles returns the regular files in path, in lexical order. Symlinks
+// and other special files are skipped.
+func collectFiles(path string) (*fileSet, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	files := &fileSet{isDir: stat.IsDir()}
+	if !files.isDir {
+		files.add(path, nil, int(stat.Size()))
+		return files, nil
+	}
+
+	err = filepath.Walk(path, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(path, filePath)
+		if err != nil {
+			return err
+		}
+		files.add(filePath, splitPath(rel), int(info.Size()))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(files.spans) == 0 {
+		return nil, fmt.Errorf("No files found in %s", path)
+	}
+	return files, nil
+}
+
+func (files *fileSet) add(path string, components []string, length int) {
+	files.spans = append(files.spans, fileSpan{
+		path:       path,
+		components: components,
+		offset:     files.length,
+		length:     length,
+	})
+	files.length += length
+}
+
+// aligned returns a copy of the file set with padding files inserted, so
+// that every file starts at a multiple of pieceLength
+func (files *fileSet) aligned(pieceLength int) *fileSet {
+	if !files.isDir {
+		return files
+	}
+	result := &fileSet{isDir: true}
+	for i, span := range files.spans {
+		result.add(span.path, span.components, span.length)
+		if rest := result.length % pieceLength; rest != 0 && i < len(files.spans)-1 {
+			padLength := pieceLength - rest
+			result.add("", []string{".pad", strconv.Itoa(padLength)}, padLength)
+			result.spans[len(result.spans)-1].pad = true
+		}
+	}
+	return result
+}
+
+// splitPath splits a relative path into its components
+func splitPath(path string) []string {
+	var components []string
+	for path != "" && path != "." {
+		dir, file := filepath.Split(path)
+		components = append([]string{file}, components...)
+		path = filepath.Clean(dir)
+		if dir == "" {
+			break
+		}
+	}
+	return components
+}
+
+// open opens the files of the set, so that they can be read while hashing.
+// Call close once done.
+func (files *fileSet) open() error {
+	for i := range files.spans {
+		span := &files.spans[i]
+		if span.pad || span.length == 0 {
+			continue
+		}
+		file, err := os.Open(span.path)
+		if err != nil {
+			files.close()
+			return err
+		}
+		span.file = file
+	}
+	return nil
+}
+
+func (files *fileSet) close() {
+	for i := range files.spans {
+		if files.spans[i].file != nil {
+			files.spans[i].file.Close()
+			files.spans[i].file = nil
+		}
+	}
+}
+
+// ReadAt reads len(buf) bytes of torrent data starting at off, from
+// however many files that range spans. The file set must be open.
+func (files *fileSet) ReadAt(buf []byte, off int) error {
+	// the first span ending after off
+	first := sort.Search(len(files.spans), func(i int) bool {
+		return files.spans[i].offset+files.spans[i].length > off
+	})
+	for _, span := range files.spans[first:] {
+		if len(buf) == 0 {
+			break
+		}
+		if span.length == 0 {
+			continue
+		}
+		n := span.offset + span.length - off
+		if n > len(buf) {
+			n = len(buf)
+		}
+		if span.pad {
+			for i := range buf[:n] {
+				buf[i] = 0
+			}
+		} else {
+			_, err := span.file.ReadAt(buf[:n], int64(off-span.offset))
+			if err != nil {
+				return err
+			}
+		}
+		buf = buf[n:]
+		off += n
+	}
+	if len(buf) > 0 {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+// hashPieces returns the concatenated SHA-1 hashes of all pieces
+func hashPieces(files *fileSet, pieceLength int) ([]byte, error) {
+	numPieces := (files.length + pieceLength - 1) / pieceLength
+	hashes := make([]byte, numPieces*sha1.Size)
+	err := forEachPiece(numPieces, pieceLength, func(index int, buf []byte) error {
+		begin := index * pieceLength
+		end := begin + pieceLength
+		if end > files.length {
+			end = files.length
+		}
+		err := files.ReadAt(buf[:end-begin], begin)
+		if err != nil {
+			return err
+		}
+		hash := sha1.Sum(buf[:end-begin])
+		copy(hashes[index*sha1.Size:], hash[:])
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return hashes, nil
+}
+
+// hashFileTree builds the v2 file tree and piece layers of the files. The
+// files must be aligned to pieceLength.
+func hashFileTree(files *fileSet, pieceLength int, name string) (map[string]interface{}, map[string]interface{}, error) {
+	fileTree := map[string]interface{}{}
+	pieceLayers := map[string]interface{}{}
+	for _, span := range files.spans {
+		if span.pad {
+			continue
+		}
+		file := map[string]interface{}{
+			"length": span.length,
+		}
+		if span.length > 0 {
+			layer, err := hashPieceLayer(files, span, pieceLength)
+			if err != nil {
+				return nil, nil, err
+			}
+			var root [32]byte
+			if len(layer) == 1 {
+				// the piece hash of a single piece file already is its root
+				root = layer[0]
+			} else {
+				root = merkle.FileRoot(layer, pieceLength/merkle.BlockSize)
+				var buf bytes.Buffer
+				for _, hash := range layer {
+					buf.Write(hash[:])
+				}
+				pieceLayers[string(root[:])] = buf.String()
+			}
+			file["pieces root"] = string(root[:])
+		}
+
+		components := span.components
+		if !files.isDir {
+			components = []string{name}
+		}
+		dir := fileTree
+		for _, component := range components {
+			child, ok := dir[component].(map[string]interface{})
+			if !ok {
+				child = map[string]interface{}{}
+				dir[component] = child
+			}
+			dir = child
+		}
+		dir[""] = file
+	}
+	return fileTree, pieceLayers, nil
+}
+
+// hashPieceLayer returns the merkle roots of the pieces of a single file.
+// For files fitting into one piece, the root only covers as many blocks as
+// needed.
+func hashPieceLayer(files *fileSet, span fileSpan, pieceLength int) ([][32]byte, error) {
+	numPieces := (span.length + pieceLength - 1) / pieceLength
+	leaves := pieceLength / merkle.BlockSize
+	if numPieces == 1 {
+		leaves = merkle.NextPowerOfTwo((span.length + merkle.BlockSize - 1) / merkle.BlockSize)
+	}
+	layer := make([][32]byte, numPieces)
+	err := forEachPiece(numPieces, pieceLength, func(index int, buf []byte) error {
+		begin := index * pieceLength
+		end := begin + pieceLength
+		if end > span.length {
+			end = span.length
+		}
+		err := files.ReadAt(buf[:end-begin], span.offset+begin)
+		if err != nil {
+			return err
+		}
+		layer[index] = merkle.PieceRoot(buf[:end-begin], leaves)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return layer, nil
+}
+
+// forEachPiece calls fn for every piece index on as many goroutines as we
+// have CPUs. Each goroutine passes its own buffer of pieceLength bytes to fn.
+func forEachPiece(numPieces, pieceLength int, fn func(index int, buf []byte) error) error {
+	indexes := make(chan int, numPieces)
+	for i := 0; i < numPieces; i++ {
+		indexes <- i
+	}
+	close(indexes)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	for w := 0; w < runtime.NumCPU(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, pieceLength)
+			for index := range indexes {
+				err := fn(index, buf)
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return firstErr
+}
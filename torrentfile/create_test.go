@@ -0,0 +1,183 @@
+package torrentfile
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sjaensch/storrent/bencode"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestFiles(t *testing.T, dir string, files map[string][]byte) {
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		require.Nil(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.Nil(t, ioutil.WriteFile(path, content, 0644))
+	}
+}
+
+func TestCreateDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storrent")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	a := bytes.Repeat([]byte{'a'}, 20000)
+	b := bytes.Repeat([]byte{'b'}, 30000)
+	root := filepath.Join(dir, "content")
+	writeTestFiles(t, root, map[string][]byte{
+		"a.txt":     a,
+		"sub/b.txt": b,
+	})
+
+	var buf bytes.Buffer
+	opts := CreateOptions{
+		Announce:     "http://tracker.example.com/announce",
+		AnnounceList: [][]string{{"http://tracker.example.com/announce"}, {"udp://backup.example.com:6969"}},
+		Comment:      "test torrent",
+		CreatedBy:    "storrent",
+		CreationDate: time.Unix(1577836800, 0),
+		Private:      true,
+		Source:       "example",
+		WebSeeds:     []string{"http://seed.example.com/"},
+	}
+	infoHash, err := Create(root, opts, &buf)
+	require.Nil(t, err)
+
+	var decoded interface{}
+	err = bencode.Unmarshal(buf.Bytes(), &decoded)
+	require.Nil(t, err)
+	torrent := decoded.(map[string]interface{})
+	assert.Equal(t, "http://tracker.example.com/announce", torrent["announce"])
+	assert.Equal(t, []interface{}{
+		[]interface{}{"http://tracker.example.com/announce"},
+		[]interface{}{"udp://backup.example.com:6969"},
+	}, torrent["announce-list"])
+	assert.Equal(t, "test torrent", torrent["comment"])
+	assert.Equal(t, "storrent", torrent["created by"])
+	assert.Equal(t, int64(1577836800), torrent["creation date"])
+	assert.Equal(t, []interface{}{"http://seed.example.com/"}, torrent["url-list"])
+
+	info := torrent["info"].(map[string]interface{})
+	assert.Equal(t, "content", info["name"])
+	assert.Equal(t, int64(minPieceLength), info["piece length"])
+	assert.Equal(t, int64(1), info["private"])
+	assert.Equal(t, "example", info["source"])
+	assert.Nil(t, info["length"])
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"length": int64(20000), "path": []interface{}{"a.txt"}},
+		map[string]interface{}{"length": int64(30000), "path": []interface{}{"sub", "b.txt"}},
+	}, info["files"])
+
+	data := append(append([]byte{}, a...), b...)
+	var pieces []byte
+	for begin := 0; begin < len(data); begin += minPieceLength {
+		end := begin + minPieceLength
+		if end > len(data) {
+			end = len(data)
+		}
+		hash := sha1.Sum(data[begin:end])
+		pieces = append(pieces, hash[:]...)
+	}
+	assert.Equal(t, string(pieces), info["pieces"])
+
+	infoBytes, err := bencode.Marshal(info)
+	require.Nil(t, err)
+	assert.Equal(t, sha1.Sum(infoBytes), infoHash)
+	assert.True(t, bytes.Contains(buf.Bytes(), infoBytes))
+}
+
+func TestCreateSingleFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storrent")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	content := bytes.Repeat([]byte("storrent"), 10000)
+	writeTestFiles(t, dir, map[string][]byte{"single.bin": content})
+
+	var buf bytes.Buffer
+	_, err = Create(filepath.Join(dir, "single.bin"), CreateOptions{PieceLength: 32768}, &buf)
+	require.Nil(t, err)
+	torrentPath := filepath.Join(dir, "single.torrent")
+	require.Nil(t, ioutil.WriteFile(torrentPath, buf.Bytes(), 0644))
+
+	tf, err := Open(torrentPath)
+	require.Nil(t, err)
+	assert.Equal(t, "single.bin", tf.Name)
+	assert.Equal(t, len(content), tf.Length)
+	assert.Equal(t, 32768, tf.PieceLength)
+	require.Len(t, tf.PieceHashes, 3)
+	assert.Equal(t, sha1.Sum(content[65536:]), tf.PieceHashes[2])
+	assert.Empty(t, tf.Announce)
+}
+
+func TestCreatePrivateSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storrent")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	root := filepath.Join(dir, "content")
+	writeTestFiles(t, root, map[string][]byte{"a.txt": []byte("hello")})
+
+	infoHashes := make(map[[20]byte]bool)
+	for _, source := range []string{"", "tracker1", "tracker2"} {
+		path := filepath.Join(dir, source+".torrent")
+		f, err := os.Create(path)
+		require.Nil(t, err)
+		infoHash, err := Create(root, CreateOptions{Private: true, Source: source}, f)
+		require.Nil(t, err)
+		require.Nil(t, f.Close())
+		infoHashes[infoHash] = true
+
+		tf, err := Open(path)
+		require.Nil(t, err)
+		assert.Equal(t, infoHash, tf.InfoHash)
+		assert.True(t, tf.Private)
+		assert.False(t, tf.AllowsDHT())
+		assert.Equal(t, source, tf.Source)
+	}
+	// each source gives a distinct info hash
+	assert.Len(t, infoHashes, 3)
+}
+
+func TestCreateErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storrent")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	var buf bytes.Buffer
+	_, err = Create(dir, CreateOptions{}, &buf)
+	assert.NotNil(t, err, "empty directory")
+	_, err = Create(filepath.Join(dir, "missing"), CreateOptions{}, &buf)
+	assert.NotNil(t, err, "missing path")
+
+	writeTestFiles(t, dir, map[string][]byte{"file": {1, 2, 3}})
+	_, err = Create(dir, CreateOptions{PieceLength: 1000}, &buf)
+	assert.NotNil(t, err, "invalid piece length")
+	assert.Equal(t, 0, buf.Len())
+}
+
+func TestChoosePieceLength(t *testing.T) {
+	tests := map[string]struct {
+		length      int
+		pieceLength int
+	}{
+		"tiny file":    {length: 100, pieceLength: minPieceLength},
+		"700MB image":  {length: 700 << 20, pieceLength: 512 << 10},
+		"4GB image":    {length: 4 << 30, pieceLength: 4 << 20},
+		"huge content": {length: 1 << 40, pieceLength: maxPieceLength},
+	}
+	for name, test := range tests {
+		assert.Equal(t, test.pieceLength, choosePieceLength(test.length), name)
+	}
+}
+
+func TestSplitPath(t *testing.T) {
+	assert.Equal(t, []string{"a"}, splitPath("a"))
+	assert.Equal(t, []string{"a", "b", "c.txt"}, splitPath(filepath.Join("a", "b", "c.txt")))
+}
@@ -0,0 +1,74 @@
+package torrentfile
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/sjaensch/storrent/bencode"
+)
+
+// EditOptions holds changes to the top-level fields of a torrent. nil fields
+// are left as they are, fields set to an empty value are removed.
+type EditOptions struct {
+	Announce     *string
+	AnnounceList *[][]string // tiers of tracker URLs (BEP 12)
+	WebSeeds     *[]string   // url-list (BEP 19)
+	Comment      *string
+	CreatedBy    *string
+}
+
+// Edit reads a bencoded torrent from r, applies the changes in opts and
+// writes the result to w. The info dictionary is copied byte for byte, so
+// the info hash doesn't change. Keys we don't know about are kept.
+func Edit(r io.Reader, opts EditOptions, w io.Writer) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	// makes sure there's an info dictionary to keep
+	_, err = rawInfo(data)
+	if err != nil {
+		return err
+	}
+	var torrent map[string]bencode.RawMessage
+	err = bencode.Unmarshal(data, &torrent)
+	if err != nil {
+		return err
+	}
+
+	type field struct {
+		key    string
+		value  interface{}
+		remove bool
+	}
+	var fields []field
+	if opts.Announce != nil {
+		fields = append(fields, field{"announce", *opts.Announce, *opts.Announce == ""})
+	}
+	if opts.AnnounceList != nil {
+		fields = append(fields, field{"announce-list", *opts.AnnounceList, len(*opts.AnnounceList) == 0})
+	}
+	if opts.WebSeeds != nil {
+		fields = append(fields, field{"url-list", *opts.WebSeeds, len(*opts.WebSeeds) == 0})
+	}
+	if opts.Comment != nil {
+		fields = append(fields, field{"comment", *opts.Comment, *opts.Comment == ""})
+	}
+	if opts.CreatedBy != nil {
+		fields = append(fields, field{"created by", *opts.CreatedBy, *opts.CreatedBy == ""})
+	}
+	for _, f := range fields {
+		if f.remove {
+			delete(torrent, f.key)
+			continue
+		}
+		encoded, err := bencode.Marshal(f.value)
+		if err != nil {
+			return fmt.Errorf("Could not encode %s: %v", f.key, err)
+		}
+		torrent[f.key] = encoded
+	}
+
+	return bencode.NewEncoder(w).Encode(torrent)
+}
@@ -0,0 +1,67 @@
+package torrentfile
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEdit(t *testing.T) {
+	// both the torrent and its info have keys we don't know about, which
+	// must be kept
+	original := "d8:announce7:http://7:comment3:old5:extrai1e4:infod6:lengthi1e4:name1:a12:piece lengthi16384e6:pieces0:1:zi1eee"
+	str := func(s string) *string { return &s }
+
+	tests := map[string]struct {
+		input  string
+		opts   EditOptions
+		output string
+		fails  bool
+	}{
+		"no changes": {
+			input:  original,
+			output: original,
+		},
+		"replace trackers and add web seeds": {
+			input: original,
+			opts: EditOptions{
+				Announce:     str("http://a/"),
+				AnnounceList: &[][]string{{"http://a/"}, {"http://b/", "http://c/"}},
+				WebSeeds:     &[]string{"http://w/"},
+			},
+			output: "d8:announce9:http://a/13:announce-listll9:http://a/el9:http://b/9:http://c/ee7:comment3:old5:extrai1e4:infod6:lengthi1e4:name1:a12:piece lengthi16384e6:pieces0:1:zi1ee8:url-listl9:http://w/ee",
+		},
+		"remove fields": {
+			input: original,
+			opts: EditOptions{
+				Announce:     str(""),
+				AnnounceList: &[][]string{},
+				Comment:      str(""),
+				CreatedBy:    str("me"),
+			},
+			output: "d10:created by2:me5:extrai1e4:infod6:lengthi1e4:name1:a12:piece lengthi16384e6:pieces0:1:zi1eee",
+		},
+		"no info": {
+			input: "d8:announce7:http://e",
+			fails: true,
+		},
+		"not bencoded": {
+			input: "not a torrent",
+			fails: true,
+		},
+	}
+
+	for name, test := range tests {
+		var buf bytes.Buffer
+		err := Edit(strings.NewReader(test.input), test.opts, &buf)
+		if test.fails {
+			assert.NotNil(t, err, name)
+		} else {
+			require.Nil(t, err, name)
+			assert.Equal(t, test.output, buf.String(), name)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package torrentfile
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Magnet holds what a magnet link (BEP 9) tells about a torrent. The
+// metadata itself has to be fetched from peers.
+type Magnet struct {
+	InfoHash   [20]byte // zero if the link only has a v2 info hash
+	InfoHashV2 [32]byte // zero unless the link has a v2 info hash (BEP 52)
+	Name       string
+	Trackers   []string
+	WebSeeds   []string
+	Peers      []string // host:port of peers to connect to
+}
+
+// ParseMagnet parses a magnet link. It needs at least one btih or btmh
+// exact topic.
+func ParseMagnet(uri string) (Magnet, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return Magnet{}, err
+	}
+	if u.Scheme != "magnet" {
+		return Magnet{}, fmt.Errorf("Not a magnet link: %s", uri)
+	}
+	params, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return Magnet{}, err
+	}
+
+	m := Magnet{
+		Name:     params.Get("dn"),
+		Trackers: params["tr"],
+		WebSeeds: params["ws"],
+		Peers:    params["x.pe"],
+	}
+	found := false
+	for _, xt := range params["xt"] {
+		switch {
+		case strings.HasPrefix(xt, "urn:btih:"):
+			err = parseBTIH(strings.TrimPrefix(xt, "urn:btih:"), &m.InfoHash)
+		case strings.HasPrefix(xt, "urn:btmh:"):
+			err = parseBTMH(strings.TrimPrefix(xt, "urn:btmh:"), &m.InfoHashV2)
+		default:
+			continue
+		}
+		if err != nil {
+			return Magnet{}, err
+		}
+		found = true
+	}
+	if !found {
+		return Magnet{}, fmt.Errorf("Magnet link has no BitTorrent info hash")
+	}
+	return m, nil
+}
+
+// parseBTIH parses a v1 info hash, which is either hex or base32 encoded
+func parseBTIH(s string, infoHash *[20]byte) error {
+	var decoded []byte
+	var err error
+	switch len(s) {
+	case 40:
+		decoded, err = hex.DecodeString(s)
+	case 32:
+		decoded, err = base32.StdEncoding.DecodeString(strings.ToUpper(s))
+	default:
+		return fmt.Errorf("Invalid btih info hash %q", s)
+	}
+	if err != nil {
+		return fmt.Errorf("Invalid btih info hash %q: %v", s, err)
+	}
+	copy(infoHash[:], decoded)
+	return nil
+}
+
+// parseBTMH parses a v2 info hash, a hex encoded multihash of which only
+// SHA-256 (0x12, length 0x20) is supported
+func parseBTMH(s string, infoHash *[32]byte) error {
+	decoded, err := hex.DecodeString(s)
+	if err != nil || len(decoded) != 34 || decoded[0] != 0x12 || decoded[1] != 0x20 {
+		return fmt.Errorf("Invalid btmh info hash %q", s)
+	}
+	copy(infoHash[:], decoded[2:])
+	return nil
+}
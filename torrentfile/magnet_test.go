@@ -0,0 +1,72 @@
+package torrentfile
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMagnet(t *testing.T) {
+	v1, _ := hex.DecodeString("dee86a7fa6f286a9d74c362014616a0ff5e4843d")
+	v2, _ := hex.DecodeString("f7044e22d431734b2a4c11cbb12d39736fc47047b47bee76c72a870e5f30cc6e")
+	var infoHash [20]byte
+	var infoHashV2 [32]byte
+	copy(infoHash[:], v1)
+	copy(infoHashV2[:], v2)
+
+	tests := map[string]struct {
+		input  string
+		output Magnet
+		fails  bool
+	}{
+		"hex info hash": {
+			input: "magnet:?xt=urn:btih:dee86a7fa6f286a9d74c362014616a0ff5e4843d&dn=arch+linux&tr=http%3A%2F%2Ft%2Fa&tr=udp%3A%2F%2Fb%3A1&ws=http%3A%2F%2Fs%2F&x.pe=10.0.0.1%3A6881",
+			output: Magnet{
+				InfoHash: infoHash,
+				Name:     "arch linux",
+				Trackers: []string{"http://t/a", "udp://b:1"},
+				WebSeeds: []string{"http://s/"},
+				Peers:    []string{"10.0.0.1:6881"},
+			},
+		},
+		"base32 info hash": {
+			input:  "magnet:?xt=urn:btih:33ugu75g6kdktv2mgyqbiylkb726jbb5",
+			output: Magnet{InfoHash: infoHash},
+		},
+		"hybrid": {
+			input:  "magnet:?xt=urn:btih:dee86a7fa6f286a9d74c362014616a0ff5e4843d&xt=urn:btmh:1220f7044e22d431734b2a4c11cbb12d39736fc47047b47bee76c72a870e5f30cc6e",
+			output: Magnet{InfoHash: infoHash, InfoHashV2: infoHashV2},
+		},
+		"v2 only": {
+			input:  "magnet:?xt=urn:btmh:1220f7044e22d431734b2a4c11cbb12d39736fc47047b47bee76c72a870e5f30cc6e",
+			output: Magnet{InfoHashV2: infoHashV2},
+		},
+		"not a magnet link": {
+			input: "http://example.com/?xt=urn:btih:dee86a7fa6f286a9d74c362014616a0ff5e4843d",
+			fails: true,
+		},
+		"no info hash": {
+			input: "magnet:?dn=foo&xt=urn:sha1:abc",
+			fails: true,
+		},
+		"short info hash": {
+			input: "magnet:?xt=urn:btih:dee86a7f",
+			fails: true,
+		},
+		"unsupported multihash": {
+			input: "magnet:?xt=urn:btmh:1320f7044e22d431734b2a4c11cbb12d39736fc47047b47bee76c72a870e5f30cc6e",
+			fails: true,
+		},
+	}
+
+	for name, test := range tests {
+		m, err := ParseMagnet(test.input)
+		if test.fails {
+			assert.NotNil(t, err, name)
+		} else {
+			assert.Nil(t, err, name)
+			assert.Equal(t, test.output, m, name)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package torrentfile
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sjaensch/storrent/p2p"
+)
+
+// DownloadFiles downloads the files of a multi-file torrent into dir.
+// priorities holds the priority of each entry and may be nil to download
+// all files with normal priority. Files with p2p.PrioritySkip are neither
+// downloaded nor created, but pieces they share with wanted files are.
+// Cancelling ctx saves the download so far, like for DownloadToFile.
+func (t *TorrentFile) DownloadFiles(ctx context.Context, dir string, priorities []p2p.Priority) error {
+	if !t.IsMultiFile() {
+		return fmt.Errorf("%s is not a multi-file torrent", t.Name)
+	}
+	if priorities != nil && len(priorities) != len(t.Entries) {
+		return fmt.Errorf("Got %d priorities for %d files", len(priorities), len(t.Entries))
+	}
+	paths := make([]string, len(t.Entries))
+	for i, entry := range t.Entries {
+		path, err := entryPath(dir, entry)
+		if err != nil {
+			return err
+		}
+		paths[i] = path
+	}
+
+	have, pieces, err := t.loadResume(dir)
+	if err != nil {
+		return err
+	}
+	offsets := t.fileOffsets()
+	buf, have, downloadErr := t.download(ctx, t.piecePriorities(priorities, offsets), have)
+	if buf == nil {
+		return downloadErr
+	}
+	t.restorePieces(buf, pieces)
+
+	for i, entry := range t.Entries {
+		if entry.IsPadding() || filePriority(priorities, i) == p2p.PrioritySkip {
+			continue
+		}
+		err := os.MkdirAll(filepath.Dir(paths[i]), 0755)
+		if err != nil {
+			return err
+		}
+		if entry.IsSymlink() {
+			err = t.createSymlink(dir, paths[i], entry)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		// hidden files need no special treatment, on Unix that's up to the name
+		err = ioutil.WriteFile(paths[i], buf[offsets[i]:offsets[i]+entry.Length], 0644)
+		if err != nil {
+			return err
+		}
+		if entry.IsExecutable() {
+			err = os.Chmod(paths[i], 0755)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return t.saveResume(dir, have, downloadErr)
+}
+
+// createSymlink creates the symlink at path. Its target must be within the
+// torrent's directory.
+func (t *TorrentFile) createSymlink(dir, path string, entry FileEntry) error {
+	root := filepath.Join(dir, t.Name)
+	target := filepath.Join(append([]string{root}, entry.Symlink...)...)
+	rel, err := filepath.Rel(root, target)
+	if err != nil || len(entry.Symlink) == 0 || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("Invalid symlink target %s of %s", filepath.Join(entry.Symlink...), entry.Name)
+	}
+	target, err = filepath.Rel(filepath.Dir(path), target)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Symlink(target, path)
+}
+
+// entryPath returns the path of the file below dir, making sure that
+// malicious file names can't escape it
+func entryPath(dir string, entry FileEntry) (string, error) {
+	path := filepath.Join(dir, entry.Path, entry.Name)
+	rel, err := filepath.Rel(dir, path)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("Invalid file path %s", filepath.Join(entry.Path, entry.Name))
+	}
+	return path, nil
+}
+
+func filePriority(priorities []p2p.Priority, index int) p2p.Priority {
+	if priorities == nil {
+		return p2p.PriorityNormal
+	}
+	return priorities[index]
+}
+
+// fileOffsets returns the offset of each entry in the data of the torrent.
+// Files of pure v2 torrents start at piece boundaries.
+func (t *TorrentFile) fileOffsets() []int {
+	aligned := t.IsV2() && !t.IsHybrid()
+	offsets := make([]int, len(t.Entries))
+	offset := 0
+	for i, entry := range t.Entries {
+		offsets[i] = offset
+		offset += entry.Length
+		if aligned && offset%t.PieceLength != 0 {
+			offset += t.PieceLength - offset%t.PieceLength
+		}
+	}
+	return offsets
+}
+
+// piecePriorities maps file priorities to piece priorities. A piece gets the
+// highest priority of the files it overlaps, pieces of skipped files only
+// are skipped. Padding is never downloaded for its own sake.
+func (t *TorrentFile) piecePriorities(priorities []p2p.Priority, offsets []int) []p2p.Priority {
+	if priorities == nil {
+		return nil
+	}
+	numPieces := t.NumPieces()
+	pieces := make([]p2p.Priority, numPieces)
+	for i := range pieces {
+		pieces[i] = p2p.PrioritySkip
+	}
+	for i, entry := range t.Entries {
+		if entry.Length == 0 || entry.IsPadding() {
+			continue
+		}
+		first := offsets[i] / t.PieceLength
+		last := (offsets[i] + entry.Length - 1) / t.PieceLength
+		for index := first; index <= last && index < numPieces; index++ {
+			if priorities[i] > pieces[index] {
+				pieces[index] = priorities[i]
+			}
+		}
+	}
+	return pieces
+}
@@ -0,0 +1,195 @@
+package torrentfile
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sjaensch/storrent/p2p"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPiecePriorities(t *testing.T) {
+	tf := TorrentFile{
+		PieceHashes: make([][20]byte, 5),
+		PieceLength: 10,
+		Entries: []FileEntry{
+			{Length: 15, Path: "t", Name: "a"},
+			{Length: 5, Path: "t", Name: "b"},
+			{Length: 0, Path: "t", Name: "empty"},
+			{Length: 30, Path: "t", Name: "c"},
+		},
+	}
+	offsets := tf.fileOffsets()
+	assert.Equal(t, []int{0, 15, 20, 20}, offsets)
+
+	priorities := []p2p.Priority{p2p.PrioritySkip, p2p.PriorityHigh, p2p.PriorityNormal, p2p.PriorityLow}
+	assert.Equal(t, []p2p.Priority{
+		p2p.PrioritySkip,
+		p2p.PriorityHigh, // shared by a and b
+		p2p.PriorityLow,
+		p2p.PriorityLow,
+		p2p.PriorityLow,
+	}, tf.piecePriorities(priorities, offsets))
+	assert.Nil(t, tf.piecePriorities(nil, offsets))
+}
+
+func TestFileOffsetsV2(t *testing.T) {
+	tf := TorrentFile{
+		MetaVersion: MetaVersion2,
+		PieceLength: 16384,
+		Entries: []FileEntry{
+			{Length: 100, Path: "t", Name: "a"},
+			{Length: 0, Path: "t", Name: "empty"},
+			{Length: 16384, Path: "t", Name: "b"},
+			{Length: 5, Path: "t", Name: "c"},
+		},
+	}
+	assert.Equal(t, []int{0, 16384, 16384, 32768}, tf.fileOffsets())
+}
+
+func TestEntryPath(t *testing.T) {
+	tests := map[string]struct {
+		input  FileEntry
+		output string
+		fails  bool
+	}{
+		"nested file": {
+			input:  FileEntry{Path: filepath.Join("t", "sub"), Name: "a"},
+			output: filepath.Join("out", "t", "sub", "a"),
+		},
+		"parent directory": {
+			input: FileEntry{Path: filepath.Join("t", "..", ".."), Name: "a"},
+			fails: true,
+		},
+		"parent name": {
+			input: FileEntry{Path: "t", Name: "../../a"},
+			fails: true,
+		},
+		"target directory": {
+			input: FileEntry{Path: "t", Name: ".."},
+			fails: true,
+		},
+	}
+
+	for name, test := range tests {
+		path, err := entryPath("out", test.input)
+		if test.fails {
+			assert.NotNil(t, err, name)
+		} else {
+			assert.Nil(t, err, name)
+			assert.Equal(t, test.output, path, name)
+		}
+	}
+}
+
+func TestDownloadFilesFromWebSeed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storrent")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	a := bytes.Repeat([]byte{'a'}, 20000)
+	b := bytes.Repeat([]byte{'b'}, 30000)
+	writeTestFiles(t, filepath.Join(dir, "seed", "content"), map[string][]byte{
+		"a.txt":     a,
+		"sub/b.txt": b,
+	})
+	server := httptest.NewServer(http.FileServer(http.Dir(filepath.Join(dir, "seed"))))
+	defer server.Close()
+
+	torrentPath := filepath.Join(dir, "content.torrent")
+	f, err := os.Create(torrentPath)
+	require.Nil(t, err)
+	_, err = Create(filepath.Join(dir, "seed", "content"), CreateOptions{WebSeeds: []string{server.URL}}, f)
+	require.Nil(t, err)
+	require.Nil(t, f.Close())
+
+	tf, err := Open(torrentPath)
+	require.Nil(t, err)
+	require.True(t, tf.IsMultiFile())
+	var events []p2p.Event
+	tf.OnEvent = func(e p2p.Event) { events = append(events, e) }
+	out := filepath.Join(dir, "out")
+	err = tf.DownloadFiles(context.Background(), out, []p2p.Priority{p2p.PrioritySkip, p2p.PriorityNormal})
+	require.Nil(t, err)
+	// the torrent has no tracker, so only the web seed is used
+	require.NotEmpty(t, events)
+	assert.Equal(t, p2p.EventAnnounce, events[0].Type)
+	assert.NotNil(t, events[0].Err)
+	assert.Equal(t, p2p.EventCompleted, events[len(events)-1].Type)
+
+	_, err = os.Stat(filepath.Join(out, "content", "a.txt"))
+	assert.True(t, os.IsNotExist(err))
+	data, err := ioutil.ReadFile(filepath.Join(out, "content", "sub", "b.txt"))
+	require.Nil(t, err)
+	assert.Equal(t, b, data)
+
+	assert.NotNil(t, tf.DownloadFiles(context.Background(), out, []p2p.Priority{p2p.PriorityNormal}))
+}
+
+func TestDownloadFilesAttributes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storrent")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	script := []byte("#!/bin/sh\n")
+	writeTestFiles(t, filepath.Join(dir, "seed", "content"), map[string][]byte{"run.sh": script})
+	requested := make(chan string, 10)
+	fileServer := http.FileServer(http.Dir(filepath.Join(dir, "seed")))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested <- r.URL.Path
+		fileServer.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	piece := make([]byte, minPieceLength)
+	copy(piece, script)
+	hash := sha1.Sum(piece)
+	info := map[string]interface{}{
+		"name":         "content",
+		"piece length": minPieceLength,
+		"pieces":       string(hash[:]),
+		"files": []interface{}{
+			map[string]interface{}{"length": len(script), "path": []string{"run.sh"}, "attr": "x"},
+			map[string]interface{}{"length": minPieceLength - len(script), "path": []string{".pad", "16374"}, "attr": "p"},
+			map[string]interface{}{"length": 0, "path": []string{"bin", "run"}, "attr": "l", "symlink path": []string{"run.sh"}},
+			map[string]interface{}{"length": 0, "path": []string{"escape"}, "attr": "l", "symlink path": []string{"..", "x"}},
+		},
+	}
+	torrentPath := filepath.Join(dir, "attributes.torrent")
+	writeTorrent(t, torrentPath, map[string]interface{}{"info": info, "url-list": server.URL})
+
+	tf, err := Open(torrentPath)
+	require.Nil(t, err)
+	require.Len(t, tf.Entries, 4)
+	assert.True(t, tf.Entries[0].IsExecutable())
+	assert.True(t, tf.Entries[1].IsPadding())
+	assert.False(t, tf.Entries[1].IsHidden())
+	assert.True(t, tf.Entries[2].IsSymlink())
+	assert.Equal(t, []string{"run.sh"}, tf.Entries[2].Symlink)
+
+	out := filepath.Join(dir, "out")
+	err = tf.DownloadFiles(context.Background(), out, []p2p.Priority{p2p.PriorityNormal, p2p.PriorityNormal, p2p.PriorityNormal, p2p.PrioritySkip})
+	require.Nil(t, err)
+	assert.Equal(t, "/content/run.sh", <-requested)
+	assert.Len(t, requested, 0)
+
+	stat, err := os.Stat(filepath.Join(out, "content", "run.sh"))
+	require.Nil(t, err)
+	assert.Equal(t, os.FileMode(0755), stat.Mode().Perm())
+	_, err = os.Stat(filepath.Join(out, "content", ".pad"))
+	assert.True(t, os.IsNotExist(err))
+	target, err := os.Readlink(filepath.Join(out, "content", "bin", "run"))
+	require.Nil(t, err)
+	assert.Equal(t, filepath.Join("..", "run.sh"), target)
+
+	// the link pointing outside of the torrent is refused
+	assert.NotNil(t, tf.DownloadFiles(context.Background(), out, nil))
+}
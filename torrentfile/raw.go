@@ -0,0 +1,45 @@
+package torrentfile
+
+import (
+	"fmt"
+
+	"github.com/sjaensch/storrent/bencode"
+)
+
+// MetadataPieceSize is the size of the pieces the info dictionary is split
+// into when serving it via ut_metadata (BEP 9)
+const MetadataPieceSize = 16384
+
+// MetadataPiece returns piece index of the raw info dictionary, as served
+// via ut_metadata
+func (t *TorrentFile) MetadataPiece(index int) ([]byte, error) {
+	begin := index * MetadataPieceSize
+	if index < 0 || begin >= len(t.InfoBytes) {
+		return nil, fmt.Errorf("Metadata piece %d out of range", index)
+	}
+	end := begin + MetadataPieceSize
+	if end > len(t.InfoBytes) {
+		end = len(t.InfoBytes)
+	}
+	return t.InfoBytes[begin:end], nil
+}
+
+// rawInfo returns the exact bytes of the info dictionary of a bencoded
+// torrent. Hashing a re-encoding of the parsed dictionary would lose keys
+// we don't know about and change the info hash.
+func rawInfo(data []byte) ([]byte, error) {
+	var torrent struct {
+		Info bencode.RawMessage `bencode:"info"`
+	}
+	err := bencode.Unmarshal(data, &torrent)
+	if err != nil {
+		return nil, err
+	}
+	if len(torrent.Info) == 0 {
+		return nil, fmt.Errorf("Torrent has no info dictionary")
+	}
+	if torrent.Info[0] != 'd' {
+		return nil, fmt.Errorf("Info is not a dictionary")
+	}
+	return torrent.Info, nil
+}
@@ -0,0 +1,100 @@
+package torrentfile
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRawInfo(t *testing.T) {
+	tests := map[string]struct {
+		input  string
+		output string
+		fails  bool
+	}{
+		"info is returned verbatim": {
+			input:  "d8:announce3:url4:infod6:lengthi-1e4:name1:a7:privatei1e5:zzzzzli1eeee",
+			output: "d6:lengthi-1e4:name1:a7:privatei1e5:zzzzzli1eee",
+		},
+		"keys following info": {
+			input:  "d4:infod1:xlee8:url-listl1:uee",
+			output: "d1:xlee",
+		},
+		"no info": {
+			input: "d8:announce3:urle",
+			fails: true,
+		},
+		"info is not a dictionary": {
+			input: "d4:infoli1eee",
+			fails: true,
+		},
+		"not a dictionary": {
+			input: "li1ee",
+			fails: true,
+		},
+		"truncated": {
+			input: "d4:infod1:x",
+			fails: true,
+		},
+		"string length beyond the data": {
+			input: "d4:infod1:x99:abcee",
+			fails: true,
+		},
+		"malformed integer": {
+			input: "d4:infod1:xi1-2eee",
+			fails: true,
+		},
+	}
+
+	for name, test := range tests {
+		raw, err := rawInfo([]byte(test.input))
+		if test.fails {
+			assert.NotNil(t, err, name)
+		} else {
+			assert.Nil(t, err, name)
+			assert.Equal(t, test.output, string(raw), name)
+		}
+	}
+}
+
+func TestOpenKeepsUnknownKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storrent")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	info := "d6:lengthi3e4:name1:a12:piece lengthi16384e6:pieces20:aaaaaaaaaaaaaaaaaaaa7:privatei1e6:source3:fooe"
+	path := filepath.Join(dir, "unknown.torrent")
+	require.Nil(t, ioutil.WriteFile(path, []byte("d4:info"+info+"e"), 0644))
+
+	tf, err := Open(path)
+	require.Nil(t, err)
+	assert.Equal(t, []byte(info), tf.InfoBytes)
+	assert.Equal(t, sha1.Sum([]byte(info)), tf.InfoHash)
+}
+
+func TestOpenInfoHash(t *testing.T) {
+	tf, err := Open("testdata/archlinux-2019.12.01-x86_64.iso.torrent")
+	require.Nil(t, err)
+	assert.Equal(t, "dee86a7fa6f286a9d74c362014616a0ff5e4843d", hex.EncodeToString(tf.InfoHash[:]))
+}
+
+func TestMetadataPiece(t *testing.T) {
+	tf := TorrentFile{InfoBytes: bytes.Repeat([]byte{'x'}, MetadataPieceSize+100)}
+	piece, err := tf.MetadataPiece(0)
+	assert.Nil(t, err)
+	assert.Len(t, piece, MetadataPieceSize)
+	piece, err = tf.MetadataPiece(1)
+	assert.Nil(t, err)
+	assert.Len(t, piece, 100)
+	_, err = tf.MetadataPiece(2)
+	assert.NotNil(t, err)
+	_, err = tf.MetadataPiece(-1)
+	assert.NotNil(t, err)
+}
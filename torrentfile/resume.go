@@ -0,0 +1,107 @@
+package torrentfile
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/sjaensch/storrent/bencode"
+	"github.com/sjaensch/storrent/bitfield"
+)
+
+// resumeState records which pieces of an interrupted download were saved,
+// so that it can be continued later
+type resumeState struct {
+	InfoHash string `bencode:"info hash"`
+	Have     string `bencode:"have"` // bitfield of the pieces
+}
+
+// resumePath returns where the resume state of a download to path is kept:
+// next to the file of a single-file torrent, and next to the torrent's
+// directory within path for multi-file torrents
+func (t *TorrentFile) resumePath(path string) string {
+	if t.IsMultiFile() {
+		return filepath.Join(path, filepath.Base(t.Name)+".resume")
+	}
+	return path + ".resume"
+}
+
+// loadResume reads the resume state of a download to path. The pieces it
+// lists are read back and verified, those that are intact are returned
+// along with their data. Without a resume state, nothing is returned.
+func (t *TorrentFile) loadResume(path string) (bitfield.Bitfield, map[int][]byte, error) {
+	data, err := ioutil.ReadFile(t.resumePath(path))
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	var state resumeState
+	err = bencode.Unmarshal(data, &state)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Invalid resume state %s: %v", t.resumePath(path), err)
+	}
+	if state.InfoHash != string(t.InfoHash[:]) {
+		log.Printf("%s: Ignoring resume state %s of another torrent", t.Name, t.resumePath(path))
+		return nil, nil, nil
+	}
+
+	spans, _, err := t.openSpans(path)
+	defer closeSpans(spans)
+	if err != nil {
+		return nil, nil, err
+	}
+	piecesV2 := t.piecesV2()
+	listed := bitfield.Bitfield(state.Have)
+	have := make(bitfield.Bitfield, (t.NumPieces()+7)/8)
+	pieces := make(map[int][]byte)
+	for index := 0; index < t.NumPieces(); index++ {
+		if !listed.HasPiece(index) {
+			continue
+		}
+		buf := make([]byte, t.pieceSize(index, piecesV2))
+		ok, err := t.verifyPiece(index, spans, piecesV2, buf)
+		if err != nil {
+			return nil, nil, err
+		}
+		if ok {
+			have.SetPiece(index)
+			pieces[index] = buf
+		}
+	}
+	log.Printf("%s: Resuming with %d of %d pieces", t.Name, len(pieces), t.NumPieces())
+	return have, pieces, nil
+}
+
+// restorePieces copies the pieces read by loadResume into the torrent's data
+func (t *TorrentFile) restorePieces(buf []byte, pieces map[int][]byte) {
+	for index, data := range pieces {
+		copy(buf[index*t.PieceLength:], data)
+	}
+}
+
+// saveResume records the pieces we have if the download to path was
+// interrupted by downloadErr, and removes the resume state once the
+// download is complete. downloadErr is returned unless saving fails.
+func (t *TorrentFile) saveResume(path string, have bitfield.Bitfield, downloadErr error) error {
+	if downloadErr == nil {
+		err := os.Remove(t.resumePath(path))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	data, err := bencode.Marshal(resumeState{InfoHash: string(t.InfoHash[:]), Have: string(have)})
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(t.resumePath(path), data, 0644)
+	if err != nil {
+		return err
+	}
+	log.Printf("%s: Saved %d of %d pieces, resume state is in %s", t.Name, have.Count(), t.NumPieces(), t.resumePath(path))
+	return downloadErr
+}
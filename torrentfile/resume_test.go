@@ -0,0 +1,106 @@
+package torrentfile
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sjaensch/storrent/p2p"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownloadToFileResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storrent")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	data := make([]byte, 3*minPieceLength-100)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	var mu sync.Mutex
+	var events, ranges []string
+	stall := true
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		events = append(events, r.URL.Query().Get("event"))
+		mu.Unlock()
+		w.Write([]byte("d8:intervali900e5:peers0:e"))
+	}))
+	defer tracker.Close()
+	seed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		stalled := stall && r.Header.Get("Range") != "bytes=0-16383"
+		mu.Unlock()
+		if stalled {
+			// hang until the download is cancelled
+			<-r.Context().Done()
+			return
+		}
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(data))
+	}))
+	defer seed.Close()
+
+	var pieces string
+	for i := 0; i < len(data); i += minPieceLength {
+		end := i + minPieceLength
+		if end > len(data) {
+			end = len(data)
+		}
+		hash := sha1.Sum(data[i:end])
+		pieces += string(hash[:])
+	}
+	info := map[string]interface{}{
+		"name":         "file.bin",
+		"piece length": minPieceLength,
+		"pieces":       pieces,
+		"length":       len(data),
+	}
+	torrentPath := filepath.Join(dir, "file.torrent")
+	writeTorrent(t, torrentPath, map[string]interface{}{"announce": tracker.URL, "info": info, "url-list": seed.URL + "/file.bin"})
+	tf, err := Open(torrentPath)
+	require.Nil(t, err)
+
+	// the download is interrupted after the first piece
+	out := filepath.Join(dir, "file.bin")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tf.OnEvent = func(e p2p.Event) {
+		if e.Type == p2p.EventPieceVerified {
+			cancel()
+		}
+	}
+	err = tf.DownloadToFile(ctx, out)
+	assert.Equal(t, context.Canceled, err)
+	_, err = os.Stat(out + ".resume")
+	require.Nil(t, err)
+	mu.Lock()
+	assert.Equal(t, []string{"", "stopped"}, events)
+	stall = false
+	ranges = nil
+	mu.Unlock()
+
+	// and continued without fetching the first piece again
+	tf.OnEvent = nil
+	err = tf.DownloadToFile(context.Background(), out)
+	require.Nil(t, err)
+	written, err := ioutil.ReadFile(out)
+	require.Nil(t, err)
+	assert.Equal(t, data, written)
+	_, err = os.Stat(out + ".resume")
+	assert.True(t, os.IsNotExist(err))
+	mu.Lock()
+	defer mu.Unlock()
+	assert.NotContains(t, ranges, "bytes=0-16383")
+	assert.Len(t, ranges, 2)
+}
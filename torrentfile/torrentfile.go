@@ -1,16 +1,21 @@
 package torrentfile
 
 import (
-	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/sha1"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 
-	"github.com/jackpal/bencode-go"
+	"github.com/sjaensch/storrent/bencode"
+	"github.com/sjaensch/storrent/bitfield"
 	"github.com/sjaensch/storrent/p2p"
+	"github.com/sjaensch/storrent/peers"
+	"github.com/sjaensch/storrent/ratelimit"
 )
 
 // Port to listen on
@@ -18,27 +23,74 @@ const Port uint16 = 6881
 
 // FileEntry represents a single file within a multi-file torrent
 type FileEntry struct {
-	Length int
-	Path   string
-	Name   string
-	Md5sum string
+	Length     int
+	Path       string
+	Name       string
+	Md5sum     string
+	PiecesRoot [32]byte   // root of the file's merkle tree in v2 torrents
+	PieceLayer [][32]byte // merkle tree layer of the pieces, for files larger than a piece
+	Attr       string     // file attributes (BEP 47), see IsPadding etc.
+	Symlink    []string   // target of a symlink, relative to the torrent's root directory
+}
+
+// IsPadding returns true for files that only align the next file to a
+// piece boundary. Their content is all zeros and never stored.
+func (e *FileEntry) IsPadding() bool {
+	return strings.Contains(e.Attr, "p")
+}
+
+// IsExecutable returns true if the file should have its executable bits set
+func (e *FileEntry) IsExecutable() bool {
+	return strings.Contains(e.Attr, "x")
+}
+
+// IsHidden returns true if the file should be hidden
+func (e *FileEntry) IsHidden() bool {
+	return strings.Contains(e.Attr, "h")
+}
+
+// IsSymlink returns true if the file is a symbolic link to Symlink
+func (e *FileEntry) IsSymlink() bool {
+	return strings.Contains(e.Attr, "l")
 }
 
 // TorrentFile encodes the metadata from a .torrent file
 type TorrentFile struct {
-	Announce    string
-	InfoHash    [20]byte
-	PieceHashes [][20]byte
-	PieceLength int
-	Length      int
-	Name        string
-	Entries     []FileEntry
+	Announce     string
+	AnnounceList [][]string // tiers of tracker URLs (BEP 12)
+	InfoHash     [20]byte
+	PieceHashes  [][20]byte
+	PieceLength  int
+	Length       int
+	Name         string
+	Entries      []FileEntry
+	MetaVersion  int      // MetaVersion2 for v2 and hybrid torrents
+	InfoHashV2   [32]byte // SHA-256 info hash of v2 and hybrid torrents
+	InfoBytes    []byte   // the info dictionary exactly as found in the torrent
+	Private      bool     // peers may only be obtained from the tracker (BEP 27)
+	Source       string   // distinguishes cross-seeded copies of a private torrent
+	WebSeeds     []string // url-list (BEP 19)
+	HTTPSeeds    []string // httpseeds (BEP 17)
+
+	// DownloadLimit and UploadLimit throttle the download, nil doesn't limit.
+	// They aren't part of the torrent file.
+	DownloadLimit *ratelimit.Limiter `json:"-"`
+	UploadLimit   *ratelimit.Limiter `json:"-"`
+	// Stats, if set, collects the statistics of the download
+	Stats *p2p.Stats `json:"-"`
+	// OnEvent, if set, is called with the events of the download
+	OnEvent p2p.EventHandler `json:"-"`
+	// Control, if set, pauses and resumes the download. The tracker is told
+	// when the download stops and starts again.
+	Control *p2p.Control `json:"-"`
 }
 
 type bencodeFile struct {
-	Length int      `bencode:"length"`
-	Path   []string `bencode:"path"`
-	Md5sum string   `bencode:"md5sum"`
+	Length  int      `bencode:"length"`
+	Path    []string `bencode:"path"`
+	Md5sum  string   `bencode:"md5sum"`
+	Attr    string   `bencode:"attr,omitempty"`
+	Symlink []string `bencode:"symlink path,omitempty"`
 }
 
 type bencodeInfo struct {
@@ -48,78 +100,220 @@ type bencodeInfo struct {
 	Name        string        `bencode:"name"`
 	Md5sum      string        `bencode:"md5sum"`
 	Files       []bencodeFile `bencode:"files"`
+	Private     bool          `bencode:"private,omitempty"`
+	Source      string        `bencode:"source,omitempty"`
+
+	// BEP 52 fields of v2 and hybrid torrents
+	MetaVersion int                    `bencode:"meta version"`
+	FileTree    map[string]interface{} `bencode:"file tree"`
+
+	raw bencode.RawMessage // the exact bytes of the dictionary
+}
+
+// UnmarshalBencode decodes the info dictionary and keeps its bytes. Hashing
+// a re-encoding of the parsed dictionary would lose keys we don't know about
+// and change the info hash.
+func (i *bencodeInfo) UnmarshalBencode(data []byte) error {
+	// fields has the fields of bencodeInfo, but not this method
+	type fields bencodeInfo
+	err := bencode.Unmarshal(data, (*fields)(i))
+	if err != nil {
+		return err
+	}
+	i.raw = append(bencode.RawMessage{}, data...)
+	return nil
 }
 
 type bencodeTorrent struct {
-	Announce string      `bencode:"announce"`
-	Info     bencodeInfo `bencode:"info"`
+	Announce     string      `bencode:"announce"`
+	AnnounceList [][]string  `bencode:"announce-list"`
+	Info         bencodeInfo `bencode:"info"`
+	URLList      urlList     `bencode:"url-list"`
+	HTTPSeeds    []string    `bencode:"httpseeds"`
+
+	PieceLayers map[string]interface{} `bencode:"piece layers"`
+}
+
+// urlList is either a single URL or a list of URLs
+type urlList []string
+
+func (l *urlList) UnmarshalBencode(data []byte) error {
+	var url string
+	if bencode.Unmarshal(data, &url) == nil {
+		if url != "" {
+			*l = urlList{url}
+		}
+		return nil
+	}
+	return bencode.Unmarshal(data, (*[]string)(l))
+}
+
+// DownloadToFile downloads a torrent and writes it to a file. If ctx is
+// cancelled, the pieces downloaded so far are written along with a resume
+// state, and the download continues from there the next time.
+func (t *TorrentFile) DownloadToFile(ctx context.Context, path string) error {
+	have, pieces, err := t.loadResume(path)
+	if err != nil {
+		return err
+	}
+	buf, have, downloadErr := t.download(ctx, nil, have)
+	if buf == nil {
+		return downloadErr
+	}
+	t.restorePieces(buf, pieces)
+
+	outFile, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer outFile.Close()
+	_, err = outFile.Write(buf)
+	if err != nil {
+		return err
+	}
+	return t.saveResume(path, have, downloadErr)
 }
 
-// DownloadToFile downloads a torrent and writes it to a file
-func (t *TorrentFile) DownloadToFile(path string) error {
+// download fetches the pieces of the torrent that are neither skipped nor
+// in have, returning the data of the whole torrent and the pieces we have.
+// If ctx is cancelled during the download, the data downloaded so far is
+// returned along with ctx's error, and the tracker is told that we stopped.
+func (t *TorrentFile) download(ctx context.Context, piecePriorities []p2p.Priority, have bitfield.Bitfield) ([]byte, bitfield.Bitfield, error) {
 	var peerID [20]byte
 	version := "-JT0001-"
 	copy(peerID[:], version)
 	_, err := rand.Read(peerID[len(version):])
 	if err != nil {
-		return err
+		return nil, have, err
 	}
 
-	peers, err := t.requestPeers(peerID, Port)
+	trackerPeers, err := t.requestPeers(ctx, peerID, Port)
+	t.OnEvent.Emit(p2p.Event{Type: p2p.EventAnnounce, Tracker: t.Announce, Peers: len(trackerPeers), Err: err})
+	if ctx.Err() != nil {
+		return nil, have, ctx.Err()
+	}
+	announced := err == nil
 	if err != nil {
-		return err
+		if len(t.WebSeeds) == 0 && len(t.HTTPSeeds) == 0 {
+			return nil, have, err
+		}
+		log.Printf("%s: Requesting peers failed, downloading from HTTP seeds only: %v", t.Name, err)
 	}
 
 	torrent := p2p.Torrent{
-		Peers:       peers,
+		Peers:       trackerPeers,
 		PeerID:      peerID,
 		InfoHash:    t.InfoHash,
 		PieceHashes: t.PieceHashes,
 		PieceLength: t.PieceLength,
 		Length:      t.Length,
 		Name:        t.Name,
+		Files:       t.files(),
+		HTTPSeeds:   t.HTTPSeeds,
+
+		DownloadLimit:   t.DownloadLimit,
+		UploadLimit:     t.UploadLimit,
+		Stats:           t.Stats,
+		OnEvent:         t.OnEvent,
+		Have:            have,
+		Control:         t.Control,
+		PiecePriorities: piecePriorities,
 	}
-	buf, err := torrent.Download()
-	if err != nil {
-		return err
+	if t.IsV2() {
+		torrent.PiecesV2 = t.piecesV2()
+		if !t.IsHybrid() {
+			torrent.Length = t.alignedLengthV2()
+		}
+	}
+	if t.IsV2() && !t.IsHybrid() && len(torrent.Files) > 0 {
+		// the files of pure v2 torrents don't follow each other directly
+		log.Printf("%s: Ignoring web seeds of v2 multi-file torrent", t.Name)
+	} else {
+		torrent.WebSeeds = t.WebSeeds
+	}
+	if announced {
+		torrent.OnPauseChange = func(ctx context.Context, paused bool) []peers.Peer {
+			return t.announcePause(ctx, peerID, paused)
+		}
+	}
+	buf, err := torrent.Download(ctx)
+	if err != nil && announced {
+		// ctx is done, but the tracker should still hear that we stopped
+		stopCtx, cancel := context.WithTimeout(context.Background(), stoppedAnnounceTimeout)
+		defer cancel()
+		stopErr := t.announceStopped(stopCtx, peerID, Port)
+		t.OnEvent.Emit(p2p.Event{Type: p2p.EventAnnounce, Tracker: t.Announce, Err: stopErr})
+		if stopErr != nil {
+			log.Printf("%s: Announcing that we stopped failed: %v", t.Name, stopErr)
+		}
 	}
+	return buf, torrent.Have, err
+}
 
-	outFile, err := os.Create(path)
-	if err != nil {
-		return err
+// files lists the files of a multi-file torrent, or nothing for a single file
+func (t *TorrentFile) files() []p2p.TorrentFile {
+	var files []p2p.TorrentFile
+	for _, entry := range t.Entries {
+		if entry.Path == "" {
+			continue // the file of a single-file v2 torrent
+		}
+		files = append(files, p2p.TorrentFile{
+			Length:  entry.Length,
+			Path:    entry.Path,
+			Name:    entry.Name,
+			Md5sum:  entry.Md5sum,
+			Padding: entry.IsPadding(),
+		})
 	}
-	defer outFile.Close()
-	_, err = outFile.Write(buf)
-	if err != nil {
-		return err
+	return files
+}
+
+// NumPieces returns the number of pieces of the torrent
+func (t *TorrentFile) NumPieces() int {
+	if len(t.PieceHashes) > 0 {
+		return len(t.PieceHashes)
 	}
-	return nil
+	return len(t.piecesV2())
+}
+
+// IsMultiFile returns true if the torrent contains a directory of files
+func (t *TorrentFile) IsMultiFile() bool {
+	return len(t.files()) > 0
+}
+
+// AllowsDHT returns false for private torrents, which must not get peers
+// from the DHT, peer exchange or local service discovery (BEP 27)
+func (t *TorrentFile) AllowsDHT() bool {
+	return !t.Private
 }
 
 // Open parses a torrent file
 func Open(path string) (TorrentFile, error) {
-	file, err := os.Open(path)
+	data, err := ioutil.ReadFile(path)
 	if err != nil {
 		return TorrentFile{}, err
 	}
-	defer file.Close()
 
 	bto := bencodeTorrent{}
-	err = bencode.Unmarshal(file, &bto)
+	err = bencode.Unmarshal(data, &bto)
 	if err != nil {
 		return TorrentFile{}, err
 	}
-	return bto.toTorrentFile()
-}
+	if len(bto.Info.raw) == 0 {
+		return TorrentFile{}, fmt.Errorf("Torrent has no info dictionary")
+	}
+	t, err := bto.toTorrentFile()
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	t.InfoBytes = bto.Info.raw
+	t.InfoHash = sha1.Sum(t.InfoBytes)
 
-func (i *bencodeInfo) hash() ([20]byte, error) {
-	var buf bytes.Buffer
-	err := bencode.Marshal(&buf, *i)
+	err = t.parseV2(&bto)
 	if err != nil {
-		return [20]byte{}, err
+		return TorrentFile{}, err
 	}
-	h := sha1.Sum(buf.Bytes())
-	return h, nil
+	return t, nil
 }
 
 func (i *bencodeInfo) splitPieceHashes() ([][20]byte, error) {
@@ -139,22 +333,22 @@ func (i *bencodeInfo) splitPieceHashes() ([][20]byte, error) {
 }
 
 func (bto *bencodeTorrent) toTorrentFile() (TorrentFile, error) {
-	infoHash, err := bto.Info.hash()
-	if err != nil {
-		return TorrentFile{}, err
-	}
 	pieceHashes, err := bto.Info.splitPieceHashes()
 	if err != nil {
 		return TorrentFile{}, err
 	}
 	t := TorrentFile{
-		Announce:    bto.Announce,
-		InfoHash:    infoHash,
-		PieceHashes: pieceHashes,
-		PieceLength: bto.Info.PieceLength,
-		Length:      bto.Info.Length,
-		Name:        bto.Info.Name,
-		Entries:     make([]FileEntry, len(bto.Info.Files)),
+		Announce:     bto.Announce,
+		AnnounceList: bto.AnnounceList,
+		PieceHashes:  pieceHashes,
+		PieceLength:  bto.Info.PieceLength,
+		Length:       bto.Info.Length,
+		Name:         bto.Info.Name,
+		Entries:      make([]FileEntry, len(bto.Info.Files)),
+		Private:      bto.Info.Private,
+		Source:       bto.Info.Source,
+		WebSeeds:     bto.URLList,
+		HTTPSeeds:    bto.HTTPSeeds,
 	}
 
 	length := 0
@@ -168,6 +362,8 @@ func (bto *bencodeTorrent) toTorrentFile() (TorrentFile, error) {
 		t.Entries[i].Path = path
 		t.Entries[i].Name = file.Path[len(file.Path)-1]
 		t.Entries[i].Md5sum = file.Md5sum
+		t.Entries[i].Attr = file.Attr
+		t.Entries[i].Symlink = file.Symlink
 	}
 
 	if length > 0 {
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"flag"
 	"io/ioutil"
+	"os"
 	"path/filepath"
 	"testing"
 
@@ -51,7 +52,6 @@ func TestToTorrentFile(t *testing.T) {
 			},
 			output: TorrentFile{
 				Announce: "http://bttracker.debian.org:6969/announce",
-				InfoHash: [20]byte{0x68, 0x46, 0xa2, 0xf7, 0x3a, 0x38, 0x8c, 0x3d, 0xc6, 0xb6, 0x3b, 0x56, 0x75, 0xaf, 0x1, 0x3, 0x25, 0xf0, 0x83, 0xb3},
 				PieceHashes: [][20]byte{
 					{49, 50, 51, 52, 53, 54, 55, 56, 57, 48, 97, 98, 99, 100, 101, 102, 103, 104, 105, 106},
 					{97, 98, 99, 100, 101, 102, 103, 104, 105, 106, 49, 50, 51, 52, 53, 54, 55, 56, 57, 48},
@@ -87,7 +87,6 @@ func TestToTorrentFile(t *testing.T) {
 			},
 			output: TorrentFile{
 				Announce: "http://tracker.site1.com/announce",
-				InfoHash: [20]byte{215, 245, 228, 60, 10, 145, 52, 10, 123, 182, 177, 48, 165, 111, 41, 253, 30, 144, 194, 65},
 				PieceHashes: [][20]byte{
 					{49, 50, 51, 52, 53, 54, 55, 56, 57, 48, 97, 98, 99, 100, 101, 102, 103, 104, 105, 106},
 					{97, 98, 99, 100, 101, 102, 103, 104, 105, 106, 49, 50, 51, 52, 53, 54, 55, 56, 57, 48},
@@ -136,3 +135,62 @@ func TestToTorrentFile(t *testing.T) {
 		assert.Equal(t, test.output, to)
 	}
 }
+
+func TestOpenWebSeeds(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storrent")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	info := "4:infod6:lengthi3e4:name1:a12:piece lengthi16384e6:pieces20:aaaaaaaaaaaaaaaaaaaae"
+	tests := map[string]struct {
+		input  string
+		output []string
+		fails  bool
+	}{
+		"single url": {
+			input:  "d" + info + "8:url-list19:http://example.com/e",
+			output: []string{"http://example.com/"},
+		},
+		"list of urls": {
+			input:  "d" + info + "8:url-listl19:http://example.com/18:http://mirror.org/ee",
+			output: []string{"http://example.com/", "http://mirror.org/"},
+		},
+		"empty url": {
+			input:  "d" + info + "8:url-list0:e",
+			output: nil,
+		},
+		"no url-list": {
+			input:  "d" + info + "e",
+			output: nil,
+		},
+		"invalid url-list": {
+			input: "d" + info + "8:url-listi1ee",
+			fails: true,
+		},
+	}
+
+	for name, test := range tests {
+		path := filepath.Join(dir, "webseeds.torrent")
+		require.Nil(t, ioutil.WriteFile(path, []byte(test.input), 0644))
+		tf, err := Open(path)
+		if test.fails {
+			assert.NotNil(t, err, name)
+			continue
+		}
+		require.Nil(t, err, name)
+		assert.Equal(t, test.output, tf.WebSeeds, name)
+	}
+}
+
+func TestOpenHTTPSeeds(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storrent")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	input := "d9:httpseedsl23:http://example.com/seede4:infod6:lengthi3e4:name1:a12:piece lengthi16384e6:pieces20:aaaaaaaaaaaaaaaaaaaaee"
+	path := filepath.Join(dir, "httpseeds.torrent")
+	require.Nil(t, ioutil.WriteFile(path, []byte(input), 0644))
+	tf, err := Open(path)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"http://example.com/seed"}, tf.HTTPSeeds)
+}
@@ -1,24 +1,31 @@
 package torrentfile
 
 import (
+	"context"
 	"fmt"
+	"log"
 	"net/http"
 	"net/url"
 	"strconv"
 	"time"
 
+	"github.com/sjaensch/storrent/bencode"
+	"github.com/sjaensch/storrent/p2p"
 	"github.com/sjaensch/storrent/peers"
-
-	"github.com/jackpal/bencode-go"
 )
 
+// stoppedAnnounceTimeout limits how long shutting down waits for the tracker
+const stoppedAnnounceTimeout = 5 * time.Second
+
 type bencodeTrackerResp struct {
 	Interval int    `bencode:"interval"`
 	Peers    string `bencode:"peers"`
 	Error    string `bencode:"failure reason"`
 }
 
-func (t *TorrentFile) buildTrackerURL(peerID [20]byte, port uint16) (string, error) {
+// buildTrackerURL returns the URL to announce to. event is "started",
+// "stopped" or "completed", or empty for regular announces.
+func (t *TorrentFile) buildTrackerURL(peerID [20]byte, port uint16, event string) (string, error) {
 	base, err := url.Parse(t.Announce)
 	if err != nil {
 		return "", err
@@ -32,25 +39,65 @@ func (t *TorrentFile) buildTrackerURL(peerID [20]byte, port uint16) (string, err
 		"compact":    []string{"1"},
 		"left":       []string{strconv.Itoa(t.Length)},
 	}
+	if event != "" {
+		params.Set("event", event)
+	}
 	base.RawQuery = params.Encode()
 	return base.String(), nil
 }
 
-func (t *TorrentFile) requestPeers(peerID [20]byte, port uint16) ([]peers.Peer, error) {
-	url, err := t.buildTrackerURL(peerID, port)
+func (t *TorrentFile) requestPeers(ctx context.Context, peerID [20]byte, port uint16) ([]peers.Peer, error) {
+	trackerResp, err := t.announce(ctx, peerID, port, "")
+	if err != nil {
+		return nil, err
+	}
+	return peers.Unmarshal([]byte(trackerResp.Peers))
+}
+
+// announceStopped tells the tracker that we stopped downloading
+func (t *TorrentFile) announceStopped(ctx context.Context, peerID [20]byte, port uint16) error {
+	_, err := t.announce(ctx, peerID, port, "stopped")
+	return err
+}
+
+// announcePause tells the tracker that the download was paused or resumed.
+// When resumed, it returns the peers the tracker sent.
+func (t *TorrentFile) announcePause(ctx context.Context, peerID [20]byte, paused bool) []peers.Peer {
+	event := "started"
+	if paused {
+		event = "stopped"
+	}
+	trackerResp, err := t.announce(ctx, peerID, Port, event)
+	var found []peers.Peer
+	if err == nil {
+		found, err = peers.Unmarshal([]byte(trackerResp.Peers))
+	}
+	t.OnEvent.Emit(p2p.Event{Type: p2p.EventAnnounce, Tracker: t.Announce, Peers: len(found), Err: err})
+	if err != nil && ctx.Err() == nil {
+		log.Printf("%s: Announcing that the download %s failed: %v", t.Name, event, err)
+	}
+	return found
+}
+
+func (t *TorrentFile) announce(ctx context.Context, peerID [20]byte, port uint16, event string) (*bencodeTrackerResp, error) {
+	url, err := t.buildTrackerURL(peerID, port, event)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
 
 	c := &http.Client{Timeout: 15 * time.Second}
-	resp, err := c.Get(url)
+	resp, err := c.Do(req)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
 	trackerResp := bencodeTrackerResp{}
-	err = bencode.Unmarshal(resp.Body, &trackerResp)
+	err = bencode.NewDecoder(resp.Body).Decode(&trackerResp)
 	if err != nil {
 		return nil, err
 	}
@@ -58,6 +105,5 @@ func (t *TorrentFile) requestPeers(peerID [20]byte, port uint16) ([]peers.Peer,
 	if trackerResp.Error != "" {
 		return nil, fmt.Errorf("Error getting peers from tracker using URL %v: %v", url, trackerResp.Error)
 	}
-
-	return peers.Unmarshal([]byte(trackerResp.Peers))
+	return &trackerResp, nil
 }
@@ -1,6 +1,7 @@
 package torrentfile
 
 import (
+	"context"
 	"net"
 	"net/http"
 	"net/http/httptest"
@@ -24,10 +25,14 @@ func TestBuildTrackerURL(t *testing.T) {
 	}
 	peerID := [20]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
 	const port uint16 = 6882
-	url, err := to.buildTrackerURL(peerID, port)
+	url, err := to.buildTrackerURL(peerID, port, "")
 	expected := "http://bttracker.debian.org:6969/announce?compact=1&downloaded=0&info_hash=%D8%F79%CE%C3%28%95l%CC%5B%BF%1F%86%D9%FD%CF%DB%A8%CE%B6&left=351272960&peer_id=%01%02%03%04%05%06%07%08%09%0A%0B%0C%0D%0E%0F%10%11%12%13%14&port=6881&uploaded=0"
 	assert.Nil(t, err)
 	assert.Equal(t, url, expected)
+
+	url, err = to.buildTrackerURL(peerID, port, "stopped")
+	assert.Nil(t, err)
+	assert.Contains(t, url, "&event=stopped&")
 }
 
 func TestRequestPeers(t *testing.T) {
@@ -60,7 +65,26 @@ func TestRequestPeers(t *testing.T) {
 		{IP: net.IP{192, 0, 2, 123}, Port: 6881},
 		{IP: net.IP{127, 0, 0, 1}, Port: 6889},
 	}
-	p, err := tf.requestPeers(peerID, port)
+	p, err := tf.requestPeers(context.Background(), peerID, port)
 	assert.Nil(t, err)
 	assert.Equal(t, expected, p)
 }
+
+func TestAnnouncePause(t *testing.T) {
+	events := make(chan string, 2)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		events <- r.URL.Query().Get("event")
+		w.Write([]byte("d8:intervali900e5:peers6:" + string([]byte{192, 0, 2, 123, 0x1A, 0xE1}) + "e"))
+	}))
+	defer ts.Close()
+	tf := TorrentFile{
+		Announce: ts.URL,
+		Length:   100,
+	}
+
+	tf.announcePause(context.Background(), [20]byte{}, true)
+	assert.Equal(t, "stopped", <-events)
+	found := tf.announcePause(context.Background(), [20]byte{}, false)
+	assert.Equal(t, "started", <-events)
+	assert.Equal(t, []peers.Peer{{IP: net.IP{192, 0, 2, 123}, Port: 6881}}, found)
+}
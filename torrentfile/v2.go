@@ -0,0 +1,231 @@
+package torrentfile
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	"github.com/sjaensch/storrent/merkle"
+	"github.com/sjaensch/storrent/p2p"
+)
+
+// MetaVersion2 is the meta version of v2 and hybrid torrents (BEP 52)
+const MetaVersion2 = 2
+
+// IsV2 tells if the torrent has v2 metadata, i.e. is a v2 or hybrid torrent
+func (t *TorrentFile) IsV2() bool {
+	return t.MetaVersion == MetaVersion2
+}
+
+// IsHybrid tells if the torrent has both v1 and v2 metadata
+func (t *TorrentFile) IsHybrid() bool {
+	return t.IsV2() && len(t.PieceHashes) > 0
+}
+
+// v2File is a file from the file tree of a v2 torrent
+type v2File struct {
+	path       []string
+	length     int
+	piecesRoot [32]byte
+}
+
+// parseV2 reads the BEP 52 metadata of a torrent. The file tree is a
+// dictionary with the path components as keys, so it is decoded generically.
+func (t *TorrentFile) parseV2(bto *bencodeTorrent) error {
+	version := bto.Info.MetaVersion
+	if version == 0 {
+		return nil // v1 torrent
+	}
+	if version != MetaVersion2 {
+		return fmt.Errorf("Unsupported meta version %d", version)
+	}
+	if !merkle.IsPowerOfTwo(t.PieceLength) || t.PieceLength < merkle.BlockSize {
+		return fmt.Errorf("Invalid piece length %d for a v2 torrent", t.PieceLength)
+	}
+	tree := bto.Info.FileTree
+	if tree == nil {
+		return fmt.Errorf("v2 torrent has no file tree")
+	}
+	var files []v2File
+	err := walkFileTree(tree, nil, &files)
+	if err != nil {
+		return err
+	}
+	layers := bto.PieceLayers
+
+	t.MetaVersion = MetaVersion2
+	t.InfoHashV2 = sha256.Sum256(t.InfoBytes)
+	if len(t.PieceHashes) == 0 {
+		// pure v2 torrents use the truncated v2 hash wherever 20 bytes are expected
+		copy(t.InfoHash[:], t.InfoHashV2[:20])
+	}
+
+	isSingleFile := len(files) == 1 && len(files[0].path) == 1 && len(t.Entries) == 0
+	if isSingleFile && len(t.PieceHashes) == 0 {
+		t.Length = files[0].length
+	}
+	for _, file := range files {
+		layer, err := t.pieceLayer(file, layers)
+		if err != nil {
+			return err
+		}
+		if isSingleFile {
+			t.Entries = append(t.Entries, FileEntry{
+				Length:     file.length,
+				Name:       file.path[0],
+				PiecesRoot: file.piecesRoot,
+				PieceLayer: layer,
+			})
+			continue
+		}
+		path := filepath.Join(append([]string{t.Name}, file.path[:len(file.path)-1]...)...)
+		name := file.path[len(file.path)-1]
+		entry := t.findEntry(path, name)
+		if entry == nil {
+			if len(t.PieceHashes) > 0 {
+				return fmt.Errorf("File %s of the file tree is missing from the v1 file list", filepath.Join(path, name))
+			}
+			t.Entries = append(t.Entries, FileEntry{Length: file.length, Path: path, Name: name})
+			t.Length += file.length
+			entry = &t.Entries[len(t.Entries)-1]
+		}
+		if entry.Length != file.length {
+			return fmt.Errorf("File %s has length %d in the v1 file list, but %d in the file tree", name, entry.Length, file.length)
+		}
+		entry.PiecesRoot = file.piecesRoot
+		entry.PieceLayer = layer
+	}
+	return nil
+}
+
+func (t *TorrentFile) findEntry(path, name string) *FileEntry {
+	for i := range t.Entries {
+		if t.Entries[i].Path == path && t.Entries[i].Name == name {
+			return &t.Entries[i]
+		}
+	}
+	return nil
+}
+
+// walkFileTree appends the files of a file tree to files, in the order of
+// their keys. Files are dictionaries with an empty key.
+func walkFileTree(tree map[string]interface{}, path []string, files *[]v2File) error {
+	keys := make([]string, 0, len(tree))
+	for key := range tree {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		node, ok := tree[key].(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("Malformed file tree entry %q", key)
+		}
+		if key == "" {
+			if len(path) == 0 {
+				return fmt.Errorf("File tree has a file without a name")
+			}
+			file := v2File{path: path}
+			length, ok := node["length"].(int64)
+			if !ok || length < 0 {
+				return fmt.Errorf("File %s has no valid length", filepath.Join(path...))
+			}
+			file.length = int(length)
+			if file.length > 0 {
+				root, ok := node["pieces root"].(string)
+				if !ok || len(root) != 32 {
+					return fmt.Errorf("File %s has no valid pieces root", filepath.Join(path...))
+				}
+				copy(file.piecesRoot[:], root)
+			}
+			*files = append(*files, file)
+			continue
+		}
+		if key == "." || key == ".." || filepath.Base(key) != key {
+			return fmt.Errorf("Invalid path component %q in file tree", key)
+		}
+		childPath := append(append([]string{}, path...), key)
+		err := walkFileTree(node, childPath, files)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pieceLayer returns the verified piece layer of a file. Files that fit into
+// a single piece don't have one.
+func (t *TorrentFile) pieceLayer(file v2File, layers map[string]interface{}) ([][32]byte, error) {
+	if file.length <= t.PieceLength {
+		return nil, nil
+	}
+	layerStr, ok := layers[string(file.piecesRoot[:])].(string)
+	if !ok {
+		return nil, fmt.Errorf("Piece layer for %s is missing", filepath.Join(file.path...))
+	}
+	numPieces := (file.length + t.PieceLength - 1) / t.PieceLength
+	if len(layerStr) != numPieces*32 {
+		return nil, fmt.Errorf("Piece layer for %s has length %d, expected %d", filepath.Join(file.path...), len(layerStr), numPieces*32)
+	}
+	layer := make([][32]byte, numPieces)
+	for i := range layer {
+		copy(layer[i][:], layerStr[i*32:])
+	}
+	if merkle.FileRoot(layer, t.PieceLength/merkle.BlockSize) != file.piecesRoot {
+		return nil, fmt.Errorf("Piece layer for %s does not match its pieces root", filepath.Join(file.path...))
+	}
+	return layer, nil
+}
+
+// piecesV2 lists the pieces of a v2 torrent. Every file starts at a piece
+// boundary, so the piece at index i starts at i*PieceLength in the data of
+// the torrent if the files are padded to a multiple of the piece length.
+func (t *TorrentFile) piecesV2() []p2p.PieceV2 {
+	var pieces []p2p.PieceV2
+	for _, entry := range t.Entries {
+		if entry.Length == 0 || entry.PiecesRoot == [32]byte{} {
+			continue // empty and v1 padding files
+		}
+		if entry.Length <= t.PieceLength {
+			pieces = append(pieces, p2p.PieceV2{
+				Root:   entry.PiecesRoot,
+				Leaves: merkle.NextPowerOfTwo((entry.Length + merkle.BlockSize - 1) / merkle.BlockSize),
+				Length: entry.Length,
+			})
+			continue
+		}
+		for i, root := range entry.PieceLayer {
+			length := t.PieceLength
+			if i == len(entry.PieceLayer)-1 {
+				length = entry.Length - i*t.PieceLength
+			}
+			pieces = append(pieces, p2p.PieceV2{
+				Root:   root,
+				Leaves: t.PieceLength / merkle.BlockSize,
+				Length: length,
+			})
+		}
+	}
+	return pieces
+}
+
+// alignedLengthV2 returns the length of the torrent data with all but the
+// last file padded to a multiple of the piece length
+func (t *TorrentFile) alignedLengthV2() int {
+	pieces := t.piecesV2()
+	if len(pieces) == 0 {
+		return 0
+	}
+	return (len(pieces)-1)*t.PieceLength + pieces[len(pieces)-1].Length
+}
+
+// VerifyPieceV2 checks data against the merkle tree of a v2 torrent, where
+// index counts the pieces of all files
+func (t *TorrentFile) VerifyPieceV2(index int, data []byte) error {
+	pieces := t.piecesV2()
+	if index < 0 || index >= len(pieces) {
+		return fmt.Errorf("Piece index %d out of range", index)
+	}
+	return pieces[index].Verify(data)
+}
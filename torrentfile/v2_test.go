@@ -0,0 +1,182 @@
+package torrentfile
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sjaensch/storrent/bencode"
+	"github.com/sjaensch/storrent/merkle"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// createHybrid creates a hybrid torrent with a piece length of 32 KiB from
+// a few files and returns the decoded torrent and the file contents
+func createHybrid(t *testing.T, dir string) (map[string]interface{}, map[string][]byte) {
+	contents := map[string][]byte{
+		"a.bin":       bytes.Repeat([]byte("a"), 40000),
+		"b.txt":       []byte("small file"),
+		"c/empty":     {},
+		"c/large.bin": bytes.Repeat([]byte("0123456789abcdef"), 10000),
+	}
+	writeTestFiles(t, filepath.Join(dir, "content"), contents)
+
+	var buf bytes.Buffer
+	_, err := Create(filepath.Join(dir, "content"), CreateOptions{PieceLength: 32768, Hybrid: true}, &buf)
+	require.Nil(t, err)
+	var decoded interface{}
+	err = bencode.Unmarshal(buf.Bytes(), &decoded)
+	require.Nil(t, err)
+	return decoded.(map[string]interface{}), contents
+}
+
+func writeTorrent(t *testing.T, path string, torrent map[string]interface{}) {
+	data, err := bencode.Marshal(torrent)
+	require.Nil(t, err)
+	require.Nil(t, ioutil.WriteFile(path, data, 0644))
+}
+
+func TestOpenHybrid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storrent")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	torrent, contents := createHybrid(t, dir)
+	path := filepath.Join(dir, "hybrid.torrent")
+	writeTorrent(t, path, torrent)
+
+	tf, err := Open(path)
+	require.Nil(t, err)
+	assert.True(t, tf.IsV2())
+	assert.True(t, tf.IsHybrid())
+
+	infoBytes, err := bencode.Marshal(torrent["info"])
+	require.Nil(t, err)
+	assert.Equal(t, sha1.Sum(infoBytes), tf.InfoHash)
+	assert.Equal(t, sha256.Sum256(infoBytes), tf.InfoHashV2)
+
+	// padding files are inserted after a.bin and b.txt
+	names := []string{}
+	for _, entry := range tf.Entries {
+		names = append(names, entry.Name)
+	}
+	assert.Equal(t, []string{"a.bin", "25536", "b.txt", "32758", "empty", "large.bin"}, names)
+	assert.Equal(t, 2*32768+32768+160000, tf.Length)
+
+	large := tf.Entries[5]
+	assert.Len(t, large.PieceLayer, 5)
+	assert.Equal(t, merkle.FileRoot(large.PieceLayer, 2), large.PiecesRoot)
+	assert.Nil(t, tf.Entries[2].PieceLayer)
+	assert.Equal(t, merkle.PieceRoot(contents["b.txt"], 1), tf.Entries[2].PiecesRoot)
+
+	// every piece verifies against both the v1 hash and the merkle tree
+	pieces := tf.piecesV2()
+	assert.Len(t, pieces, len(tf.PieceHashes))
+	data := append(append([]byte{}, contents["a.bin"]...), make([]byte, 25536)...)
+	data = append(append(data, contents["b.txt"]...), make([]byte, 32758)...)
+	data = append(data, contents["c/large.bin"]...)
+	for i, piece := range pieces {
+		begin := i * tf.PieceLength
+		assert.Nil(t, tf.VerifyPieceV2(i, data[begin:begin+piece.Length]), "piece %d", i)
+		end := begin + tf.PieceLength
+		if end > len(data) {
+			end = len(data)
+		}
+		assert.Equal(t, tf.PieceHashes[i], sha1.Sum(data[begin:end]), "piece %d", i)
+	}
+	assert.NotNil(t, tf.VerifyPieceV2(0, bytes.Repeat([]byte("b"), 32768)))
+	assert.NotNil(t, tf.VerifyPieceV2(len(pieces), nil))
+}
+
+func TestOpenV2(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storrent")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// strip the v1 keys from a hybrid torrent to get a pure v2 torrent
+	torrent, _ := createHybrid(t, dir)
+	info := torrent["info"].(map[string]interface{})
+	delete(info, "pieces")
+	delete(info, "files")
+	path := filepath.Join(dir, "v2.torrent")
+	writeTorrent(t, path, torrent)
+
+	tf, err := Open(path)
+	require.Nil(t, err)
+	assert.True(t, tf.IsV2())
+	assert.False(t, tf.IsHybrid())
+	assert.Equal(t, tf.InfoHashV2[:20], tf.InfoHash[:])
+	assert.Equal(t, 40000+10+160000, tf.Length)
+	require.Len(t, tf.Entries, 4)
+	assert.Equal(t, filepath.Join("content", "c"), tf.Entries[3].Path)
+	assert.Equal(t, "large.bin", tf.Entries[3].Name)
+	assert.Equal(t, 3*32768+160000, tf.alignedLengthV2())
+}
+
+func TestOpenV2Errors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storrent")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	tests := map[string]func(torrent, info map[string]interface{}){
+		"tampered piece layer": func(torrent, info map[string]interface{}) {
+			for root, layer := range torrent["piece layers"].(map[string]interface{}) {
+				tampered := []byte(layer.(string))
+				tampered[0]++
+				torrent["piece layers"].(map[string]interface{})[root] = string(tampered)
+			}
+		},
+		"missing piece layers": func(torrent, info map[string]interface{}) {
+			delete(torrent, "piece layers")
+		},
+		"unknown meta version": func(torrent, info map[string]interface{}) {
+			info["meta version"] = 3
+		},
+		"piece length not a power of two": func(torrent, info map[string]interface{}) {
+			info["piece length"] = 3 * 16384
+		},
+		"invalid path component": func(torrent, info map[string]interface{}) {
+			tree := info["file tree"].(map[string]interface{})
+			tree[".."] = tree["a.bin"]
+		},
+	}
+	for name, modify := range tests {
+		torrent, _ := createHybrid(t, filepath.Join(dir, name))
+		modify(torrent, torrent["info"].(map[string]interface{}))
+		path := filepath.Join(dir, name+".torrent")
+		writeTorrent(t, path, torrent)
+
+		_, err := Open(path)
+		assert.NotNil(t, err, name)
+	}
+}
+
+func TestCreateHybridSingleFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storrent")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	content := bytes.Repeat([]byte("x"), 100000)
+	writeTestFiles(t, dir, map[string][]byte{"file.bin": content})
+	var buf bytes.Buffer
+	infoHash, err := Create(filepath.Join(dir, "file.bin"), CreateOptions{PieceLength: 65536, Hybrid: true}, &buf)
+	require.Nil(t, err)
+	path := filepath.Join(dir, "file.torrent")
+	require.Nil(t, ioutil.WriteFile(path, buf.Bytes(), 0644))
+
+	tf, err := Open(path)
+	require.Nil(t, err)
+	assert.Equal(t, infoHash, tf.InfoHash)
+	assert.Equal(t, len(content), tf.Length)
+	require.Len(t, tf.Entries, 1)
+	assert.Equal(t, "file.bin", tf.Entries[0].Name)
+	assert.Nil(t, tf.VerifyPieceV2(1, content[65536:]))
+
+	_, err = Create(filepath.Join(dir, "file.bin"), CreateOptions{PieceLength: 3 * 16384, Hybrid: true}, &buf)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,201 @@
+package torrentfile
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/sjaensch/storrent/p2p"
+)
+
+// VerifyResult reports which parts of the data of a torrent are bad
+type VerifyResult struct {
+	NumPieces    int
+	BadPieces    []int    // pieces that are incomplete or don't match their hash
+	MissingFiles []string // files that don't exist
+	CorruptFiles []string // files that overlap a bad piece, which may also be due to a neighbouring file
+}
+
+// OK returns true if all the data is there and matches its hashes
+func (r *VerifyResult) OK() bool {
+	return len(r.BadPieces) == 0 && len(r.MissingFiles) == 0
+}
+
+// verifySpan is a file on disk and where its data lies in the torrent
+type verifySpan struct {
+	name   string // path within the torrent, for reporting
+	file   *os.File
+	offset int
+	length int
+	pad    bool
+}
+
+// Verify checks the data of the torrent at path against the piece hashes,
+// without any networking. Like for downloads, path is the file of a
+// single-file torrent and the directory containing the torrent's directory
+// for multi-file torrents. Pieces are hashed in parallel. An error is only
+// returned if the check itself fails, bad data is reported in the result.
+func (t *TorrentFile) Verify(path string) (*VerifyResult, error) {
+	spans, result, err := t.openSpans(path)
+	defer closeSpans(spans)
+	if err != nil {
+		return nil, err
+	}
+
+	piecesV2 := t.piecesV2()
+	result.NumPieces = t.NumPieces()
+	bad := make([]bool, result.NumPieces)
+	var mu sync.Mutex
+	err = forEachPiece(result.NumPieces, t.PieceLength, func(index int, buf []byte) error {
+		ok, err := t.verifyPiece(index, spans, piecesV2, buf[:t.pieceSize(index, piecesV2)])
+		if err != nil {
+			return err
+		}
+		if !ok {
+			mu.Lock()
+			bad[index] = true
+			mu.Unlock()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	corrupt := make(map[string]bool)
+	for index, isBad := range bad {
+		if !isBad {
+			continue
+		}
+		result.BadPieces = append(result.BadPieces, index)
+		begin, end := index*t.PieceLength, (index+1)*t.PieceLength
+		for _, span := range spans {
+			if span.file != nil && !span.pad && span.offset < end && span.offset+span.length > begin {
+				corrupt[span.name] = true
+			}
+		}
+	}
+	for name := range corrupt {
+		result.CorruptFiles = append(result.CorruptFiles, name)
+	}
+	sort.Strings(result.CorruptFiles)
+	return result, nil
+}
+
+// pieceSize returns the length of the piece at index
+func (t *TorrentFile) pieceSize(index int, piecesV2 []p2p.PieceV2) int {
+	if len(t.PieceHashes) == 0 {
+		return piecesV2[index].Length
+	}
+	begin := index * t.PieceLength
+	if begin+t.PieceLength > t.Length {
+		return t.Length - begin
+	}
+	return t.PieceLength
+}
+
+// openSpans opens the files of the torrent below path. Missing files are
+// recorded in the result and left nil.
+func (t *TorrentFile) openSpans(path string) ([]verifySpan, *VerifyResult, error) {
+	result := &VerifyResult{}
+	var spans []verifySpan
+	if !t.IsMultiFile() {
+		spans = append(spans, verifySpan{name: t.Name, length: t.Length})
+		file, err := os.Open(path)
+		if err != nil && !os.IsNotExist(err) {
+			return spans, nil, err
+		}
+		if err != nil {
+			result.MissingFiles = append(result.MissingFiles, t.Name)
+		} else {
+			spans[0].file = file
+		}
+		return spans, result, nil
+	}
+
+	offsets := t.fileOffsets()
+	for i, entry := range t.Entries {
+		span := verifySpan{
+			name:   filepath.Join(entry.Path, entry.Name),
+			offset: offsets[i],
+			length: entry.Length,
+			pad:    entry.IsPadding(),
+		}
+		if !span.pad && entry.Length > 0 {
+			filePath, err := entryPath(path, entry)
+			if err != nil {
+				return spans, nil, err
+			}
+			file, err := os.Open(filePath)
+			if err != nil && !os.IsNotExist(err) {
+				return spans, nil, err
+			}
+			if err != nil {
+				result.MissingFiles = append(result.MissingFiles, span.name)
+			}
+			span.file = file
+		}
+		spans = append(spans, span)
+	}
+	return spans, result, nil
+}
+
+func closeSpans(spans []verifySpan) {
+	for _, span := range spans {
+		if span.file != nil {
+			span.file.Close()
+		}
+	}
+}
+
+// verifyPiece reads the piece at index into buf and checks it. Pieces with
+// missing or short files are bad, other read errors are returned.
+func (t *TorrentFile) verifyPiece(index int, spans []verifySpan, piecesV2 []p2p.PieceV2, buf []byte) (bool, error) {
+	begin := index * t.PieceLength
+	end := begin + len(buf)
+	for i := range buf {
+		buf[i] = 0
+	}
+	for _, span := range spans {
+		spanBegin, spanEnd := span.offset, span.offset+span.length
+		if spanEnd <= begin || spanBegin >= end || span.pad {
+			continue
+		}
+		if span.file == nil {
+			return false, nil
+		}
+		from, to := spanBegin, spanEnd
+		if from < begin {
+			from = begin
+		}
+		if to > end {
+			to = end
+		}
+		_, err := span.file.ReadAt(buf[from-begin:to-begin], int64(from-spanBegin))
+		if err == io.EOF {
+			return false, nil // the file is too short
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+
+	if index < len(t.PieceHashes) {
+		hash := sha1.Sum(buf)
+		if !bytes.Equal(hash[:], t.PieceHashes[index][:]) {
+			return false, nil
+		}
+	}
+	if index < len(piecesV2) {
+		piece := piecesV2[index]
+		// pieces of hybrid torrents may be followed by padding
+		if len(buf) < piece.Length || piece.Verify(buf[:piece.Length]) != nil {
+			return false, nil
+		}
+	}
+	return true, nil
+}
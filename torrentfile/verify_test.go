@@ -0,0 +1,112 @@
+package torrentfile
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyHybrid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storrent")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	torrent, _ := createHybrid(t, dir)
+	path := filepath.Join(dir, "hybrid.torrent")
+	writeTorrent(t, path, torrent)
+	tf, err := Open(path)
+	require.Nil(t, err)
+
+	result, err := tf.Verify(dir)
+	require.Nil(t, err)
+	assert.True(t, result.OK())
+	assert.Equal(t, 8, result.NumPieces)
+	assert.Empty(t, result.BadPieces)
+
+	// b.txt is alone in piece 2, large.bin starts at piece 3
+	content := filepath.Join(dir, "content")
+	require.Nil(t, ioutil.WriteFile(filepath.Join(content, "b.txt"), []byte("Small file"), 0644))
+	require.Nil(t, os.Truncate(filepath.Join(content, "c", "large.bin"), 100000))
+	require.Nil(t, os.Remove(filepath.Join(content, "a.bin")))
+
+	result, err = tf.Verify(dir)
+	require.Nil(t, err)
+	assert.False(t, result.OK())
+	assert.Equal(t, []int{0, 1, 2, 6, 7}, result.BadPieces)
+	assert.Equal(t, []string{filepath.Join("content", "a.bin")}, result.MissingFiles)
+	assert.Equal(t, []string{filepath.Join("content", "b.txt"), filepath.Join("content", "c", "large.bin")}, result.CorruptFiles)
+}
+
+func TestVerifyV2(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storrent")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	torrent, _ := createHybrid(t, dir)
+	info := torrent["info"].(map[string]interface{})
+	delete(info, "pieces")
+	delete(info, "files")
+	path := filepath.Join(dir, "v2.torrent")
+	writeTorrent(t, path, torrent)
+	tf, err := Open(path)
+	require.Nil(t, err)
+
+	result, err := tf.Verify(dir)
+	require.Nil(t, err)
+	assert.True(t, result.OK())
+
+	large := filepath.Join(dir, "content", "c", "large.bin")
+	f, err := os.OpenFile(large, os.O_WRONLY, 0)
+	require.Nil(t, err)
+	_, err = f.WriteAt([]byte("X"), 32768)
+	require.Nil(t, err)
+	require.Nil(t, f.Close())
+
+	result, err = tf.Verify(dir)
+	require.Nil(t, err)
+	assert.False(t, result.OK())
+	assert.Equal(t, []int{4}, result.BadPieces)
+	assert.Empty(t, result.MissingFiles)
+	assert.Equal(t, []string{filepath.Join("content", "c", "large.bin")}, result.CorruptFiles)
+}
+
+func TestVerifySingleFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storrent")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 5000)
+	writeTestFiles(t, dir, map[string][]byte{"single.bin": data})
+	path := filepath.Join(dir, "single.torrent")
+	f, err := os.Create(path)
+	require.Nil(t, err)
+	_, err = Create(filepath.Join(dir, "single.bin"), CreateOptions{PieceLength: 32768}, f)
+	require.Nil(t, err)
+	require.Nil(t, f.Close())
+	tf, err := Open(path)
+	require.Nil(t, err)
+
+	result, err := tf.Verify(filepath.Join(dir, "single.bin"))
+	require.Nil(t, err)
+	assert.True(t, result.OK())
+	assert.Equal(t, 3, result.NumPieces)
+
+	data[70000] = 'X'
+	writeTestFiles(t, dir, map[string][]byte{"single.bin": data})
+	result, err = tf.Verify(filepath.Join(dir, "single.bin"))
+	require.Nil(t, err)
+	assert.Equal(t, []int{2}, result.BadPieces)
+	assert.Equal(t, []string{"single.bin"}, result.CorruptFiles)
+
+	result, err = tf.Verify(filepath.Join(dir, "missing.bin"))
+	require.Nil(t, err)
+	assert.False(t, result.OK())
+	assert.Equal(t, []int{0, 1, 2}, result.BadPieces)
+	assert.Equal(t, []string{"single.bin"}, result.MissingFiles)
+	assert.Empty(t, result.CorruptFiles)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/sjaensch/storrent/torrentfile"
+)
+
+func verify(args []string) {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: storrent verify <torrent file> <path>\n\n")
+		fmt.Fprintf(flags.Output(), "path is the downloaded file, or the directory the torrent's directory was saved to\n")
+	}
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	tf, err := torrentfile.Open(flags.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	result, err := tf.Verify(flags.Arg(1))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, name := range result.MissingFiles {
+		fmt.Printf("Missing: %s\n", name)
+	}
+	for _, name := range result.CorruptFiles {
+		fmt.Printf("Corrupt: %s\n", name)
+	}
+	if len(result.BadPieces) > 0 {
+		fmt.Printf("Bad pieces: %s\n", formatRanges(result.BadPieces))
+	}
+	fmt.Printf("%d of %d pieces ok\n", result.NumPieces-len(result.BadPieces), result.NumPieces)
+	if !result.OK() {
+		os.Exit(1)
+	}
+}
+
+// formatRanges formats sorted integers, collapsing consecutive ones into ranges
+func formatRanges(values []int) string {
+	var parts []string
+	for i := 0; i < len(values); {
+		j := i
+		for j+1 < len(values) && values[j+1] == values[j]+1 {
+			j++
+		}
+		if i == j {
+			parts = append(parts, fmt.Sprint(values[i]))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", values[i], values[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(parts, ", ")
+}